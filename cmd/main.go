@@ -6,9 +6,11 @@ import (
 	"net/http"
 	"os"
 	"os/signal"
+	"path/filepath"
 	"strconv"
 	"strings"
 	"syscall"
+	"time"
 
 	"github.com/sirupsen/logrus"
 	"github.com/virtual-kubelet/virtual-kubelet/log"
@@ -17,6 +19,8 @@ import (
 	docker "github.com/intertwin-eu/interlink-docker-plugin/pkg/docker"
 	"github.com/intertwin-eu/interlink-docker-plugin/pkg/docker/dindmanager"
 	"github.com/intertwin-eu/interlink-docker-plugin/pkg/docker/gpustrategies"
+	"github.com/intertwin-eu/interlink-docker-plugin/pkg/docker/runtime"
+	"github.com/intertwin-eu/interlink-docker-plugin/pkg/docker/statestore"
 )
 
 func main() {
@@ -60,27 +64,70 @@ func main() {
 		log.G(Ctx).Fatal(err)
 	}
 
-	availableDinds := os.Getenv("AVAILABLEDINDS")
-	if availableDinds == "" {
-		availableDinds = "2"
+	var containerRuntime runtime.ContainerRuntime
+	if interLinkConfig.ContainerRuntime == commonIL.ContainerRuntimePodman {
+		containerRuntime, err = runtime.NewPodmanRuntime(interLinkConfig.PodmanSocket)
+	} else {
+		containerRuntime, err = runtime.NewDockerRuntime()
+	}
+	if err != nil {
+		log.G(Ctx).Fatal(err)
+	}
+
+	dataRoot, err := commonIL.DataRootPath(interLinkConfig)
+	if err != nil {
+		log.G(Ctx).Fatal(err)
+	}
+
+	dindIdleTTL, err := time.ParseDuration(interLinkConfig.DindIdleTTL)
+	if err != nil {
+		log.G(Ctx).Fatal(err)
+	}
+
+	// the DIND containers of the pods are built on demand in their cgroup parent, idle ones could not serve them
+	dindMinIdle := *interLinkConfig.DindMinIdle
+	if interLinkConfig.DindCgroupParent != "" {
+		log.G(Ctx).Info("\u2705 DindCgroupParent is set, DIND containers are built on demand instead of being kept idle")
+		dindMinIdle = 0
 	}
+
 	var dindHandler dindmanager.DindManagerInterface
 	dindHandler = &dindmanager.DindManager{
-		DindList: []dindmanager.DindSpecs{},
-		Ctx:      Ctx,
+		DindList:             []dindmanager.DindSpecs{},
+		Ctx:                  Ctx,
+		Runtime:              containerRuntime,
+		SocketsFolder:        filepath.Join(dataRoot, "dinds"),
+		InstanceID:           interLinkConfig.InstanceID,
+		MinIdle:              dindMinIdle,
+		MaxTotal:             interLinkConfig.DindMaxTotal,
+		MaxConcurrentWarmups: interLinkConfig.DindMaxConcurrentWarmups,
+		IdleTTL:              dindIdleTTL,
 	}
-	availableDindsInt, err := strconv.ParseInt(availableDinds, 10, 8)
+
+	stateStore, err := statestore.Open(filepath.Join(dataRoot, "state.json"))
 	if err != nil {
 		log.G(Ctx).Fatal(err)
 	}
-	dindHandler.CleanDindContainers()
-	dindHandler.BuildDindContainers(int8(availableDindsInt))
 
 	SidecarAPIs := docker.SidecarHandler{
 		Config:      interLinkConfig,
 		Ctx:         Ctx,
 		GpuManager:  gpuManager,
 		DindManager: dindHandler,
+		Runtime:     containerRuntime,
+		StateStore:  stateStore,
+	}
+
+	// running pods survive a restart: their DIND containers are re-adopted instead of being cleaned
+	_, err = SidecarAPIs.Reconcile()
+	if err != nil {
+		log.G(Ctx).Fatal(err)
+	}
+
+	// the pool controller builds the idle DIND containers missing after the reconciliation. In host mode the pods run on
+	// the host docker daemon and no DIND container is needed.
+	if interLinkConfig.ExecutionMode == commonIL.ExecutionModeDind {
+		go dindHandler.RunPoolController(Ctx)
 	}
 
 	mutex := http.NewServeMux()
@@ -2,11 +2,14 @@ package common
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"flag"
 	"fmt"
 	"io"
 	"net/http"
 	"os"
+	"path/filepath"
 	"strconv"
 
 	"k8s.io/client-go/kubernetes"
@@ -121,11 +124,79 @@ func NewInterLinkConfig() (InterLinkConfig, error) {
 			InterLinkConfigInst.VKTokenFile = path
 		}
 
+		if InterLinkConfigInst.ExecutionMode == "" {
+			InterLinkConfigInst.ExecutionMode = ExecutionModeDind
+		} else if InterLinkConfigInst.ExecutionMode != ExecutionModeDind && InterLinkConfigInst.ExecutionMode != ExecutionModeHost {
+			log.G(context.Background()).Error("\u274C ExecutionMode must be " + ExecutionModeDind + " or " + ExecutionModeHost + ". Exiting...")
+			return InterLinkConfig{}, fmt.Errorf("unknown execution mode %s", InterLinkConfigInst.ExecutionMode)
+		}
+
+		if InterLinkConfigInst.ContainerRuntime == "" {
+			InterLinkConfigInst.ContainerRuntime = ContainerRuntimeDocker
+		} else if InterLinkConfigInst.ContainerRuntime != ContainerRuntimeDocker && InterLinkConfigInst.ContainerRuntime != ContainerRuntimePodman {
+			log.G(context.Background()).Error("\u274C ContainerRuntime must be " + ContainerRuntimeDocker + " or " + ContainerRuntimePodman + ". Exiting...")
+			return InterLinkConfig{}, fmt.Errorf("unknown container runtime %s", InterLinkConfigInst.ContainerRuntime)
+		}
+
+		if InterLinkConfigInst.InfraImage == "" {
+			InterLinkConfigInst.InfraImage = DefaultInfraImage
+		}
+
+		// AVAILABLEDINDS is kept for compatibility, it overrides DindMinIdle
+		if os.Getenv("AVAILABLEDINDS") != "" {
+			availableDinds, err := strconv.Atoi(os.Getenv("AVAILABLEDINDS"))
+			if err != nil {
+				log.G(context.Background()).Error("\u274C AVAILABLEDINDS must be an integer. Exiting...")
+				return InterLinkConfig{}, err
+			}
+			InterLinkConfigInst.DindMinIdle = &availableDinds
+		} else if InterLinkConfigInst.DindMinIdle == nil {
+			defaultMinIdle := 2
+			InterLinkConfigInst.DindMinIdle = &defaultMinIdle
+		}
+
+		if InterLinkConfigInst.DindMaxConcurrentWarmups == 0 {
+			InterLinkConfigInst.DindMaxConcurrentWarmups = 2
+		}
+
+		if InterLinkConfigInst.DindIdleTTL == "" {
+			InterLinkConfigInst.DindIdleTTL = "10m"
+		}
+
+		if InterLinkConfigInst.DindCPUOverhead == "" {
+			InterLinkConfigInst.DindCPUOverhead = "100m"
+		}
+
+		if InterLinkConfigInst.DindMemoryOverhead == "" {
+			InterLinkConfigInst.DindMemoryOverhead = "256Mi"
+		}
+
+		if os.Getenv("INSTANCEID") != "" {
+			InterLinkConfigInst.InstanceID = os.Getenv("INSTANCEID")
+		} else if InterLinkConfigInst.InstanceID == "" {
+			// instances sharing a host need their own data folder, so it identifies the instance across restarts
+			dataRoot, err := DataRootPath(InterLinkConfigInst)
+			if err != nil {
+				return InterLinkConfig{}, err
+			}
+			sum := sha256.Sum256([]byte(dataRoot))
+			InterLinkConfigInst.InstanceID = hex.EncodeToString(sum[:6])
+		}
+
 		InterLinkConfigInst.set = true
 	}
 	return InterLinkConfigInst, nil
 }
 
+// DataRootPath returns the absolute path of the DataRootFolder of config, which is relative to the working directory
+func DataRootPath(config InterLinkConfig) (string, error) {
+	wd, err := os.Getwd()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(wd, config.DataRootFolder), nil
+}
+
 // PingInterLink pings the InterLink API and returns true if there's an answer. The second return value is given by the answer provided by the API.
 func PingInterLink(ctx context.Context) (bool, int, error) {
 	log.G(ctx).Info("Pinging: " + InterLinkConfigInst.Interlinkurl + ":" + InterLinkConfigInst.Interlinkport + "/pinglink")
@@ -21,6 +21,23 @@ type PodStatus struct {
 	JobID          string               `json:"JID"`
 	Containers     []v1.ContainerStatus `json:"containers"`
 	InitContainers []v1.ContainerStatus `json:"initContainers"`
+	// Phase, Reason and Message are set when the sidecar knows the phase of the pod, e.g. when its DIND container failed
+	Phase   v1.PodPhase `json:"phase,omitempty"`
+	Reason  string      `json:"reason,omitempty"`
+	Message string      `json:"message,omitempty"`
+	// PodIP is the address of the pod, HostIP the one of the host publishing its ports
+	PodIP  string        `json:"podIP,omitempty"`
+	HostIP string        `json:"hostIP,omitempty"`
+	Ports  []PortMapping `json:"ports,omitempty"`
+}
+
+// PortMapping is a container port of a pod published on a port of the host
+type PortMapping struct {
+	ContainerName string      `json:"containerName"`
+	ContainerPort int32       `json:"containerPort"`
+	HostPort      int32       `json:"hostPort"`
+	HostIP        string      `json:"hostIP,omitempty"`
+	Protocol      v1.Protocol `json:"protocol"`
 }
 
 // RetrievedContainer is used in InterLink to rearrange data structure in a suitable way for the sidecar
@@ -38,6 +55,22 @@ type RetrievedPodData struct {
 	InitContainers []RetrievedContainer `json:"initContainer"`
 }
 
+// Execution modes: in dind mode each pod runs in its own DIND container, in host mode the containers of a pod run on
+// the host docker daemon, in a bridge network of the pod
+const (
+	ExecutionModeDind = "dind"
+	ExecutionModeHost = "host"
+)
+
+// Container runtimes the sidecar can drive
+const (
+	ContainerRuntimeDocker = "docker"
+	ContainerRuntimePodman = "podman"
+)
+
+// DefaultInfraImage is the image of the infra containers holding the namespaces shared by the containers of a pod
+const DefaultInfraImage = "registry.k8s.io/pause:3.9"
+
 // InterLinkConfig holds the whole configuration
 type InterLinkConfig struct {
 	VKConfigPath      string `yaml:"VKConfigPath"`
@@ -64,7 +97,21 @@ type InterLinkConfig struct {
 	ErrorsOnlyLogging bool   `yaml:"ErrorsOnlyLogging"`
 	PodIP             string `yaml:"PodIP"`
 	SingularityPrefix string `yaml:"SingularityPrefix"`
-	set               bool
+	InstanceID        string `yaml:"InstanceID"`
+	ExecutionMode     string `yaml:"ExecutionMode"`
+	ContainerRuntime  string `yaml:"ContainerRuntime"`
+	PodmanSocket      string `yaml:"PodmanSocket"`
+	InfraImage        string `yaml:"InfraImage"`
+	// sizing of the DIND pool, DindMinIdle is nil if not set, so that 0 can be set explicitly
+	DindMinIdle              *int   `yaml:"DindMinIdle"`
+	DindMaxTotal             int    `yaml:"DindMaxTotal"`
+	DindMaxConcurrentWarmups int    `yaml:"DindMaxConcurrentWarmups"`
+	DindIdleTTL              string `yaml:"DindIdleTTL"`
+	// resources of the DIND containers
+	DindCgroupParent   string `yaml:"DindCgroupParent"`
+	DindCPUOverhead    string `yaml:"DindCPUOverhead"`
+	DindMemoryOverhead string `yaml:"DindMemoryOverhead"`
+	set                bool
 }
 
 // ContainerLogOpts is a struct in which it is possible to specify options to retrieve logs from the sidecar
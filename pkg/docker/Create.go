@@ -2,14 +2,13 @@ package docker
 
 import (
 	"encoding/json"
+	"fmt"
 	"io"
 	"net/http"
 	"os"
 	"strconv"
-	"strings"
 	"time"
 
-	exec "github.com/alexellis/go-execute/pkg/v1"
 	"github.com/containerd/containerd/log"
 	v1 "k8s.io/api/core/v1"
 
@@ -17,14 +16,14 @@ import (
 
 	commonIL "github.com/intertwin-eu/interlink-docker-plugin/pkg/common"
 	"github.com/intertwin-eu/interlink-docker-plugin/pkg/docker/dindmanager"
-
-	"path/filepath"
+	"github.com/intertwin-eu/interlink-docker-plugin/pkg/docker/runtime"
+	"github.com/intertwin-eu/interlink-docker-plugin/pkg/docker/statestore"
 )
 
-func (h *SidecarHandler) prepareDockerRuns(podData commonIL.RetrievedPodData, w http.ResponseWriter) ([]DockerRunStruct, error) {
+// prepareDockerRuns translates the containers of a pod to their DockerRunSpec, init containers first
+func (h *SidecarHandler) prepareDockerRuns(podData commonIL.RetrievedPodData, w http.ResponseWriter) ([]DockerRunSpec, error) {
 
-	var dockerRunStructs []DockerRunStruct
-	var gpuArgs string = ""
+	var dockerRunStructs []DockerRunSpec
 
 	podUID := string(podData.Pod.UID)
 	podNamespace := string(podData.Pod.Namespace)
@@ -66,20 +65,61 @@ func (h *SidecarHandler) prepareDockerRuns(podData commonIL.RetrievedPodData, w
 		}
 	}
 
-	allContainers := map[string][]v1.Container{
-		"initContainers": podData.Pod.Spec.InitContainers,
-		"containers":     podData.Pod.Spec.Containers,
+	dockerOptions := DockerOptions{}
+	if dockerFlags, ok := podData.Pod.ObjectMeta.Annotations["docker-options.vk.io/flags"]; ok {
+		var unsupportedOptions []string
+		var err error
+		dockerOptions, unsupportedOptions, err = parseDockerOptions(dockerFlags)
+		if err != nil {
+			HandleErrorAndRemoveData(h, w, "An error occurred during the parse of the docker-options.vk.io/flags annotation", err, podNamespace, podUID)
+			return dockerRunStructs, err
+		}
+		for _, option := range unsupportedOptions {
+			log.G(h.Ctx).Warning("\u26A0 Docker option " + option + " of pod " + podUID + " is not supported and will be ignored")
+		}
+	}
+
+	envSources := newPodEnvSources(podData)
+
+	allContainers := []struct {
+		isInitContainer bool
+		containers      []v1.Container
+	}{
+		{isInitContainer: true, containers: podData.Pod.Spec.InitContainers},
+		{isInitContainer: false, containers: podData.Pod.Spec.Containers},
 	}
 
-	for containerType, containers := range allContainers {
-		isInitContainer := containerType == "initContainers"
+	for _, containerGroup := range allContainers {
+		isInitContainer := containerGroup.isInitContainer
 
-		for _, container := range containers {
+		for _, container := range containerGroup.containers {
 
 			containerName := podNamespace + "-" + podUID + "-" + container.Name
 
-			var isGpuRequested bool = false
-			var additionalGpuArgs []string
+			runSpec := DockerRunSpec{
+				Name:            containerName,
+				ContainerName:   container.Name,
+				Image:           container.Image,
+				IsInitContainer: isInitContainer,
+				IsSidecar:       isInitContainer && isSidecar(container),
+				NetworkMode:     "host",
+				Labels: map[string]string{
+					dindmanager.LabelInstance: h.Config.InstanceID,
+					dindmanager.LabelRole:     dindmanager.RolePod,
+					LabelPodUID:               podUID,
+					LabelPodNamespace:         podNamespace,
+					LabelPodName:              podData.Pod.Name,
+					LabelContainerName:        container.Name,
+				},
+				Options: dockerOptions,
+			}
+
+			env, err := containerEnv(&podData.Pod, envSources, container)
+			if err != nil {
+				HandleErrorAndRemoveData(h, w, "An error occurred during the resolution of the environment of container "+container.Name, err, podNamespace, podUID)
+				return dockerRunStructs, fmt.Errorf("environment of container %s: %w", container.Name, err)
+			}
+			runSpec.Env = env
 
 			if val, ok := container.Resources.Limits["nvidia.com/gpu"]; ok {
 
@@ -92,8 +132,6 @@ func (h *SidecarHandler) prepareDockerRuns(podData commonIL.RetrievedPodData, w
 
 					log.G(h.Ctx).Info("\u2705 Container " + containerName + " is requesting " + val.String() + " GPU")
 
-					isGpuRequested = true
-
 					numGpusRequestedInt := int(numGpusRequested)
 					_, err := h.GpuManager.GetAvailableGPUs(numGpusRequestedInt)
 
@@ -108,135 +146,68 @@ func (h *SidecarHandler) prepareDockerRuns(podData commonIL.RetrievedPodData, w
 						return dockerRunStructs, errors.New("An error occurred during request of get and assign of an available GPU")
 					}
 
-					var gpuUUIDs string = ""
 					for _, gpuSpec := range gpuSpecs {
-						if gpuSpec.UUID == gpuSpecs[len(gpuSpecs)-1].UUID {
-							gpuUUIDs += strconv.Itoa(gpuSpec.Index)
-						} else {
-							gpuUUIDs += strconv.Itoa(gpuSpec.Index) + ","
-						}
+						runSpec.GPUs = append(runSpec.GPUs, strconv.Itoa(gpuSpec.Index))
 					}
-
-					additionalGpuArgs = append(additionalGpuArgs, "--runtime=nvidia -e NVIDIA_VISIBLE_DEVICES="+gpuUUIDs)
-					gpuArgs = "--runtime=nvidia -e NVIDIA_VISIBLE_DEVICES=" + gpuUUIDs
 				}
 
 			}
 
-			var envVars string = ""
-			for _, envVar := range container.Env {
-				if envVar.Value != "" {
-					if strings.Contains(envVar.Value, "[") {
-						envVars += " -e " + envVar.Name + "='" + envVar.Value + "'"
-					} else {
-						envVars += " -e " + envVar.Name + "=" + envVar.Value
-					}
-				} else {
-					envVars += " -e " + envVar.Name
-				}
-			}
-
 			for _, volumeMount := range container.VolumeMounts {
 				if volumeMount.MountPath != "" {
 
 					if _, ok := pathsOfVolumes[volumeMount.Name]; !ok {
 						continue
 					}
-					if volumeMount.ReadOnly {
-						envVars += " -v " + pathsOfVolumes[volumeMount.Name] + ":" + volumeMount.MountPath + ":ro"
-					} else {
-						if volumeMount.MountPropagation != nil && *volumeMount.MountPropagation == v1.MountPropagationBidirectional {
-							envVars += " -v " + pathsOfVolumes[volumeMount.Name] + ":" + volumeMount.MountPath + ":shared"
-						} else {
-							envVars += " -v " + pathsOfVolumes[volumeMount.Name] + ":" + volumeMount.MountPath
-						}
+					mount := runtime.Mount{Source: pathsOfVolumes[volumeMount.Name], Target: volumeMount.MountPath, ReadOnly: volumeMount.ReadOnly}
+					if !volumeMount.ReadOnly && volumeMount.MountPropagation != nil && *volumeMount.MountPropagation == v1.MountPropagationBidirectional {
+						mount.Propagation = "shared"
 					}
+					runSpec.Mounts = append(runSpec.Mounts, mount)
 				}
 			}
 
-			envVars += " --network=host"
-			cmd := []string{"run", "-d", "--name", containerName}
-
-			cmd = append(cmd, envVars)
-
 			if container.SecurityContext != nil && container.SecurityContext.Privileged != nil && *container.SecurityContext.Privileged {
-				cmd = append(cmd, "--privileged")
-			}
-
-			if isGpuRequested {
-				cmd = append(cmd, additionalGpuArgs...)
+				runSpec.Privileged = true
 			}
 
-			var additionalPortArgs []string
-
+			// ports without a host port are published on a free port of the host
 			for _, port := range container.Ports {
-				if port.HostPort != 0 {
-					additionalPortArgs = append(additionalPortArgs, "-p", strconv.Itoa(int(port.HostPort))+":"+strconv.Itoa(int(port.ContainerPort)))
-				}
+				runSpec.Ports = append(runSpec.Ports, runtime.PortBinding{HostIP: port.HostIP, HostPort: int(port.HostPort), ContainerPort: int(port.ContainerPort), Protocol: string(port.Protocol)})
 			}
 
-			cmd = append(cmd, additionalPortArgs...)
-
 			mounts, err := prepareMounts(h.Ctx, h.Config, podData, container)
 			if err != nil {
 				HandleErrorAndRemoveData(h, w, "An error occurred during preparing mounts for the POD", err, podNamespace, podUID)
 				return dockerRunStructs, errors.New("An error occurred during preparing mounts for the POD")
 			}
 
-			cmd = append(cmd, mounts)
+			runSpec.Mounts = append(runSpec.Mounts, mounts...)
 
-			memoryLimitsArray := []string{}
-			cpuLimitsArray := []string{}
-
-			if container.Resources.Limits.Memory().Value() != 0 {
-				memoryLimitsArray = append(memoryLimitsArray, "--memory", strconv.Itoa(int(container.Resources.Limits.Memory().Value()))+"b")
-			}
-			if container.Resources.Limits.Cpu().Value() != 0 {
-				cpuLimitsArray = append(cpuLimitsArray, "--cpus", strconv.FormatFloat(float64(container.Resources.Limits.Cpu().Value()), 'f', -1, 64))
-			}
-
-			cmd = append(cmd, memoryLimitsArray...)
-			cmd = append(cmd, cpuLimitsArray...)
-
-			containerCommands := []string{}
-			containerArgs := []string{}
-			mountFileCommand := []string{}
-
-			// if container has a command and args, call parseContainerCommandAndReturnArgs
-			if len(container.Command) > 0 || len(container.Args) > 0 {
-				mountFileCommand, containerCommands, containerArgs, err = parseContainerCommandAndReturnArgs(h.Ctx, h.Config, podUID, podNamespace, container)
+			if container.TerminationMessagePath != "" {
+				mount, err := prepareTerminationMessage(h.Config, podData.Pod, container)
 				if err != nil {
-					HandleErrorAndRemoveData(h, w, "An error occurred during the parse of the container commands and arguments", err, podNamespace, podUID)
-					return dockerRunStructs, errors.New("An error occurred during the parse of the container commands and arguments")
+					HandleErrorAndRemoveData(h, w, "An error occurred during the creation of the termination message file of container "+container.Name, err, podNamespace, podUID)
+					return dockerRunStructs, fmt.Errorf("termination message file of container %s: %w", container.Name, err)
 				}
-				cmd = append(cmd, mountFileCommand...)
+				runSpec.Mounts = append(runSpec.Mounts, mount)
 			}
 
-			cmd = append(cmd, container.Image)
-			cmd = append(cmd, containerCommands...)
-			cmd = append(cmd, containerArgs...)
-
-			dockerOptions := ""
+			runSpec.WorkingDir = container.WorkingDir
+			runSpec.Stdin, runSpec.StdinOnce, runSpec.TTY = container.Stdin, container.StdinOnce, container.TTY
 
-			if dockerFlags, ok := podData.Pod.ObjectMeta.Annotations["docker-options.vk.io/flags"]; ok {
-				parsedDockerOptions := strings.Split(dockerFlags, " ")
-				for _, option := range parsedDockerOptions {
-					dockerOptions += " " + option
-				}
+			if container.Resources.Limits.Memory().Value() != 0 {
+				runSpec.Resources.Memory = container.Resources.Limits.Memory().Value()
 			}
-
-			shell := exec.ExecTask{
-				Command: "docker" + dockerOptions,
-				Args:    cmd,
-				Shell:   true,
+			if container.Resources.Limits.Cpu().MilliValue() != 0 {
+				runSpec.Resources.NanoCPUs = container.Resources.Limits.Cpu().MilliValue() * 1000000
 			}
 
-			dockerRunStructs = append(dockerRunStructs, DockerRunStruct{
-				Name:            containerName,
-				Command:         "docker " + strings.Join(shell.Args, " "),
-				IsInitContainer: isInitContainer,
-				GpuArgs:         gpuArgs,
-			})
+			// the command overrides the entrypoint of the image and the args its cmd, the $(VAR) references of both
+			// referring to the environment of the container
+			runSpec.Entrypoint, runSpec.Args = expandCommand(container, runSpec.Env)
+
+			dockerRunStructs = append(dockerRunStructs, runSpec)
 		}
 	}
 
@@ -247,37 +218,6 @@ func (h *SidecarHandler) CreateHandler(w http.ResponseWriter, r *http.Request) {
 
 	log.G(h.Ctx).Info("\u23F3 [CREATE CALL] Received create call from InterLink ")
 
-	// create bool variable to set if a new dind container has to be created
-	newDindContainerCreated := false
-
-	// get a dind container ID from dind manager of the sidecard handler
-	dindContainerID, err := h.DindManager.GetAvailableDind()
-	if err != nil {
-
-		log.G(h.Ctx).Info("\u2705 [POD FLOW] No available DIND container found, creating a new one")
-
-		h.DindManager.BuildDindContainers(1)
-		dindContainerID, err = h.DindManager.GetAvailableDind()
-		if err != nil {
-			HandleErrorAndRemoveData(h, w, "During creation of new DIND container, an error occurred during the request of get available DIND container", err, "", "")
-			return
-		}
-		newDindContainerCreated = true
-	}
-
-	// remove the dind container from the list of available dind containers
-	err = h.DindManager.SetDindUnavailable(dindContainerID)
-	if err != nil {
-		HandleErrorAndRemoveData(h, w, "An error occurred during the removal of the DIND container from the list of available DIND containers", err, "", "")
-		return
-	}
-
-	if !newDindContainerCreated {
-		// create a new dind container in background
-		go h.DindManager.BuildDindContainers(1)
-	}
-
-	//var execReturn exec.ExecResult
 	statusCode := http.StatusOK
 
 	bodyBytes, err := io.ReadAll(r.Body)
@@ -294,20 +234,18 @@ func (h *SidecarHandler) CreateHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	wd, err := os.Getwd()
-	if err != nil {
-		HandleErrorAndRemoveData(h, w, "Unable to get current working directory", err, "", "")
-		return
-	}
-
-	log.G(h.Ctx).Info("\u2705 [POD FLOW] Request data unmarshalled successfully and current working directory detected")
+	log.G(h.Ctx).Info("\u2705 [POD FLOW] Request data unmarshalled successfully")
 
 	for _, data := range req {
 
 		podUID := string(data.Pod.UID)
 		podNamespace := string(data.Pod.Namespace)
 
-		podDirectoryPath := filepath.Join(wd, h.Config.DataRootFolder+"/"+podNamespace+"-"+podUID)
+		podDirectoryPath, err := podDirectory(h.Config, podNamespace, podUID)
+		if err != nil {
+			HandleErrorAndRemoveData(h, w, "Unable to get the directory of the pod", err, "", "")
+			return
+		}
 
 		// if the podDirectoryPath does not exist, create it
 		if _, err := os.Stat(podDirectoryPath); os.IsNotExist(err) {
@@ -318,7 +256,7 @@ func (h *SidecarHandler) CreateHandler(w http.ResponseWriter, r *http.Request) {
 			}
 		}
 
-		// call prepareDockerRuns to get the DockerRunStruct array
+		// call prepareDockerRuns to get the DockerRunSpec array
 		dockerRunStructs, err := h.prepareDockerRuns(data, w)
 		if err != nil {
 			HandleErrorAndRemoveData(h, w, "An error occurred during preparing of docker run commmands", err, "", "")
@@ -327,10 +265,16 @@ func (h *SidecarHandler) CreateHandler(w http.ResponseWriter, r *http.Request) {
 
 		log.G(h.Ctx).Info("\u2705 [POD FLOW] Docker run commands prepared successfully")
 
+		err = allocateHostPorts(dockerRunStructs)
+		if err != nil {
+			HandleErrorAndRemoveData(h, w, "An error occurred during the allocation of the host ports of the pod", err, podNamespace, podUID)
+			return
+		}
+		ports := podPortMappings(dockerRunStructs)
+
 		// from dockerRunStructs, create two arrays: one for initContainers and one for containers
-		var initContainers []DockerRunStruct
-		var containers []DockerRunStruct
-		//var gpuArgs string
+		var initContainers []DockerRunSpec
+		var containers []DockerRunSpec
 
 		for _, dockerRunStruct := range dockerRunStructs {
 			if dockerRunStruct.IsInitContainer {
@@ -340,207 +284,67 @@ func (h *SidecarHandler) CreateHandler(w http.ResponseWriter, r *http.Request) {
 			}
 		}
 
-		// // check if between the containers there is a container that requires a GPU
-		// for _, container := range containers {
-		// 	if container.GpuArgs != "" {
-		// 		gpuArgs = container.GpuArgs
-		// 	}
-		// }
-
-		// gpuArgsAsArray := []string{}
-		// if gpuArgs != "" {
-		// 	gpuArgsAsArray = strings.Split(gpuArgs, " ")
-		// }
-
-		// dindImage := "ghcr.io/extrality/nvidia-dind"
-		// if gpuArgs == "" {
-		// 	dindImage = "docker:dind"
-		// }
-
-		// // create a dedicated docker network for the dind container
-		// shell := exec.ExecTask{
-		// 	Command: "docker",
-		// 	Args:    []string{"network", "create", "--driver", "bridge", string(data.Pod.UID) + "_dind_network"},
-		// 	Shell:   true,
-		// }
-		// execReturnNetworkCommand, err := shell.Execute()
-		// if err != nil {
-		// 	HandleErrorAndRemoveData(h, w, "An error occurred during the creation of the network for the DIND container", err, "", "")
-		// 	return
-		// }
-
-		// // log the docker network creation command
-		// log.G(h.Ctx).Info("\u2705 [POD FLOW] Docker network created successfully with command: " + "docker " + strings.Join(shell.Args, " "))
-
-		// dindContainerArgs := []string{"run"}
-		// dindContainerArgs = append(dindContainerArgs, gpuArgsAsArray...)
-		// if _, err := os.Stat("/cvmfs"); err == nil {
-		// 	dindContainerArgs = append(dindContainerArgs, "-v", "/cvmfs:/cvmfs")
-		// }
-
-		// // add the network to the dind container
-		// dindContainerArgs = append(dindContainerArgs, "--network", string(data.Pod.UID)+"_dind_network")
-		// dindContainerArgs = append(dindContainerArgs, "--privileged", "-v", wd+":/"+wd, "-v", "/home:/home", "-v", "/var/lib/docker/overlay2:/var/lib/docker/overlay2", "-v", "/var/lib/docker/image:/var/lib/docker/image", "-d", "--name", string(data.Pod.UID)+"_dind", dindImage)
-
-		// var dindContainerID string
-		// shell = exec.ExecTask{
-		// 	Command: "docker",
-		// 	Args:    dindContainerArgs,
-		// 	Shell:   true,
-		// }
-
-		// execReturn, err = shell.Execute()
-		// if err != nil {
-		// 	HandleErrorAndRemoveData(h, w, "An error occurred during the execution of DIND container command", err, "", "")
-		// 	return
-		// }
-		// dindContainerID = execReturn.Stdout
-
-		// // log also the command executed to create the DIND container
-		// log.G(h.Ctx).Info("\u2705 [POD FLOW] DIND container command executed successfully: " + "docker " + strings.Join(shell.Args, " "))
-
-		// log.G(h.Ctx).Info("\u2705 [POD FLOW] DIND container created successfully with ID: " + dindContainerID)
-
-		// // create a variable of maximum number of retries
-		// maxRetries := 20
-		// output := []byte{}
-
-		// // wait until the dind container is up and running by check that the command docker ps inside of it does not return an error
-		// for {
-
-		// 	if maxRetries == 0 {
-		// 		HandleErrorAndRemoveData(h, w, "The number of attempts to check if the DIND container is running is 0. This means that an error occurred during the creation of the DIND container UID. "+dindContainerID+" output: "+string(output)+" Network creation output "+string(execReturnNetworkCommand.Stdout), err, "", "")
-		// 		return
-		// 	}
-
-		// 	cmd := OSexec.Command("docker", "logs", string(data.Pod.UID)+"_dind")
-		// 	output, err = cmd.CombinedOutput()
-
-		// 	if err != nil {
-		// 		time.Sleep(1 * time.Second)
-		// 	}
-
-		// 	if strings.Contains(string(output), "API listen on /var/run/docker.sock") {
-		// 		break
-		// 	} else {
-		// 		time.Sleep(1 * time.Second)
-		// 	}
-
-		// 	maxRetries -= 1
-
-		// }
-
-		// log.G(h.Ctx).Info("\u2705 [POD FLOW] DIND container is up and running, ready to create the containers inside of it")
-
-		// set the podUID to the dind container
-		err = h.DindManager.SetPodUIDToDind(dindContainerID, podUID)
+		// create the DIND container or the network the containers of the pod run in
+		sandbox, err := h.createSandbox(&data.Pod, dockerRunStructs)
 		if err != nil {
-			HandleErrorAndRemoveData(h, w, "An error occurred during the setting of the pod UID to the DIND container", err, "", "")
+			HandleErrorAndRemoveData(h, w, "An error occurred during the creation of the sandbox of the pod", err, podNamespace, podUID)
 			return
 		}
-
-		// run the docker command to rename the container to the pod UID
-		shell := exec.ExecTask{
-			Command: "docker",
-			Args:    []string{"rename", dindContainerID, string(data.Pod.UID) + "_dind"},
-			Shell:   true,
+		for i := range initContainers {
+			initContainers[i] = sandbox.attach(initContainers[i])
 		}
-
-		_, err = shell.Execute()
-		if err != nil {
-			HandleErrorAndRemoveData(h, w, "An error occurred during the rename of the DIND container", err, "", "")
-			return
+		for i := range containers {
+			containers[i] = sandbox.attach(containers[i])
 		}
 
-		if len(initContainers) > 0 {
-
-			log.G(h.Ctx).Info("\u2705 [POD FLOW] Start creating init containers")
-
-			initContainersCommand := "#!/bin/sh\n"
-			for _, initContainer := range initContainers {
-				initContainersCommand += initContainer.Command + "\n"
-			}
-			err = os.WriteFile(podDirectoryPath+"/init_containers_command.sh", []byte(initContainersCommand), 0644)
-			if err != nil {
-				HandleErrorAndRemoveData(h, w, "An error occurred during the creation of the init container script file", err, "", "")
-				return
-			}
-
-			shell := exec.ExecTask{
-				Command: "docker",
-				Args:    []string{"exec", string(data.Pod.UID) + "_dind", "/bin/sh", podDirectoryPath + "/init_containers_command.sh"},
+		// the environment of the containers may refer to the address of the pod, only known once its sandbox exists
+		if sandbox.IP != "" {
+			data.Pod.Status.PodIP = sandbox.IP
+			err = resolveEnv(data, initContainers)
+			if err == nil {
+				err = resolveEnv(data, containers)
 			}
-
-			_, err := shell.Execute()
 			if err != nil {
-				HandleErrorAndRemoveData(h, w, "An error occurred during the exec of the init container command script ", err, "", "")
+				HandleErrorAndRemoveData(h, w, "An error occurred during the resolution of the environment of the containers", err, podNamespace, podUID)
 				return
 			}
-			// Poll the container status until it exits
-			for {
-
-				allInitContainersCompleted := false
-				initContainersCompleted := 0
-
-				for _, initContainer := range initContainers {
-
-					shell = exec.ExecTask{
-						Command: "docker",
-						Args:    []string{"exec", string(data.Pod.UID) + "_dind", "docker", "inspect", "--format='{{.State.Status}}'", initContainer.Name},
-					}
-
-					statusReturn, err := shell.Execute()
-					if err != nil {
-						HandleErrorAndRemoveData(h, w, "An error occurred during inspect of init container", err, "", "")
-						return
-					}
-
-					status := strings.Trim(statusReturn.Stdout, "'\n")
-					if status == "exited" {
-						initContainersCompleted += 1
-					} else {
-						time.Sleep(1 * time.Second) // Wait for a second before polling again
-					}
-				}
-				if initContainersCompleted == len(initContainers) {
-					allInitContainersCompleted = true
-				}
-
-				if allInitContainersCompleted {
-					break
-				}
-			}
-
-			log.G(h.Ctx).Info("\u2705 [POD FLOW] Init containers created and executed successfully")
 		}
 
-		// create a file called containers_command.sh and write the containers commands to it, use WriteFile function
-		containersCommand := "#!/bin/sh\n"
-		for _, container := range containers {
-			containersCommand += container.Command + "\n"
-		}
-		err = os.WriteFile(podDirectoryPath+"/containers_command.sh", []byte(containersCommand), 0644)
+		// record the pod, so that it is re-adopted if the sidecar restarts, and its creation resumed if not done yet
+		runSpecs, err := json.Marshal(append(append([]DockerRunSpec{}, initContainers...), containers...))
 		if err != nil {
-			HandleErrorAndRemoveData(h, w, "An error occurred during the creation of the container commands script.", err, "", "")
+			HandleErrorAndRemoveData(h, w, "An error occurred during the json marshal of the run specs of the pod", err, podNamespace, podUID)
 			return
 		}
-
-		log.G(h.Ctx).Info("\u2705 [POD FLOW] Containers commands written to the script file")
-
-		shell = exec.ExecTask{
-			Command: "docker",
-			Args:    []string{"exec", string(data.Pod.UID) + "_dind", "/bin/sh", podDirectoryPath + "/containers_command.sh"},
+		podGPUs := map[string][]string{}
+		for _, dockerRunStruct := range dockerRunStructs {
+			if len(dockerRunStruct.GPUs) > 0 {
+				podGPUs[dockerRunStruct.Name] = dockerRunStruct.GPUs
+			}
 		}
-
-		_, err = shell.Execute()
+		err = h.StateStore.PutPod(statestore.PodRecord{
+			PodUID:        podUID,
+			PodNamespace:  podNamespace,
+			PodName:       data.Pod.Name,
+			DindID:        sandbox.DindID,
+			DindNetworkID: sandbox.NetworkID,
+			GPUs:          podGPUs,
+			Ports:         ports,
+			PodDirectory:  podDirectoryPath,
+			Phase:         workerPulling,
+			Pod:           &data.Pod,
+			RunSpecs:      runSpecs,
+			CreatedAt:     time.Now(),
+		})
 		if err != nil {
-			HandleErrorAndRemoveData(h, w, "An error occurred during the execution of the container command script", err, "", "")
+			HandleErrorAndRemoveData(h, w, "An error occurred during the recording of the pod in the state store", err, podNamespace, podUID)
 			return
 		}
 
-		log.G(h.Ctx).Info("\u2705 [POD FLOW] Containers created successfully")
+		// the images are pulled and the containers started in the background, reported by the status of the pod
+		h.startWorker(&data.Pod, sandbox, podDirectoryPath, initContainers, containers, workerPulling)
 
-		createResponse := CreateStruct{PodUID: string(data.Pod.UID), PodJID: dindContainerID}
+		createResponse := CreateStruct{PodUID: string(data.Pod.UID), PodJID: sandbox.JobID, Ports: ports}
 		createResponseBytes, err := json.Marshal(createResponse)
 		if err != nil {
 			statusCode = http.StatusInternalServerError
@@ -566,36 +370,21 @@ func HandleErrorAndRemoveData(h *SidecarHandler, w http.ResponseWriter, s string
 	w.Write([]byte("Some errors occurred while creating container. Check Docker Sidecar's logs"))
 
 	if podNamespace != "" && podUID != "" {
-		os.RemoveAll(h.Config.DataRootFolder + podNamespace + "-" + podUID)
-	}
-	dindSpec := dindmanager.DindSpecs{}
-	dindSpec, err = h.DindManager.GetDindFromPodUID(podUID)
-
-	if err != nil {
-		log.G(h.Ctx).Error("\u274C [CREATE CALL] Error retrieving DindSpecs, maybe the Dind container has already been deleted")
-	} else {
-		log.G(h.Ctx).Info("\u2705 [CREATE CALL] Retrieved DindSpecs: " + dindSpec.DindID + " " + dindSpec.PodUID + " " + dindSpec.DindNetworkID + " ")
-
-		// log the retrieved dindSpec
-		log.G(h.Ctx).Info("\u2705 [CREATE CALL] Retrieved DindSpecs: " + dindSpec.DindID + " " + dindSpec.PodUID + " " + dindSpec.DindNetworkID + " ")
-
-		cmd := []string{"network", "rm", dindSpec.DindNetworkID}
-		shell := exec.ExecTask{
-			Command: "docker",
-			Args:    cmd,
-			Shell:   true,
+		if podDirectoryPath, err := podDirectory(h.Config, podNamespace, podUID); err == nil {
+			os.RemoveAll(podDirectoryPath)
 		}
-		execReturn, _ := shell.Execute()
-		execReturn.Stdout = strings.ReplaceAll(execReturn.Stdout, "\n", "")
-		if execReturn.Stderr != "" {
-			log.G(h.Ctx).Error("\u274C [CREATE CALL] Error deleting network " + dindSpec.DindNetworkID)
-		} else {
-			log.G(h.Ctx).Info("\u2705 [CREATE CALL] Deleted network " + dindSpec.DindNetworkID)
+	}
+	if podUID != "" {
+		err = h.StateStore.DeletePod(podUID)
+		if err != nil {
+			log.G(h.Ctx).Error("\u274C [CREATE CALL] Error removing pod " + podUID + " from the state store: " + err.Error())
 		}
-		// set the dind available again
-		err = h.DindManager.RemoveDindFromList(dindSpec.PodUID)
+
+		err = h.removeSandbox(podUID)
 		if err != nil {
-			log.G(h.Ctx).Error("\u274C [CREATE CALL] Error setting DIND container available")
+			log.G(h.Ctx).Error("\u274C [CREATE CALL] Error removing the sandbox of pod " + podUID + ": " + err.Error())
+		} else {
+			log.G(h.Ctx).Info("\u2705 [CREATE CALL] Removed the sandbox of pod " + podUID)
 		}
 	}
 }
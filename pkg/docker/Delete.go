@@ -5,20 +5,14 @@ import (
 	"io"
 	"net/http"
 	"os"
-	"strings"
 
-	exec "github.com/alexellis/go-execute/pkg/v1"
 	"github.com/containerd/containerd/log"
-	"github.com/intertwin-eu/interlink-docker-plugin/pkg/docker/dindmanager"
 	v1 "k8s.io/api/core/v1"
-
-	"path/filepath"
 )
 
 // DeleteHandler stops and deletes Docker containers from provided data
 func (h *SidecarHandler) DeleteHandler(w http.ResponseWriter, r *http.Request) {
 	log.G(h.Ctx).Info("\u23F3 [DELETE CALL] Received delete call from Interlink")
-	var execReturn exec.ExecResult
 	statusCode := http.StatusOK
 	bodyBytes, err := io.ReadAll(r.Body)
 
@@ -43,68 +37,51 @@ func (h *SidecarHandler) DeleteHandler(w http.ResponseWriter, r *http.Request) {
 	podUID := string(pod.UID)
 	podNamespace := string(pod.Namespace)
 
-	for _, container := range pod.Spec.Containers {
+	// the containers of the pod are given its grace period to save their state before they are removed
+	log.G(h.Ctx).Info("\u23F3 [DELETE CALL] Stopping the containers of POD " + podUID)
+	h.terminatePod(&pod)
+	log.G(h.Ctx).Info("\u2705 [DELETE CALL] Stopped the containers of POD " + podUID)
+
+	for _, container := range append(append([]v1.Container{}, pod.Spec.InitContainers...), pod.Spec.Containers...) {
 		containerName := podNamespace + "-" + podUID + "-" + container.Name
 		h.GpuManager.Release(containerName)
 	}
 
-	log.G(h.Ctx).Debug("\u2705 [DELETE CALL] Deleting POD " + podUID + "_dind")
-
-	cmd := []string{"rm", "-f", podUID + "_dind"}
-	shell := exec.ExecTask{
-		Command: "docker",
-		Args:    cmd,
-		Shell:   true,
+	// the DIND container of the pod, or its network in host mode
+	sandboxName := podUID + "_dind"
+	if h.hostMode() {
+		sandboxName = h.hostSandboxName(podUID)
 	}
-	execReturn, _ = shell.Execute()
-	execReturn.Stdout = strings.ReplaceAll(execReturn.Stdout, "\n", "")
+	log.G(h.Ctx).Info("\u23F3 [DELETE CALL] Deleting " + sandboxName + " along with the containers of POD " + podUID)
 
-	if execReturn.Stderr != "" {
-		log.G(h.Ctx).Error("\u274C [DELETE CALL] Error deleting container " + podUID + "_dind")
+	err = h.removeSandbox(podUID)
+	if err != nil {
+		log.G(h.Ctx).Error("\u274C [DELETE CALL] Error deleting " + sandboxName + " of POD " + podUID + ": " + err.Error())
 		statusCode = http.StatusInternalServerError
 	} else {
-		log.G(h.Ctx).Info("\u2705 [DELETE CALL] Deleted container " + podUID + "_dind")
+		log.G(h.Ctx).Info("\u2705 [DELETE CALL] Deleted " + sandboxName + " of POD " + podUID)
 	}
 
-	dindSpec := dindmanager.DindSpecs{}
-	dindSpec, err = h.DindManager.GetDindFromPodUID(podUID)
-
+	err = h.StateStore.DeletePod(podUID)
 	if err != nil {
-		log.G(h.Ctx).Error("\u274C [DELETE CALL] Error retrieving DindSpecs, maybe the Dind container has already been deleted")
-	} else {
-		log.G(h.Ctx).Info("\u2705 [DELETE CALL] Retrieved DindSpecs: " + dindSpec.DindID + " " + dindSpec.PodUID + " " + dindSpec.DindNetworkID + " ")
-
-		// log the retrieved dindSpec
-		log.G(h.Ctx).Info("\u2705 [DELETE CALL] Retrieved DindSpecs: " + dindSpec.DindID + " " + dindSpec.PodUID + " " + dindSpec.DindNetworkID + " ")
-
-		cmd = []string{"network", "rm", dindSpec.DindNetworkID}
-		shell = exec.ExecTask{
-			Command: "docker",
-			Args:    cmd,
-			Shell:   true,
-		}
-		execReturn, _ = shell.Execute()
-		execReturn.Stdout = strings.ReplaceAll(execReturn.Stdout, "\n", "")
-		if execReturn.Stderr != "" {
-			log.G(h.Ctx).Error("\u274C [DELETE CALL] Error deleting network " + dindSpec.DindNetworkID)
-		} else {
-			log.G(h.Ctx).Info("\u2705 [DELETE CALL] Deleted network " + dindSpec.DindNetworkID)
-		}
-		// set the dind available again
-		err = h.DindManager.RemoveDindFromList(dindSpec.PodUID)
-		if err != nil {
-			log.G(h.Ctx).Error("\u274C [DELETE CALL] Error setting DIND container available")
-		}
+		log.G(h.Ctx).Error("\u274C [DELETE CALL] Error removing pod " + podUID + " from the state store: " + err.Error())
+		statusCode = http.StatusInternalServerError
 	}
-	wd, err := os.Getwd()
+
+	podDirectoryPathToDelete, err := podDirectory(h.Config, podNamespace, podUID)
 	if err != nil {
-		HandleErrorAndRemoveData(h, w, "Unable to get current working directory", err, "", "")
+		HandleErrorAndRemoveData(h, w, "Unable to get the directory of the pod", err, "", "")
 		return
 	}
-	podDirectoryPathToDelete := filepath.Join(wd, h.Config.DataRootFolder+"/"+podNamespace+"-"+podUID)
-	log.G(h.Ctx).Info("\u2705 [DELETE CALL] Deleting directory " + podDirectoryPathToDelete)
+	log.G(h.Ctx).Info("\u23F3 [DELETE CALL] Deleting directory " + podDirectoryPathToDelete)
 
 	err = os.RemoveAll(podDirectoryPathToDelete)
+	if err != nil {
+		log.G(h.Ctx).Error("\u274C [DELETE CALL] Error deleting directory " + podDirectoryPathToDelete + ": " + err.Error())
+		statusCode = http.StatusInternalServerError
+	} else {
+		log.G(h.Ctx).Info("\u2705 [DELETE CALL] Deleted directory " + podDirectoryPathToDelete)
+	}
 
 	w.WriteHeader(statusCode)
 	if statusCode != http.StatusOK {
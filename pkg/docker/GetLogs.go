@@ -2,19 +2,19 @@ package docker
 
 import (
 	"encoding/json"
+	"errors"
 	"io"
 	"net/http"
 	"strings"
 	"time"
 
-	OSexec "os/exec"
-
 	"github.com/containerd/containerd/log"
 
 	commonIL "github.com/intertwin-eu/interlink-docker-plugin/pkg/common"
+	"github.com/intertwin-eu/interlink-docker-plugin/pkg/docker/runtime"
 )
 
-// GetLogsHandler performs a Docker logs command and returns its manipulated output
+// GetLogsHandler retrieves the logs of a container inside the pod's sandbox and returns its manipulated output
 func (h *SidecarHandler) GetLogsHandler(w http.ResponseWriter, r *http.Request) {
 	log.G(h.Ctx).Info("\u23F3 [LOGS CALL]: received get logs call")
 	var req commonIL.LogStruct
@@ -44,8 +44,10 @@ func (h *SidecarHandler) GetLogsHandler(w http.ResponseWriter, r *http.Request)
 
 	containerName := podNamespace + "-" + podUID + "-" + req.ContainerName
 
-	cmd := OSexec.Command("docker", "exec", podUID+"_dind", "docker", "ps", "-a", "--format", "{{.Names}}")
-	output, err := cmd.CombinedOutput()
+	sandbox, err := h.getSandbox(podUID)
+	if err == nil && sandbox.Failure != "" {
+		err = errors.New(sandbox.Failure)
+	}
 	if err != nil {
 		log.G(h.Ctx).Error(err)
 		statusCode = http.StatusInternalServerError
@@ -53,30 +55,12 @@ func (h *SidecarHandler) GetLogsHandler(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
-	lines := strings.Split(string(output), "\n")
-	found := false
-	for _, line := range lines {
-		if line == containerName {
-			found = true
-			break
-		}
-	}
-	if !found {
+	output, err := sandbox.Runtime.ContainerLogs(h.Ctx, containerName, runtime.LogOptions{Timestamps: req.Opts.Timestamps})
+	if runtime.IsNotFound(err) {
 		w.WriteHeader(statusCode)
 		w.Write([]byte("No logs available for container " + containerName + ". Container not found."))
 		return
-	}
-
-	//var cmd *OSexec.Cmd
-	if req.Opts.Timestamps {
-		cmd = OSexec.Command("docker", "exec", podUID+"_dind", "docker", "logs", "-t", containerName)
-	} else {
-		cmd = OSexec.Command("docker", "exec", podUID+"_dind", "docker", "logs", containerName)
-	}
-
-	output, err = cmd.CombinedOutput()
-
-	if err != nil {
+	} else if err != nil {
 		log.G(h.Ctx).Error(err)
 		statusCode = http.StatusInternalServerError
 		w.WriteHeader(statusCode)
@@ -2,19 +2,20 @@ package docker
 
 import (
 	"encoding/json"
+	"fmt"
 	"io"
 	"net/http"
-	"strconv"
-	"strings"
+	"time"
 
-	exec "github.com/alexellis/go-execute/pkg/v1"
 	"github.com/containerd/containerd/log"
 	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 
 	commonIL "github.com/intertwin-eu/interlink-docker-plugin/pkg/common"
+	"github.com/intertwin-eu/interlink-docker-plugin/pkg/docker/runtime"
 )
 
-// StatusHandler checks Docker Container's status by running docker ps -af command and returns that status
+// StatusHandler checks Docker Container's status by inspecting the containers inside the pod's sandbox and returns that status
 func (h *SidecarHandler) StatusHandler(w http.ResponseWriter, r *http.Request) {
 	log.G(h.Ctx).Info("\u23F3 [STATUS CALL] received get status call")
 	var resp []commonIL.PodStatus
@@ -39,84 +40,195 @@ func (h *SidecarHandler) StatusHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	for i, pod := range req {
+	for _, pod := range req {
 
 		podUID := string(pod.UID)
 		podNamespace := string(pod.Namespace)
 
-		// send a docker command to retrieve the uuid of the dind container
-		// the command to exec is: docker inspect --format '{{.Id}}' podUID + "_dind"
-		cmd := []string{"inspect", "--format", "{{.Id}}", podUID + "_dind"}
-		shell := exec.ExecTask{
-			Command: "docker",
-			Args:    cmd,
-			Shell:   true,
-		}
-		execReturn, err := shell.Execute()
-		if err != nil {
+		// retrieve the sandbox of the pod and the runtime its containers run in
+		sandbox, err := h.getSandbox(podUID)
+		if runtime.IsNotFound(err) {
+			log.G(h.Ctx).Error("\u274C [STATUS CALL] Error retrieving the sandbox of pod " + podUID)
+			statusCode = http.StatusNotFound
+			w.WriteHeader(statusCode)
+			w.Write([]byte("Sandbox of pod " + podUID + " not found. Maybe it was deleted or never existed."))
+			return
+		} else if err != nil {
 			log.G(h.Ctx).Error(err)
 			statusCode = http.StatusInternalServerError
 			break
 		}
 
-		//dindUUID := strings.ReplaceAll(execReturn.Stdout, "\n", "")
-		dindUUID := strings.Join(strings.Fields(execReturn.Stdout), "")
-		log.G(h.Ctx).Info("\u2705 [STATUS CALL] UUID of the dind container retrieved successfully: ", dindUUID)
+		// a pod whose sandbox died is failed, along with all its containers
+		if sandbox.Failure != "" {
+			log.G(h.Ctx).Error("\u274C [STATUS CALL] Pod " + podUID + " failed: " + sandbox.Failure)
+			h.probes.stop(podUID)
+			h.supervisor.stop(podUID)
+			resp = append(resp, h.failedPodStatus(pod, sandbox))
+			continue
+		}
 
-		// if the string is empty or the length of the string is 0, return an error and 404 status code\
-		if len(dindUUID) == 0 || dindUUID == "" {
-			log.G(h.Ctx).Error("\u274C [STATUS CALL] Error retrieving UUID of the dind container")
-			statusCode = http.StatusNotFound
-			w.WriteHeader(statusCode)
-			w.Write([]byte("DIND container with UUID " + dindUUID + " not found. Maybe it was deleted or never existed."))
-			return
+		record, _ := h.StateStore.GetPod(podUID)
+		if record.Phase == "" || record.Phase == workerRunning {
+			// the supervisor and the probes of a re-adopted pod are started again on its first status call
+			h.startSupervisor(pod, sandbox)
+			h.startProbes(pod, sandbox)
 		}
 
-		resp = append(resp, commonIL.PodStatus{PodName: pod.Name, PodUID: podUID, PodNamespace: podNamespace, JobID: dindUUID})
-		for _, container := range pod.Spec.Containers {
+		innerRuntime := sandbox.Runtime
+		log.G(h.Ctx).Info("\u2705 [STATUS CALL] Sandbox of the pod retrieved successfully: ", sandbox.JobID)
+
+		resp = append(resp, commonIL.PodStatus{PodName: pod.Name, PodUID: podUID, PodNamespace: podNamespace, JobID: sandbox.JobID, PodIP: sandbox.IP, HostIP: h.Config.PodIP})
+		podStatus := &resp[len(resp)-1]
+		// without a known address, the pod is reached through the ports published on the host
+		if podStatus.PodIP == "" {
+			podStatus.PodIP = h.Config.PodIP
+		}
+		podStatus.Ports = record.Ports
+		switch record.Phase {
+		case workerPulling, workerInitializing:
+			if h.workers.running(podUID) {
+				podStatus.Phase = v1.PodPending
+				podStatus.Message = "the containers of the pod are being created: " + record.Phase
+				break
+			}
+			// the creation of the pod could not be resumed after a restart of the plugin
+			podStatus.Phase = v1.PodFailed
+			podStatus.Reason = "CreationInterrupted"
+			podStatus.Message = "the creation of the pod was interrupted by a restart of the plugin"
+		case workerFailed:
+			podStatus.Phase = v1.PodFailed
+			podStatus.Reason = "CreateContainerError"
+			podStatus.Message = record.Message
+		}
+		// the init containers run one after the other before the containers, the pod fails if one of them fails
+		initialized := true
+		for _, container := range pod.Spec.InitContainers {
 
 			containerName := podNamespace + "-" + podUID + "-" + container.Name
-			cmd := []string{"exec " + podUID + "_dind" + " docker ps -af name=^" + containerName + "$ --format \"{{.Status}}\""}
 
-			shell := exec.ExecTask{
-				Command: "docker",
-				Args:    cmd,
-				Shell:   true,
+			containerInfo, err := innerRuntime.InspectContainer(h.Ctx, containerName)
+			if runtime.IsNotFound(err) {
+				waiting := h.images.status(podUID, container.Image)
+				if waiting == nil {
+					waiting = &v1.ContainerStateWaiting{Reason: "PodInitializing"}
+				}
+				podStatus.InitContainers = append(podStatus.InitContainers, v1.ContainerStatus{Name: container.Name, Image: container.Image, State: v1.ContainerState{Waiting: waiting}})
+				initialized = false
+				continue
+			} else if err != nil {
+				log.G(h.Ctx).Error(err)
+				statusCode = http.StatusInternalServerError
+				break
+			}
+
+			containerStatus := v1.ContainerStatus{Name: container.Name, Image: container.Image, ImageID: containerInfo.ImageID, ContainerID: h.containerID(containerInfo), RestartCount: record.RestartCounts[container.Name]}
+			switch containerInfo.State.Status {
+			case "running", "restarting", "paused":
+				containerStatus.State = v1.ContainerState{Running: &v1.ContainerStateRunning{StartedAt: metav1.NewTime(containerInfo.State.StartedAt)}}
+				if isSidecar(container) {
+					// a sidecar runs along with the containers, it is ready once its startup and readiness probes succeeded
+					started, ready := h.probes.status(podUID, container.Name)
+					containerStatus.Ready = started && ready
+					containerStatus.Started = &started
+					initialized = initialized && started
+					break
+				}
+				initialized = false
+			case "exited", "dead":
+				if isSidecar(container) && h.supervisor.completed(podUID) {
+					// the sidecars are stopped once the containers exited
+					containerStatus.State = v1.ContainerState{Terminated: h.terminatedState(h.Ctx, innerRuntime, container, containerInfo)}
+					break
+				} else if isSidecar(container) {
+					restarts := h.supervisor.status(podUID, container.Name)
+					containerStatus.State = v1.ContainerState{Waiting: &v1.ContainerStateWaiting{Reason: "CrashLoopBackOff", Message: fmt.Sprintf("back-off %s restarting failed container %s", restarts.Backoff.Round(time.Second), container.Name)}}
+					containerStatus.LastTerminationState = v1.ContainerState{Terminated: h.terminatedState(h.Ctx, innerRuntime, container, containerInfo)}
+					break
+				}
+				if containerInfo.State.ExitCode != 0 && pod.Spec.RestartPolicy != v1.RestartPolicyNever {
+					// the failed init container is restarted by the worker of the pod, after its back-off
+					containerStatus.State = v1.ContainerState{Waiting: &v1.ContainerStateWaiting{Reason: "CrashLoopBackOff", Message: "back-off restarting failed init container " + container.Name}}
+					containerStatus.LastTerminationState = v1.ContainerState{Terminated: h.terminatedState(h.Ctx, innerRuntime, container, containerInfo)}
+					initialized = false
+					break
+				}
+				containerStatus.State = v1.ContainerState{Terminated: h.terminatedState(h.Ctx, innerRuntime, container, containerInfo)}
+				containerStatus.Ready = containerInfo.State.ExitCode == 0
+				if containerInfo.State.ExitCode != 0 {
+					initialized = false
+					podStatus.Phase = v1.PodFailed
+					podStatus.Reason = "InitContainerFailed"
+					podStatus.Message = fmt.Sprintf("init container %s exited with code %d", container.Name, containerInfo.State.ExitCode)
+				}
+				// release all the GPUs from the container
+				h.GpuManager.Release(containerName)
+			default:
+				containerStatus.State = v1.ContainerState{Waiting: &v1.ContainerStateWaiting{Reason: "PodInitializing"}}
+				initialized = false
 			}
-			execReturn, err := shell.Execute()
-			execReturn.Stdout = strings.ReplaceAll(execReturn.Stdout, "\n", "")
+			podStatus.InitContainers = append(podStatus.InitContainers, containerStatus)
+		}
+
+		for _, container := range pod.Spec.Containers {
 
-			if err != nil {
+			containerName := podNamespace + "-" + podUID + "-" + container.Name
+
+			containerInfo, err := innerRuntime.InspectContainer(h.Ctx, containerName)
+			if runtime.IsNotFound(err) {
+				// the container is not created yet, maybe because its image cannot be pulled
+				waiting := h.images.status(podUID, container.Image)
+				if waiting == nil && !initialized {
+					waiting = &v1.ContainerStateWaiting{Reason: "PodInitializing"}
+				} else if waiting == nil {
+					waiting = &v1.ContainerStateWaiting{Reason: "ContainerCreating"}
+				}
+				podStatus.Containers = append(podStatus.Containers, v1.ContainerStatus{Name: container.Name, Image: container.Image, State: v1.ContainerState{Waiting: waiting}, Ready: false})
+				continue
+			} else if err != nil {
 				log.G(h.Ctx).Error(err)
 				statusCode = http.StatusInternalServerError
 				break
 			}
 
 			log.G(h.Ctx).Info("\u2705 [STATUS CALL] Status of the container retrieved successfully")
+			log.G(h.Ctx).Info("\u2705 [STATUS CALL] The container " + container.Name + " is in the state: " + containerInfo.State.Status)
+
+			restarts := h.supervisor.status(podUID, container.Name)
+			containerStatus := v1.ContainerStatus{
+				Name:         container.Name,
+				Image:        container.Image,
+				ImageID:      containerInfo.ImageID,
+				ContainerID:  h.containerID(containerInfo),
+				RestartCount: restarts.RestartCount,
+			}
+			if restarts.LastTermination != nil {
+				containerStatus.LastTerminationState = v1.ContainerState{Terminated: restarts.LastTermination}
+			}
 
-			containerstatus := strings.Split(execReturn.Stdout, " ")
-
-			if execReturn.Stdout != "" {
-				log.G(h.Ctx).Info("\u2705 [STATUS CALL] The container " + container.Name + " is in the state: " + containerstatus[0])
-
-				if containerstatus[0] == "Created" {
-					resp[i].Containers = append(resp[i].Containers, v1.ContainerStatus{Name: container.Name, State: v1.ContainerState{Waiting: &v1.ContainerStateWaiting{}}, Ready: false})
-				} else if containerstatus[0] == "Up" {
-					resp[i].Containers = append(resp[i].Containers, v1.ContainerStatus{Name: container.Name, State: v1.ContainerState{Running: &v1.ContainerStateRunning{}}, Ready: true})
-				} else if containerstatus[0] == "Exited" {
-					containerExitCode := strings.Split(containerstatus[1], "(")
-					exitCode, err := strconv.Atoi(strings.Trim(containerExitCode[1], ")"))
-					if err != nil {
-						log.G(h.Ctx).Error(err)
-						exitCode = 0
-					}
-					resp[i].Containers = append(resp[i].Containers, v1.ContainerStatus{Name: container.Name, State: v1.ContainerState{Terminated: &v1.ContainerStateTerminated{ExitCode: int32(exitCode)}}, Ready: false})
-					// release all the GPUs from the container
-					h.GpuManager.Release(containerName)
+			switch containerInfo.State.Status {
+			case "running", "restarting", "paused":
+				// a running container is ready once its startup and readiness probes succeeded
+				started, ready := h.probes.status(podUID, container.Name)
+				containerStatus.State = v1.ContainerState{Running: &v1.ContainerStateRunning{StartedAt: metav1.NewTime(containerInfo.State.StartedAt)}}
+				containerStatus.Ready = started && ready
+				containerStatus.Started = &started
+			case "exited", "dead":
+				if restartsOnExit(pod.Spec.RestartPolicy, containerInfo.State.ExitCode) {
+					// the container is restarted by the supervisor of the pod, after its back-off
+					containerStatus.State = v1.ContainerState{Waiting: &v1.ContainerStateWaiting{Reason: "CrashLoopBackOff", Message: fmt.Sprintf("back-off %s restarting failed container %s", restarts.Backoff.Round(time.Second), container.Name)}}
+					containerStatus.LastTerminationState = v1.ContainerState{Terminated: h.terminatedState(h.Ctx, innerRuntime, container, containerInfo)}
+					break
 				}
-			} else {
-				resp[i].Containers = append(resp[i].Containers, v1.ContainerStatus{Name: container.Name, State: v1.ContainerState{Waiting: &v1.ContainerStateWaiting{}}, Ready: false})
+				containerStatus.State = v1.ContainerState{Terminated: h.terminatedState(h.Ctx, innerRuntime, container, containerInfo)}
+				// release all the GPUs from the container
+				h.GpuManager.Release(containerName)
+			case "created":
+				containerStatus.State = v1.ContainerState{Waiting: &v1.ContainerStateWaiting{Reason: "ContainerCreating"}}
+			default:
+				containerStatus.State = v1.ContainerState{Waiting: &v1.ContainerStateWaiting{}}
 			}
+			podStatus.Containers = append(podStatus.Containers, containerStatus)
 		}
 	}
 
@@ -135,3 +247,47 @@ func (h *SidecarHandler) StatusHandler(w http.ResponseWriter, r *http.Request) {
 		w.Write(bodyBytes)
 	}
 }
+
+// failedPodStatus returns the status of a pod whose sandbox failed: the pod is Failed and its containers are
+// terminated, since they cannot run anymore
+func (h *SidecarHandler) failedPodStatus(pod *v1.Pod, sandbox podSandbox) commonIL.PodStatus {
+	podUID := string(pod.UID)
+	podStatus := commonIL.PodStatus{
+		PodName:      pod.Name,
+		PodUID:       podUID,
+		PodNamespace: pod.Namespace,
+		JobID:        sandbox.JobID,
+		Phase:        v1.PodFailed,
+		Reason:       sandbox.FailureReason,
+		Message:      sandbox.Failure,
+	}
+
+	for _, container := range pod.Spec.InitContainers {
+		podStatus.InitContainers = append(podStatus.InitContainers, v1.ContainerStatus{
+			Name:  container.Name,
+			State: v1.ContainerState{Terminated: &v1.ContainerStateTerminated{ExitCode: 137, Reason: sandbox.FailureReason, Message: sandbox.Failure}},
+			Ready: false,
+		})
+		h.GpuManager.Release(pod.Namespace + "-" + podUID + "-" + container.Name)
+	}
+	for _, container := range pod.Spec.Containers {
+		podStatus.Containers = append(podStatus.Containers, v1.ContainerStatus{
+			Name:  container.Name,
+			State: v1.ContainerState{Terminated: &v1.ContainerStateTerminated{ExitCode: 137, Reason: sandbox.FailureReason, Message: sandbox.Failure}},
+			Ready: false,
+		})
+		// release all the GPUs from the container
+		h.GpuManager.Release(pod.Namespace + "-" + podUID + "-" + container.Name)
+	}
+
+	return podStatus
+}
+
+// containerID returns the ID of a container in the <runtime>://<id> form used by the kubelet
+func (h *SidecarHandler) containerID(info runtime.ContainerInfo) string {
+	containerRuntime := h.Config.ContainerRuntime
+	if containerRuntime == "" {
+		containerRuntime = commonIL.ContainerRuntimeDocker
+	}
+	return containerRuntime + "://" + info.ID
+}
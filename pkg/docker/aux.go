@@ -7,13 +7,14 @@ import (
 	"path/filepath"
 	"strings"
 
-	exec2 "github.com/alexellis/go-execute/pkg/v1"
 	"github.com/containerd/containerd/log"
 	v1 "k8s.io/api/core/v1"
 
 	commonIL "github.com/intertwin-eu/interlink-docker-plugin/pkg/common"
 	"github.com/intertwin-eu/interlink-docker-plugin/pkg/docker/dindmanager"
 	"github.com/intertwin-eu/interlink-docker-plugin/pkg/docker/gpustrategies"
+	"github.com/intertwin-eu/interlink-docker-plugin/pkg/docker/runtime"
+	"github.com/intertwin-eu/interlink-docker-plugin/pkg/docker/statestore"
 )
 
 type SidecarHandler struct {
@@ -21,77 +22,102 @@ type SidecarHandler struct {
 	Ctx         context.Context
 	GpuManager  gpustrategies.GPUManagerInterface
 	DindManager dindmanager.DindManagerInterface
+	Runtime     runtime.ContainerRuntime
+	StateStore  *statestore.StateStore
+	// ports publishes the ports of the pods running in DIND containers
+	ports portForwarder
+	// probes runs the probes of the containers of the pods
+	probes probeManager
+	// supervisor restarts the containers of the pods according to their restart policy
+	supervisor supervisorManager
+	// images holds the failed image pulls of the pods waiting for their images
+	images imagePullManager
+	// workers create the containers of the pods in the background
+	workers workerManager
 }
 
-func parseContainerCommandAndReturnArgs(Ctx context.Context, config commonIL.InterLinkConfig, podUID string, podNamespace string, container v1.Container) ([]string, []string, []string, error) {
-
-	dirPath := config.DataRootFolder + podNamespace + "-" + podUID
-	if _, err := os.Stat(dirPath); os.IsNotExist(err) {
-		err := os.MkdirAll(dirPath, os.ModePerm)
-		if err != nil {
-			log.G(Ctx).Error(err)
-		} else {
-			log.G(Ctx).Info("-- Created directory " + dirPath)
-		}
+// dindRuntime returns the runtime of the docker daemon running inside the DIND container of a pod, along with the DIND container itself
+func (h *SidecarHandler) dindRuntime(podUID string) (runtime.ContainerRuntime, runtime.ContainerInfo, error) {
+	dind, err := h.Runtime.InspectContainer(h.Ctx, podUID+"_dind")
+	if err != nil {
+		return nil, dind, err
 	}
 
-	if container.Command == nil {
-		return []string{}, container.Command, container.Args, nil
+	endpoint, err := dindmanager.InnerEndpoint(dind)
+	if err != nil {
+		return nil, dind, err
 	}
 
-	prefileName := container.Name + "_" + podUID + "_" + podNamespace
+	innerRuntime, err := h.Runtime.Inner(endpoint)
+	return innerRuntime, dind, err
+}
 
-	wd, err := os.Getwd()
+// runContainer creates and starts the container described by runSpec through the given runtime
+func (h *SidecarHandler) runContainer(containerRuntime runtime.ContainerRuntime, runSpec DockerRunSpec) error {
+	containerID, err := containerRuntime.CreateContainer(h.Ctx, runSpec.ContainerSpec())
 	if err != nil {
-		return nil, nil, nil, err
+		return err
 	}
+	return containerRuntime.StartContainer(h.Ctx, containerID)
+}
 
-	if len(container.Command) > 0 {
-
-		fileName := prefileName + "_script.sh"
-
-		if len(container.Args) == 0 {
-			fileNamePath := filepath.Join(wd, config.DataRootFolder+podNamespace+"-"+podUID, fileName)
-			err = os.WriteFile(fileNamePath, []byte(strings.Join(container.Command, " ")), 0644)
-			if err != nil {
-				log.G(Ctx).Error(err)
-				return nil, nil, nil, err
-			}
-			return []string{"-v " + fileNamePath + ":/" + fileName}, []string{"/bin/sh" + " /" + fileName}, []string{}, nil
-		}
-
-		argsFileName := container.Name + "_args"
-		argsFileNamePath := filepath.Join(wd, config.DataRootFolder+podNamespace+"-"+podUID, argsFileName)
-		err = os.WriteFile(argsFileNamePath, []byte(strings.Join(container.Args, " ")), 0644)
-		if err != nil {
-			log.G(Ctx).Error(err)
-			return nil, nil, nil, err
-		}
+// writeDebugScript writes the docker run commands equivalent to runSpecs to path
+func writeDebugScript(path string, runSpecs []DockerRunSpec) error {
+	script := "#!/bin/sh\n"
+	for _, runSpec := range runSpecs {
+		script += runSpec.ShellCommand() + "\n"
+	}
+	return os.WriteFile(path, []byte(script), 0644)
+}
 
-		fullFileContent := strings.Join(container.Command, " ") + " \"$(cat " + argsFileName + ")\""
-		fullFileNamePath := filepath.Join(wd, config.DataRootFolder+podNamespace+"-"+podUID, fileName)
-		err = os.WriteFile(fullFileNamePath, []byte(fullFileContent), 0644)
-		if err != nil {
-			log.G(Ctx).Error(err)
-			return nil, nil, nil, err
-		}
+// podDirectory returns the absolute path of the directory of a pod, in the DataRootFolder of config
+func podDirectory(config commonIL.InterLinkConfig, podNamespace string, podUID string) (string, error) {
+	dataRoot, err := commonIL.DataRootPath(config)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dataRoot, podNamespace+"-"+podUID), nil
+}
 
-		return []string{"-v " + argsFileNamePath + ":/" + argsFileName, "-v " + fullFileNamePath + ":/" + fileName}, []string{"/bin/sh" + " /" + fileName}, []string{}, nil
+// prepareTerminationMessage creates the file a container writes its termination message to, in the directory of its pod,
+// and returns its mount at the terminationMessagePath of the container. The file is writable by any user of the container.
+func prepareTerminationMessage(config commonIL.InterLinkConfig, pod v1.Pod, container v1.Container) (runtime.Mount, error) {
+	podDirectoryPath, err := podDirectory(config, pod.Namespace, string(pod.UID))
+	if err != nil {
+		return runtime.Mount{}, err
+	}
+	dir := filepath.Join(podDirectoryPath, "terminationMessages")
+	err = os.MkdirAll(dir, os.ModePerm)
+	if err != nil {
+		return runtime.Mount{}, err
+	}
 
-	} else {
-		return []string{}, container.Command, container.Args, nil
+	path := filepath.Join(dir, container.Name)
+	err = os.WriteFile(path, nil, 0666)
+	if err != nil {
+		return runtime.Mount{}, err
+	}
+	// the permissions of a new file are masked by the umask
+	err = os.Chmod(path, 0666)
+	if err != nil {
+		return runtime.Mount{}, err
 	}
+	return runtime.Mount{Source: path, Target: container.TerminationMessagePath}, nil
 }
 
-func prepareMounts(Ctx context.Context, config commonIL.InterLinkConfig, data commonIL.RetrievedPodData, container v1.Container) (string, error) {
-	mountedData := ""
+func prepareMounts(Ctx context.Context, config commonIL.InterLinkConfig, data commonIL.RetrievedPodData, container v1.Container) ([]runtime.Mount, error) {
+	mountedData := []runtime.Mount{}
 
 	podUID := string(data.Pod.UID)
 	podNamespace := string(data.Pod.UID)
 
-	err := os.MkdirAll(config.DataRootFolder+data.Pod.Namespace+"-"+podUID, os.ModePerm)
+	podDirectoryPath, err := podDirectory(config, data.Pod.Namespace, podUID)
 	if err != nil {
-		return "", err
+		return nil, err
+	}
+	err = os.MkdirAll(podDirectoryPath, os.ModePerm)
+	if err != nil {
+		return nil, err
 	}
 
 	allContainers := append(data.Containers, data.InitContainers...)
@@ -108,11 +134,9 @@ func prepareMounts(Ctx context.Context, config commonIL.InterLinkConfig, data co
 			if containerName == podNamespace+"-"+podUID+"-"+cont.Name {
 				paths, err := mountData(Ctx, config, data.Pod, cfgMap, container)
 				if err != nil {
-					return "", errors.New("Error mounting ConfigMap " + cfgMap.Name)
-				}
-				for _, path := range paths {
-					mountedData += "-v " + path + " "
+					return nil, errors.New("Error mounting ConfigMap " + cfgMap.Name)
 				}
+				mountedData = append(mountedData, paths...)
 			}
 		}
 
@@ -120,11 +144,9 @@ func prepareMounts(Ctx context.Context, config commonIL.InterLinkConfig, data co
 			if containerName == podNamespace+"-"+podUID+"-"+cont.Name {
 				paths, err := mountData(Ctx, config, data.Pod, secret, container)
 				if err != nil {
-					return "", errors.New("Error mounting Secret " + secret.Name)
-				}
-				for _, path := range paths {
-					mountedData += "-v " + path + " "
+					return nil, errors.New("Error mounting Secret " + secret.Name)
 				}
+				mountedData = append(mountedData, paths...)
 			}
 		}
 
@@ -133,23 +155,18 @@ func prepareMounts(Ctx context.Context, config commonIL.InterLinkConfig, data co
 				paths, err := mountData(Ctx, config, data.Pod, emptyDir, container)
 				if err != nil {
 					log.G(Ctx).Error("Error mounting EmptyDir " + emptyDir)
-					return "", errors.New("Error mounting EmptyDir " + emptyDir)
-				}
-				for _, path := range paths {
-					mountedData += "-v " + path + " "
+					return nil, errors.New("Error mounting EmptyDir " + emptyDir)
 				}
+				mountedData = append(mountedData, paths...)
 			}
 		}
 	}
 
-	if last := len(mountedData) - 1; last >= 0 && mountedData[last] == ',' {
-		mountedData = mountedData[:last]
-	}
 	return mountedData, nil
 }
 
-func mountData(Ctx context.Context, config commonIL.InterLinkConfig, pod v1.Pod, data interface{}, container v1.Container) ([]string, error) {
-	wd, err := os.Getwd()
+func mountData(Ctx context.Context, config commonIL.InterLinkConfig, pod v1.Pod, data interface{}, container v1.Container) ([]runtime.Mount, error) {
+	podDirectoryPath, err := podDirectory(config, pod.Namespace, string(pod.UID))
 	if err != nil {
 		log.G(Ctx).Error(err)
 		return nil, err
@@ -166,15 +183,15 @@ func mountData(Ctx context.Context, config commonIL.InterLinkConfig, pod v1.Pod,
 
 			switch mount := data.(type) {
 			case v1.ConfigMap:
-				var configMapNamePaths []string
-				err := os.RemoveAll(config.DataRootFolder + pod.Namespace + "-" + string(pod.UID) + "/" + "configMaps/" + vol.Name)
+				var configMapNamePaths []runtime.Mount
+				err := os.RemoveAll(filepath.Join(podDirectoryPath, "configMaps", vol.Name))
 
 				if err != nil {
 					return nil, err
 				}
 
 				if podVolumeSpec != nil && podVolumeSpec.ConfigMap != nil {
-					podConfigMapDir := filepath.Join(wd+"/"+config.DataRootFolder+pod.Namespace+"-"+string(pod.UID)+"/", "configMaps/", vol.Name)
+					podConfigMapDir := filepath.Join(podDirectoryPath, "configMaps", vol.Name)
 					mode := os.FileMode(*podVolumeSpec.ConfigMap.DefaultMode)
 
 					correctMountPath := ""
@@ -187,27 +204,19 @@ func mountData(Ctx context.Context, config commonIL.InterLinkConfig, pod v1.Pod,
 					if mount.Data != nil {
 						for key := range mount.Data {
 							path := filepath.Join(podConfigMapDir, key)
-							path += (":" + correctMountPath + "/" + key + " ")
-							configMapNamePaths = append(configMapNamePaths, path)
+							configMapNamePaths = append(configMapNamePaths, runtime.Mount{Source: path, Target: correctMountPath + "/" + key})
 						}
 					}
 
-					cmd := []string{"-p " + podConfigMapDir}
-					shell := exec2.ExecTask{
-						Command: "mkdir",
-						Args:    cmd,
-						Shell:   true,
-					}
-
-					execReturn, _ := shell.Execute()
-					if execReturn.Stderr != "" {
+					err = os.MkdirAll(podConfigMapDir, os.ModePerm)
+					if err != nil {
 						return nil, err
 					}
 
 					for k, v := range mount.Data {
 						// TODO: Ensure that these files are deleted in failure cases
 						fullPath := filepath.Join(podConfigMapDir, k)
-						os.WriteFile(fullPath, []byte(v), mode)
+						err = os.WriteFile(fullPath, []byte(v), mode)
 						if err != nil {
 							err = os.RemoveAll(fullPath)
 							return nil, err
@@ -217,43 +226,32 @@ func mountData(Ctx context.Context, config commonIL.InterLinkConfig, pod v1.Pod,
 				}
 
 			case v1.Secret:
-				var secretNamePaths []string
-				err := os.RemoveAll(config.DataRootFolder + pod.Namespace + "-" + string(pod.UID) + "/" + "secrets/" + vol.Name)
+				var secretNamePaths []runtime.Mount
+				err := os.RemoveAll(filepath.Join(podDirectoryPath, "secrets", vol.Name))
 
 				if err != nil {
 					return nil, err
 				}
 				if podVolumeSpec != nil && podVolumeSpec.Secret != nil {
 					mode := os.FileMode(*podVolumeSpec.Secret.DefaultMode)
-					podSecretDir := filepath.Join(wd+"/"+config.DataRootFolder+pod.Namespace+"-"+string(pod.UID)+"/", "secrets/", vol.Name)
+					podSecretDir := filepath.Join(podDirectoryPath, "secrets", vol.Name)
 
 					if mount.Data != nil {
 						for key := range mount.Data {
 							path := filepath.Join(podSecretDir, key)
-							path += (":" + mountSpec.MountPath + "/" + key + " ")
-							secretNamePaths = append(secretNamePaths, path)
+							secretNamePaths = append(secretNamePaths, runtime.Mount{Source: path, Target: mountSpec.MountPath + "/" + key})
 						}
 					}
 
-					cmd := []string{"-p " + podSecretDir}
-					shell := exec2.ExecTask{
-						Command: "mkdir",
-						Args:    cmd,
-						Shell:   true,
-					}
-
-					execReturn, _ := shell.Execute()
-					if strings.Compare(execReturn.Stdout, "") != 0 {
+					err = os.MkdirAll(podSecretDir, os.ModePerm)
+					if err != nil {
 						return nil, err
 					}
-					if execReturn.Stderr != "" {
-						return nil, errors.New(execReturn.Stderr)
-					}
 
 					for k, v := range mount.Data {
 						// TODO: Ensure that these files are deleted in failure cases
 						fullPath := filepath.Join(podSecretDir, k)
-						os.WriteFile(fullPath, v, mode)
+						err = os.WriteFile(fullPath, v, mode)
 						if err != nil {
 							err = os.RemoveAll(fullPath)
 							return nil, err
@@ -290,30 +288,18 @@ func mountData(Ctx context.Context, config commonIL.InterLinkConfig, pod v1.Pod,
 						}
 					}
 
-					edPath = filepath.Join(wd + "/" + config.DataRootFolder + pod.Namespace + "-" + string(pod.UID) + "/" + "emptyDirs/" + vol.Name)
-					cmd := []string{"-p " + edPath}
-					shell := exec2.ExecTask{
-						Command: "mkdir",
-						Args:    cmd,
-						Shell:   true,
-					}
-
-					_, err := shell.Execute()
+					edPath = filepath.Join(podDirectoryPath, "emptyDirs", vol.Name)
+					err := os.MkdirAll(edPath, os.ModePerm)
 					if err != nil {
-						return []string{""}, nil
+						return nil, nil
 					}
 
-					if isReadOnly {
-						edPath += (":" + emptyDirMountPath + "/:ro")
-					} else {
-						if isBidirectional {
-							edPath += (":" + emptyDirMountPath + "/:shared")
-						} else {
-							edPath += (":" + emptyDirMountPath + "/")
-						}
+					edMount := runtime.Mount{Source: edPath, Target: emptyDirMountPath, ReadOnly: isReadOnly}
+					if !isReadOnly && isBidirectional {
+						edMount.Propagation = "shared"
 					}
 
-					return []string{edPath}, nil
+					return []runtime.Mount{edMount}, nil
 				}
 			}
 		}
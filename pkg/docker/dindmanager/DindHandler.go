@@ -5,37 +5,89 @@ import (
 	"crypto/rand"
 	"fmt"
 	"os"
+	"path/filepath"
 	"strings"
+	"sync"
 	"time"
 
-	exec "github.com/alexellis/go-execute/pkg/v1"
 	"github.com/containerd/containerd/log"
 
-	OSexec "os/exec"
+	"github.com/intertwin-eu/interlink-docker-plugin/pkg/docker/runtime"
+)
+
+// DindSocketDir is the folder, inside a DIND container, where the inner docker daemon exposes the socket used by the sidecar
+const DindSocketDir = "/run/interlink"
+
+// Labels set on the objects created by the plugin, so that they can be found again after a restart
+const (
+	LabelInstance = "interlink.eu/instance"
+	LabelRole     = "interlink.eu/role"
+	// RolePool is the role of the DIND containers and networks, RolePod the one of the containers of the pods
+	RolePool = "pool"
+	RolePod  = "pod"
 )
 
 type DindManagerInterface interface {
-	CleanDindContainers() error
-	BuildDindContainers(nDindContainer int8) error
-	PrintDindList() error
-	GetAvailableDind() (string, error)
-	SetDindUnavailable(dindID string) error
-	RemoveDindFromList(PodUID string) error
-	SetPodUIDToDind(dindID string, podUID string) error
+	AddDind(dindSpec DindSpecs) error
+	AcquireDind(podUID string, cgroupParent string) (DindSpecs, error)
+	ReleaseDind(podUID string) error
+	RunPoolController(ctx context.Context)
 	GetDindFromPodUID(podUID string) (DindSpecs, error)
-	SetDindAvailable(PodUID string) error
 }
 
+// DindState is the state of a DIND container in the pool. A DIND container is warming until its inner daemon answers,
+// then ready to be acquired by a pod. Once assigned to a pod it is never reused: on release it is draining while it is
+// removed. A DIND container that failed to start is removed as well.
+type DindState string
+
+const (
+	DindWarming  DindState = "warming"
+	DindReady    DindState = "ready"
+	DindAssigned DindState = "assigned"
+	DindDraining DindState = "draining"
+	DindFailed   DindState = "failed"
+)
+
 type DindSpecs struct {
 	DindID        string
 	PodUID        string
 	DindNetworkID string
-	Available     bool
+	State         DindState
+	// CgroupParent is the cgroup parent the DIND container was created in, empty for the default one
+	CgroupParent string
+	// ReadySince is when the DIND container became ready, used to reap idle DIND containers
+	ReadySince time.Time
+	// HealthFailures counts the failed health probes in a row, Message explains why the DIND container failed
+	HealthFailures int
+	Message        string
 }
 
 type DindManager struct {
-	DindList []DindSpecs
-	Ctx      context.Context
+	DindList      []DindSpecs
+	DindListMutex sync.Mutex // Mutex to make DindList access atomic
+	Ctx           context.Context
+	Runtime       runtime.ContainerRuntime
+	SocketsFolder string
+	InstanceID    string
+
+	// sizing of the pool, maintained by RunPoolController
+	MinIdle              int
+	MaxTotal             int // 0 means no limit
+	MaxConcurrentWarmups int
+	IdleTTL              time.Duration
+
+	// builds tracks the DIND containers built in background
+	builds sync.WaitGroup
+	// pendingBuilds counts the DIND containers being built and not yet in DindList
+	pendingBuilds int
+	// acquisitions holds the recent AcquireDind calls, to scale up the pool under bursty traffic
+	acquisitions []time.Time
+	wake         chan struct{}
+}
+
+// PoolLabels returns the labels of the DIND containers and networks of the plugin instance
+func (a *DindManager) PoolLabels() map[string]string {
+	return map[string]string{LabelInstance: a.InstanceID, LabelRole: RolePool}
 }
 
 // GenerateUUIDv4 generates a random UUIDv4
@@ -52,61 +104,61 @@ func GenerateUUIDv4() (string, error) {
 	return fmt.Sprintf("%08x-%04x-%04x-%04x-%012x", uuid[0:4], uuid[4:6], uuid[6:8], uuid[8:10], uuid[10:16]), nil
 }
 
-func (a *DindManager) CleanDindContainers() error {
+// InnerEndpoint returns the endpoint of the docker daemon running inside a DIND container, found from the bind mount of its socket folder
+func InnerEndpoint(dind runtime.ContainerInfo) (string, error) {
+	for _, mount := range dind.Mounts {
+		if mount.Target == DindSocketDir {
+			return "unix://" + filepath.Join(mount.Source, "docker.sock"), nil
+		}
+	}
+	return "", fmt.Errorf("DIND container %s does not expose its docker socket", dind.Name)
+}
 
-	// print the number of DIND containers to be created
-	log.G(a.Ctx).Info(fmt.Sprintf("\u2705 Start cleaning zombie DIND containers"))
+// buildDind builds a DIND container in cgroupParent. If podUID is set, the DIND container is directly assigned to the pod
+// once ready, otherwise it is added to the pool. The caller must have counted the build in pendingBuilds.
+func (a *DindManager) buildDind(podUID string, cgroupParent string) (DindSpecs, error) {
+	dind, err := a.createDind(podUID, cgroupParent)
 
-	// exec this command docker ps -a --format "{{.Names}}" | grep '_dind$' | wc -l
-	shell := exec.ExecTask{
-		Command: "docker",
-		Args:    []string{"ps", "-a", "--format", "{{.Names}}", "|", "grep", "_dind$", "|", "wc", "-l"},
-		Shell:   true,
+	a.DindListMutex.Lock()
+	a.pendingBuilds--
+	if err == nil {
+		a.DindList = append(a.DindList, dind)
 	}
-	execReturn, err := shell.Execute()
+	a.DindListMutex.Unlock()
+
+	// failed builds do not wake up the pool controller, which retries them at its next periodic check
 	if err != nil {
-		return err
+		return DindSpecs{}, err
 	}
 
-	// log the number of zombie DIND containers (remove the \n at the end of the string)
-	log.G(a.Ctx).Info(fmt.Sprintf("\u2705 %s zombie DIND containers found", strings.ReplaceAll(execReturn.Stdout, "\n", "")))
-
-	shell = exec.ExecTask{
-		Command: "docker",
-		Args:    []string{"ps", "-a", "--format", "{{.Names}}", "|", "grep", "_dind$", "|", "xargs", "-I", "{}", "docker", "rm", "-f", "{}"},
-		Shell:   true,
-	}
-	_, err = shell.Execute()
+	socketDir := filepath.Join(a.SocketsFolder, strings.TrimSuffix(dind.DindNetworkID, "_dind_network"))
+	err = a.waitDind(dind.DindID, socketDir)
 	if err != nil {
-		return err
+		log.G(a.Ctx).Error(fmt.Sprintf("\u274C DIND container %s failed to start: %v", dind.DindID, err))
+		a.setDindState(dind.DindID, DindFailed)
+		a.destroyDind(dind.DindID)
+		return DindSpecs{}, err
 	}
 
-	// exec this command  docker network ls --filter name=_dind_network$ --format "{{.ID}}" | xargs -r docker network rm
+	log.G(a.Ctx).Info(fmt.Sprintf("\u2705 DIND container %s is up and running", dind.DindID))
 
-	shell = exec.ExecTask{
-		Command: "docker",
-		Args:    []string{"network", "ls", "--filter", "name=_dind_network$", "--format", "{{.ID}}", "|", "xargs", "-r", "docker", "network", "rm"},
-		Shell:   true,
-	}
-	_, err = shell.Execute()
-	if err != nil {
-		return err
+	dind.State = DindReady
+	if podUID != "" {
+		dind.State = DindAssigned
 	}
+	a.setDindState(dind.DindID, dind.State)
+	a.notify()
 
-	log.G(a.Ctx).Info(fmt.Sprintf("\u2705 DIND zombie containers cleaned"))
-
-	return nil
+	return dind, nil
 }
 
-func (a *DindManager) BuildDindContainers(nDindContainer int8) error {
-
-	// print the number of DIND containers to be created
-	log.G(a.Ctx).Info(fmt.Sprintf("\u2705 Creating %d DIND containers", nDindContainer))
+// createDind creates the network and the container of a DIND container, returned as warming
+func (a *DindManager) createDind(podUID string, cgroupParent string) (DindSpecs, error) {
 
 	// get the working dir
 	wd, err := os.Getwd()
 	if err != nil {
-		return err
+		return DindSpecs{}, err
 	}
 
 	// get the env variable GPUENABLED, if 1 then the DIND container will have GPU support, otherwise it will not
@@ -117,154 +169,250 @@ func (a *DindManager) BuildDindContainers(nDindContainer int8) error {
 		dindImage = "ghcr.io/extrality/nvidia-dind"
 	}
 
-	for i := int8(0); i < nDindContainer; i++ {
+	// generate a random UID for the DIND container
+	randUID, err := GenerateUUIDv4()
+	if err != nil {
+		return DindSpecs{}, err
+	}
 
-		// generate a random UID for the DIND container
-		randUID, err := GenerateUUIDv4()
-		if err != nil {
-			return err
-		}
+	// create the networks
+	_, err = a.Runtime.CreateNetwork(a.Ctx, randUID+"_dind_network", a.PoolLabels())
+	if err != nil {
+		return DindSpecs{}, err
+	}
 
-		// create the networks
-		shell := exec.ExecTask{
-			Command: "docker",
-			Args:    []string{"network", "create", "--driver", "bridge", randUID + "_dind_network"},
-			Shell:   true,
-		}
-		_, err = shell.Execute()
+	log.G(a.Ctx).Info(fmt.Sprintf("\u2705 DIND network %s created", randUID+"_dind_network"))
 
-		log.G(a.Ctx).Info(fmt.Sprintf("\u2705 DIND network %s created", randUID+"_dind_network"))
+	// the inner daemon also listens on a socket in this folder, so that the sidecar can reach it from the host
+	socketDir := filepath.Join(a.SocketsFolder, randUID)
+	err = os.MkdirAll(socketDir, os.ModePerm)
+	if err != nil {
+		return DindSpecs{}, err
+	}
 
-		if err != nil {
-			return err
-		}
+	mounts := []runtime.Mount{}
+	if _, err := os.Stat("/cvmfs"); err == nil {
+		mounts = append(mounts, runtime.Mount{Source: "/cvmfs", Target: "/cvmfs"})
+	}
+	mounts = append(mounts,
+		runtime.Mount{Source: wd, Target: wd},
+		runtime.Mount{Source: "/home", Target: "/home"},
+		runtime.Mount{Source: "/var/lib/docker/overlay2", Target: "/var/lib/docker/overlay2"},
+		runtime.Mount{Source: "/var/lib/docker/image", Target: "/var/lib/docker/image"},
+		runtime.Mount{Source: socketDir, Target: DindSocketDir},
+	)
+
+	dindSpec := runtime.ContainerSpec{
+		Name:  randUID + "_dind",
+		Image: dindImage,
+		// the dind entrypoint prepends dockerd and its default socket to these flags
+		Cmd:          []string{"--host=unix://" + DindSocketDir + "/docker.sock"},
+		Labels:       a.PoolLabels(),
+		Mounts:       mounts,
+		NetworkMode:  randUID + "_dind_network",
+		Privileged:   true,
+		CgroupParent: cgroupParent,
+	}
 
-		dindContainerArgs := []string{"run"}
-		//dindContainerArgs = append(dindContainerArgs, gpuArgsAsArray...)
-		if _, err := os.Stat("/cvmfs"); err == nil {
-			dindContainerArgs = append(dindContainerArgs, "-v", "/cvmfs:/cvmfs")
-		}
+	// "nvidia" runtime is added to the dind container if the GPUENABLED env variable is set to 1
+	if gpuEnabled == "1" {
+		dindSpec.Runtime = "nvidia"
+	}
 
-		// add the network to the dind container
-		dindContainerArgs = append(dindContainerArgs, "--network", randUID+"_dind_network")
-		// "--runtime=nvidia" is added to the dind container if the GPUENABLED env variable is set to 1
+	dindContainerID, err := a.Runtime.CreateContainer(a.Ctx, dindSpec)
+	if err != nil {
+		a.Runtime.RemoveNetwork(a.Ctx, randUID+"_dind_network")
+		os.RemoveAll(socketDir)
+		return DindSpecs{}, err
+	}
 
-		if gpuEnabled == "1" {
-			dindContainerArgs = append(dindContainerArgs, "--runtime=nvidia")
-		}
-		dindContainerArgs = append(dindContainerArgs, "--privileged", "-v", wd+":/"+wd, "-v", "/home:/home", "-v", "/var/lib/docker/overlay2:/var/lib/docker/overlay2", "-v", "/var/lib/docker/image:/var/lib/docker/image", "-d", "--name", randUID+"_dind", dindImage)
+	return DindSpecs{DindID: dindContainerID, PodUID: podUID, DindNetworkID: randUID + "_dind_network", State: DindWarming, CgroupParent: cgroupParent}, nil
+}
 
-		var dindContainerID string
-		shell = exec.ExecTask{
-			Command: "docker",
-			Args:    dindContainerArgs,
-			Shell:   true,
+// waitDind starts a DIND container and waits until its inner daemon answers
+func (a *DindManager) waitDind(dindContainerID string, socketDir string) error {
+	err := a.Runtime.StartContainer(a.Ctx, dindContainerID)
+	if err != nil {
+		return err
+	}
+
+	innerRuntime, err := a.Runtime.Inner("unix://" + filepath.Join(socketDir, "docker.sock"))
+	if err != nil {
+		return err
+	}
+
+	// create a variable of maximum number of retries
+	maxRetries := 20
+
+	// wait until the daemon inside the dind container answers
+	for {
+
+		if maxRetries == 0 {
+			return fmt.Errorf("DIND container %s not up and running: %v", dindContainerID, err)
 		}
 
-		execReturn, err := shell.Execute()
-		if err != nil {
-			return err
+		err = innerRuntime.Ping(a.Ctx)
+		if err == nil {
+			return nil
 		}
-		dindContainerID = execReturn.Stdout
+		time.Sleep(1 * time.Second)
+
+		maxRetries -= 1
 
-		// create a variable of maximum number of retries
-		maxRetries := 20
-		output := []byte{}
+	}
+}
 
-		// wait until the dind container is up and running by check that the command docker ps inside of it does not return an error
-		for {
+func (a *DindManager) setDindState(dindID string, state DindState) {
+	a.DindListMutex.Lock()
+	defer a.DindListMutex.Unlock()
 
-			if maxRetries == 0 {
-				return fmt.Errorf("DIND container %s not up and running", dindContainerID)
+	for i := range a.DindList {
+		if a.DindList[i].DindID == dindID {
+			a.DindList[i].State = state
+			if state == DindReady {
+				a.DindList[i].ReadySince = time.Now()
 			}
+		}
+	}
+}
 
-			cmd := OSexec.Command("docker", "logs", randUID+"_dind")
-			output, err = cmd.CombinedOutput()
+// destroyDind removes a DIND container, its network and its socket folder, then removes it from the list.
+// The DIND container is expected to be draining or failed, so that no one else acquires it meanwhile.
+func (a *DindManager) destroyDind(dindID string) error {
+	a.DindListMutex.Lock()
+	dind, found := DindSpecs{}, false
+	for _, dindSpec := range a.DindList {
+		if dindSpec.DindID == dindID {
+			dind, found = dindSpec, true
+		}
+	}
+	a.DindListMutex.Unlock()
 
-			if err != nil {
-				time.Sleep(1 * time.Second)
-			}
+	if !found {
+		return fmt.Errorf("DIND container %s not found", dindID)
+	}
 
-			if strings.Contains(string(output), "API listen on /var/run/docker.sock") {
-				break
-			} else {
-				time.Sleep(1 * time.Second)
-			}
+	// the endpoint of the inner daemon is found before the container is gone, to close its client
+	info, inspectErr := a.Runtime.InspectContainer(a.Ctx, dind.DindID)
 
-			maxRetries -= 1
+	err := a.Runtime.RemoveContainer(a.Ctx, dind.DindID, true)
+	if err != nil && !runtime.IsNotFound(err) {
+		a.setDindState(dindID, DindFailed)
+		return err
+	}
 
+	if inspectErr == nil {
+		if endpoint, err := InnerEndpoint(info); err == nil {
+			a.Runtime.Forget(endpoint)
 		}
+	}
 
-		log.G(a.Ctx).Info(fmt.Sprintf("\u2705 DIND container %s is up and running", dindContainerID))
-
-		// add the dind container to the list of DIND containers
-		a.DindList = append(a.DindList, DindSpecs{DindID: randUID + "_dind", PodUID: "", DindNetworkID: randUID + "_dind_network", Available: true})
+	err = a.Runtime.RemoveNetwork(a.Ctx, dind.DindNetworkID)
+	if err != nil && !runtime.IsNotFound(err) {
+		log.G(a.Ctx).Error(fmt.Sprintf("\u274C Error deleting network %s: %v", dind.DindNetworkID, err))
 	}
 
-	return nil
-}
+	if a.SocketsFolder != "" && dind.DindNetworkID != "" {
+		os.RemoveAll(filepath.Join(a.SocketsFolder, strings.TrimSuffix(dind.DindNetworkID, "_dind_network")))
+	}
 
-func (a *DindManager) PrintDindList() error {
-	for _, dindSpec := range a.DindList {
-		log.G(a.Ctx).Info(fmt.Sprintf("DindID: %s, PodUID: %s, DindNetworkID: %s, Available: %t", dindSpec.DindID, dindSpec.PodUID, dindSpec.DindNetworkID, dindSpec.Available))
+	a.DindListMutex.Lock()
+	defer a.DindListMutex.Unlock()
+	for i := range a.DindList {
+		if a.DindList[i].DindID == dindID {
+			a.DindList = append(a.DindList[:i], a.DindList[i+1:]...)
+			break
+		}
 	}
 	return nil
 }
 
-func (a *DindManager) GetDindFromPodUID(podUID string) (DindSpecs, error) {
-	for _, dindSpec := range a.DindList {
-		if dindSpec.PodUID == podUID {
-			return dindSpec, nil
+// AddDind adds an already running DIND container to the list, used to re-adopt the DIND containers found at startup
+func (a *DindManager) AddDind(dindSpec DindSpecs) error {
+	a.DindListMutex.Lock()
+	defer a.DindListMutex.Unlock()
+
+	for _, existing := range a.DindList {
+		if existing.DindID == dindSpec.DindID {
+			return fmt.Errorf("DIND container %s already in the list", dindSpec.DindID)
 		}
 	}
-	return DindSpecs{}, fmt.Errorf("DIND container with PodUID %s not found", podUID)
+	if dindSpec.State == DindReady && dindSpec.ReadySince.IsZero() {
+		dindSpec.ReadySince = time.Now()
+	}
+	a.DindList = append(a.DindList, dindSpec)
+	return nil
 }
 
-func (a *DindManager) GetAvailableDind() (string, error) {
-	for _, dindSpec := range a.DindList {
-		if dindSpec.Available {
-			return dindSpec.DindID, nil
+// AcquireDind picks a ready DIND container and assigns it to the pod in one step, so that a DIND container is never
+// handed to two pods. If none is ready, a DIND container is built for the pod, unless the pool is at its maximum size.
+// The cgroup parent of a container cannot be changed, so pods needing a cgroupParent always get a DIND container
+// built for them, and their acquisitions do not raise the idle target of the pool.
+func (a *DindManager) AcquireDind(podUID string, cgroupParent string) (DindSpecs, error) {
+	a.DindListMutex.Lock()
+	if cgroupParent == "" {
+		a.acquisitions = append(a.acquisitions, time.Now())
+	}
+	for i := range a.DindList {
+		if a.DindList[i].PodUID == podUID {
+			a.DindListMutex.Unlock()
+			return DindSpecs{}, fmt.Errorf("a DIND container is already assigned to pod %s", podUID)
 		}
 	}
-	return "", fmt.Errorf("No available DIND container")
-}
+	for i := range a.DindList {
+		if a.DindList[i].State == DindReady && a.DindList[i].CgroupParent == cgroupParent {
+			a.DindList[i].State = DindAssigned
+			a.DindList[i].PodUID = podUID
+			dind := a.DindList[i]
+			a.DindListMutex.Unlock()
 
-func (a *DindManager) SetDindUnavailable(dindID string) error {
-	for i, dindSpec := range a.DindList {
-		if dindSpec.DindID == dindID {
-			a.DindList[i].Available = false
-			return nil
+			// the pool controller replaces it
+			a.notify()
+
+			return dind, nil
 		}
 	}
-	return fmt.Errorf("DIND container %s not found", dindID)
+	if a.MaxTotal > 0 && a.countDinds()+a.pendingBuilds >= a.MaxTotal {
+		a.DindListMutex.Unlock()
+		return DindSpecs{}, fmt.Errorf("no available DIND container and maximum number of %d DIND containers reached", a.MaxTotal)
+	}
+	a.pendingBuilds++
+	a.DindListMutex.Unlock()
+
+	log.G(a.Ctx).Info("\u2705 No available DIND container found, creating a new one for pod " + podUID)
+
+	return a.buildDind(podUID, cgroupParent)
 }
 
-func (a *DindManager) SetDindAvailable(PodUI string) error {
-	for i, dindSpec := range a.DindList {
-		if dindSpec.PodUID == PodUI {
-			a.DindList[i].Available = true
-			return nil
+// ReleaseDind destroys the DIND container assigned to a pod
+func (a *DindManager) ReleaseDind(podUID string) error {
+	a.DindListMutex.Lock()
+	dindID := ""
+	for i := range a.DindList {
+		if a.DindList[i].PodUID == podUID && a.DindList[i].State != DindDraining {
+			a.DindList[i].State = DindDraining
+			dindID = a.DindList[i].DindID
+			break
 		}
 	}
-	return fmt.Errorf("DIND container %s not found", PodUI)
-}
+	a.DindListMutex.Unlock()
 
-func (a *DindManager) SetPodUIDToDind(dindID string, podUID string) error {
-	for i, dindSpec := range a.DindList {
-		if dindSpec.DindID == dindID {
-			a.DindList[i].PodUID = podUID
-			return nil
-		}
+	if dindID == "" {
+		return fmt.Errorf("DIND container with PodUID %s not found", podUID)
 	}
-	return fmt.Errorf("DIND container %s not found", dindID)
+	err := a.destroyDind(dindID)
+	a.notify()
+	return err
 }
 
-func (a *DindManager) RemoveDindFromList(PodUID string) error {
-	for i, dindSpec := range a.DindList {
-		if dindSpec.PodUID == PodUID {
-			a.DindList = append(a.DindList[:i], a.DindList[i+1:]...)
-			return nil
+func (a *DindManager) GetDindFromPodUID(podUID string) (DindSpecs, error) {
+	a.DindListMutex.Lock()
+	defer a.DindListMutex.Unlock()
+
+	for _, dindSpec := range a.DindList {
+		if dindSpec.PodUID == podUID {
+			return dindSpec, nil
 		}
 	}
-	return fmt.Errorf("DIND container with PodUID %s not found", PodUID)
+	return DindSpecs{}, fmt.Errorf("DIND container with PodUID %s not found", podUID)
 }
@@ -0,0 +1,256 @@
+package dindmanager
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/containerd/containerd/log"
+
+	"github.com/intertwin-eu/interlink-docker-plugin/pkg/docker/runtime"
+)
+
+// poolDemandWindow is how long an acquisition raises the idle target of the pool
+const poolDemandWindow = time.Minute
+
+// poolControlInterval is how often the pool is checked when nothing happens, and the health of the DIND containers probed
+const poolControlInterval = 10 * time.Second
+
+// dindHealthThreshold is the number of failed health probes in a row after which a DIND container is failed
+const dindHealthThreshold = 3
+
+// dindProbeTimeout is how long the inner daemon of a DIND container has to answer a health probe
+var dindProbeTimeout = 5 * time.Second
+
+// notify wakes up the pool controller, if running
+func (a *DindManager) notify() {
+	a.DindListMutex.Lock()
+	wake := a.wake
+	a.DindListMutex.Unlock()
+
+	if wake == nil {
+		return
+	}
+	select {
+	case wake <- struct{}{}:
+	default:
+	}
+}
+
+// countDinds returns the number of DIND containers in the list that are not being removed. DindListMutex must be held.
+func (a *DindManager) countDinds() int {
+	count := 0
+	for _, dindSpec := range a.DindList {
+		if dindSpec.State != DindDraining && dindSpec.State != DindFailed {
+			count++
+		}
+	}
+	return count
+}
+
+// RunPoolController maintains the pool until ctx is done. The idle target is MinIdle plus the number of DIND containers
+// acquired in the last minute, so that the pool grows under bursty create traffic. At most MaxConcurrentWarmups DIND
+// containers are built at the same time and the pool never exceeds MaxTotal DIND containers. Idle DIND containers beyond
+// the target are removed once they have been idle for IdleTTL.
+func (a *DindManager) RunPoolController(ctx context.Context) {
+	a.DindListMutex.Lock()
+	if a.wake == nil {
+		a.wake = make(chan struct{}, 1)
+	}
+	wake := a.wake
+	a.DindListMutex.Unlock()
+
+	log.G(a.Ctx).Info(fmt.Sprintf("\u2705 DIND pool controller started, min idle: %d, max total: %d, max concurrent warmups: %d, idle TTL: %s", a.MinIdle, a.MaxTotal, a.MaxConcurrentWarmups, a.IdleTTL))
+
+	ticker := time.NewTicker(poolControlInterval)
+	defer ticker.Stop()
+
+	for {
+		a.controlPool()
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			a.checkDindHealth()
+		case <-wake:
+		}
+	}
+}
+
+// controlPool builds or removes DIND containers to reach the idle target of the pool
+func (a *DindManager) controlPool() {
+	now := time.Now()
+
+	a.DindListMutex.Lock()
+
+	recentAcquisitions := a.acquisitions[:0]
+	for _, acquisition := range a.acquisitions {
+		if now.Sub(acquisition) < poolDemandWindow {
+			recentAcquisitions = append(recentAcquisitions, acquisition)
+		}
+	}
+	a.acquisitions = recentAcquisitions
+	target := a.MinIdle + len(recentAcquisitions)
+
+	ready, warmingIdle, warming := 0, 0, a.pendingBuilds
+	for _, dindSpec := range a.DindList {
+		switch dindSpec.State {
+		case DindReady:
+			ready++
+		case DindWarming:
+			warming++
+			if dindSpec.PodUID == "" {
+				warmingIdle++
+			}
+		}
+	}
+
+	toBuild := target - ready - warmingIdle - a.pendingBuilds
+	if a.MaxConcurrentWarmups > 0 {
+		toBuild = min(toBuild, a.MaxConcurrentWarmups-warming)
+	}
+	if a.MaxTotal > 0 {
+		toBuild = min(toBuild, a.MaxTotal-a.countDinds()-a.pendingBuilds)
+	}
+	if toBuild > 0 {
+		a.pendingBuilds += toBuild
+	}
+
+	var reaped []string
+	excess := ready - target
+	if a.IdleTTL > 0 {
+		for i := range a.DindList {
+			if excess <= 0 {
+				break
+			}
+			if a.DindList[i].State == DindReady && now.Sub(a.DindList[i].ReadySince) >= a.IdleTTL {
+				a.DindList[i].State = DindDraining
+				reaped = append(reaped, a.DindList[i].DindID)
+				excess--
+			}
+		}
+	}
+
+	a.DindListMutex.Unlock()
+
+	if toBuild > 0 {
+		log.G(a.Ctx).Info(fmt.Sprintf("\u2705 DIND pool below its idle target of %d, creating %d DIND containers", target, toBuild))
+	}
+	for i := 0; i < toBuild; i++ {
+		a.builds.Add(1)
+		go func() {
+			defer a.builds.Done()
+			a.buildDind("", "")
+		}()
+	}
+
+	for _, dindID := range reaped {
+		log.G(a.Ctx).Info(fmt.Sprintf("\u2705 Removing DIND container %s, idle for more than %s", dindID, a.IdleTTL))
+		err := a.destroyDind(dindID)
+		if err != nil {
+			log.G(a.Ctx).Error(fmt.Sprintf("\u274C Error removing idle DIND container %s: %v", dindID, err))
+		}
+	}
+}
+
+// probeDind checks that a DIND container is running and that its inner daemon answers. The returned bool is true if the
+// DIND container is not running anymore, in which case there is no point in probing it again.
+func (a *DindManager) probeDind(dindID string) (bool, error) {
+	dind, err := a.Runtime.InspectContainer(a.Ctx, dindID)
+	if runtime.IsNotFound(err) {
+		return true, fmt.Errorf("DIND container %s does not exist anymore", dindID)
+	} else if err != nil {
+		return false, err
+	}
+	if !dind.State.Running {
+		return true, fmt.Errorf("DIND container %s is %s (exit code %d)", dind.Name, dind.State.Status, dind.State.ExitCode)
+	}
+
+	endpoint, err := InnerEndpoint(dind)
+	if err != nil {
+		return true, err
+	}
+	innerRuntime, err := a.Runtime.Inner(endpoint)
+	if err != nil {
+		return false, err
+	}
+
+	ctx, cancel := context.WithTimeout(a.Ctx, dindProbeTimeout)
+	defer cancel()
+	err = innerRuntime.Ping(ctx)
+	if err != nil {
+		return false, fmt.Errorf("docker daemon of DIND container %s is not answering: %v", dind.Name, err)
+	}
+	return false, nil
+}
+
+// checkDindHealth probes the ready and assigned DIND containers. A DIND container that stopped, or whose inner daemon
+// failed dindHealthThreshold probes in a row, is failed: idle ones are removed, so that the pool controller replaces
+// them, while assigned ones are kept to report their pod as failed until it is deleted. The DIND containers are probed
+// all at once, so that unresponsive ones hold the pool controller for a single probe timeout.
+func (a *DindManager) checkDindHealth() {
+	a.DindListMutex.Lock()
+	var probed []string
+	for _, dindSpec := range a.DindList {
+		if dindSpec.State == DindReady || dindSpec.State == DindAssigned {
+			probed = append(probed, dindSpec.DindID)
+		}
+	}
+	a.DindListMutex.Unlock()
+
+	type probeResult struct {
+		dead bool
+		err  error
+	}
+	results := make([]probeResult, len(probed))
+	var wg sync.WaitGroup
+	for i, dindID := range probed {
+		wg.Add(1)
+		go func(i int, dindID string) {
+			defer wg.Done()
+			results[i].dead, results[i].err = a.probeDind(dindID)
+		}(i, dindID)
+	}
+	wg.Wait()
+
+	var failedIdle []string
+	a.DindListMutex.Lock()
+	for j, dindID := range probed {
+		dead, err := results[j].dead, results[j].err
+		for i := range a.DindList {
+			dindSpec := &a.DindList[i]
+			if dindSpec.DindID != dindID || (dindSpec.State != DindReady && dindSpec.State != DindAssigned) {
+				continue
+			}
+			if err == nil {
+				dindSpec.HealthFailures = 0
+				continue
+			}
+
+			dindSpec.HealthFailures++
+			log.G(a.Ctx).Warning(fmt.Sprintf("\u26A0 Health probe %d/%d of DIND container %s failed: %v", dindSpec.HealthFailures, dindHealthThreshold, dindID, err))
+			if !dead && dindSpec.HealthFailures < dindHealthThreshold {
+				continue
+			}
+
+			dindSpec.Message = err.Error()
+			if dindSpec.State == DindReady {
+				failedIdle = append(failedIdle, dindID)
+			} else {
+				log.G(a.Ctx).Error(fmt.Sprintf("\u274C DIND container %s of pod %s failed: %v", dindID, dindSpec.PodUID, err))
+			}
+			dindSpec.State = DindFailed
+		}
+	}
+	a.DindListMutex.Unlock()
+
+	for _, dindID := range failedIdle {
+		log.G(a.Ctx).Info(fmt.Sprintf("\u2705 Replacing failed idle DIND container %s", dindID))
+		err := a.destroyDind(dindID)
+		if err != nil {
+			log.G(a.Ctx).Error(fmt.Sprintf("\u274C Error removing failed DIND container %s: %v", dindID, err))
+		}
+	}
+}
@@ -0,0 +1,300 @@
+package dindmanager
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/intertwin-eu/interlink-docker-plugin/pkg/docker/runtime"
+)
+
+func newTestDindManager(t *testing.T) (*DindManager, *runtime.FakeRuntime) {
+	t.Helper()
+
+	fakeRuntime := runtime.NewFakeRuntime()
+	dindManager := &DindManager{
+		Ctx:           context.Background(),
+		Runtime:       fakeRuntime,
+		SocketsFolder: t.TempDir(),
+		InstanceID:    "test",
+	}
+	// DIND containers built in background must be done before the temporary folder is removed
+	t.Cleanup(dindManager.builds.Wait)
+	return dindManager, fakeRuntime
+}
+
+// warmPool has the pool controller build idle DIND containers until idle of them are ready
+func warmPool(dindManager *DindManager, idle int) {
+	minIdle := dindManager.MinIdle
+	dindManager.MinIdle = idle
+	dindManager.controlPool()
+	dindManager.builds.Wait()
+	dindManager.MinIdle = minIdle
+}
+
+func TestAcquireDindConcurrently(t *testing.T) {
+	dindManager, fakeRuntime := newTestDindManager(t)
+	warmPool(dindManager, 3)
+
+	nPods := 20
+	acquired := make([]DindSpecs, nPods)
+	errs := make([]error, nPods)
+
+	var wg sync.WaitGroup
+	for i := 0; i < nPods; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			acquired[i], errs[i] = dindManager.AcquireDind(fmt.Sprintf("uid-%d", i), "")
+		}(i)
+	}
+	wg.Wait()
+	dindManager.builds.Wait()
+
+	owners := map[string]string{}
+	for i, dind := range acquired {
+		if errs[i] != nil {
+			t.Fatalf("pod %d: %v", i, errs[i])
+		}
+		if dind.State != DindAssigned || dind.PodUID != fmt.Sprintf("uid-%d", i) {
+			t.Errorf("pod %d: unexpected DIND %+v", i, dind)
+		}
+		if owner, ok := owners[dind.DindID]; ok {
+			t.Errorf("DIND container %s assigned to both %s and %s", dind.DindID, owner, dind.PodUID)
+		}
+		owners[dind.DindID] = dind.PodUID
+	}
+
+	if _, err := dindManager.AcquireDind("uid-0", ""); err == nil {
+		t.Error("expected an error acquiring a second DIND container for the same pod")
+	}
+
+	// releasing concurrently destroys every assigned DIND container exactly once
+	for i := 0; i < nPods; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if err := dindManager.ReleaseDind(fmt.Sprintf("uid-%d", i)); err != nil {
+				t.Errorf("pod %d: %v", i, err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	for _, dind := range dindManager.DindList {
+		if dind.State != DindReady {
+			t.Errorf("expected only ready DIND containers left, got %+v", dind)
+		}
+	}
+	containers, err := fakeRuntime.ListContainers(context.Background(), runtime.ListOptions{All: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(containers) != len(dindManager.DindList) {
+		t.Errorf("expected %d DIND containers left, got %d", len(dindManager.DindList), len(containers))
+	}
+	if err := dindManager.ReleaseDind("uid-0"); err == nil {
+		t.Error("expected an error releasing a DIND container twice")
+	}
+}
+
+func countStates(dindManager *DindManager) map[DindState]int {
+	dindManager.DindListMutex.Lock()
+	defer dindManager.DindListMutex.Unlock()
+
+	counts := map[DindState]int{}
+	for _, dind := range dindManager.DindList {
+		counts[dind.State]++
+	}
+	return counts
+}
+
+func TestPoolControllerScaling(t *testing.T) {
+	dindManager, _ := newTestDindManager(t)
+	dindManager.MinIdle = 2
+	dindManager.MaxTotal = 3
+	dindManager.MaxConcurrentWarmups = 1
+
+	controlPool := func() {
+		dindManager.controlPool()
+		dindManager.builds.Wait()
+	}
+
+	// one DIND container is built at a time, up to the minimum of idle ones
+	controlPool()
+	if ready := countStates(dindManager)[DindReady]; ready != 1 {
+		t.Fatalf("expected 1 ready DIND container after the first check, got %d", ready)
+	}
+	controlPool()
+	controlPool()
+	if ready := countStates(dindManager)[DindReady]; ready != 2 {
+		t.Fatalf("expected 2 ready DIND containers, got %d", ready)
+	}
+
+	// an acquisition raises the idle target, but the pool stays within its maximum size
+	if _, err := dindManager.AcquireDind("uid-1", ""); err != nil {
+		t.Fatal(err)
+	}
+	controlPool()
+	controlPool()
+	if counts := countStates(dindManager); counts[DindReady] != 2 || counts[DindAssigned] != 1 {
+		t.Fatalf("unexpected pool %v", counts)
+	}
+
+	for _, podUID := range []string{"uid-2", "uid-3"} {
+		if _, err := dindManager.AcquireDind(podUID, ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := dindManager.AcquireDind("uid-4", ""); err == nil {
+		t.Error("expected an error acquiring a DIND container beyond the maximum size of the pool")
+	}
+}
+
+func TestPoolControllerCgroupParent(t *testing.T) {
+	dindManager, _ := newTestDindManager(t)
+	controlPool := func() {
+		dindManager.controlPool()
+		dindManager.builds.Wait()
+	}
+
+	// a DIND container in a cgroup parent is built for its pod, the pool cannot serve it so it is not warmed for it
+	dind, err := dindManager.AcquireDind("uid-1", "/interlink/default")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dindManager.builds.Wait()
+	if dind.CgroupParent != "/interlink/default" || dind.PodUID != "uid-1" {
+		t.Errorf("unexpected DIND container %+v", dind)
+	}
+	controlPool()
+	if counts := countStates(dindManager); counts[DindReady] != 0 || counts[DindWarming] != 0 {
+		t.Errorf("expected no idle DIND container to be built, got %v", counts)
+	}
+
+	// an acquisition the pool could serve raises its idle target
+	if _, err := dindManager.AcquireDind("uid-2", ""); err != nil {
+		t.Fatal(err)
+	}
+	controlPool()
+	if ready := countStates(dindManager)[DindReady]; ready != 1 {
+		t.Errorf("expected 1 ready DIND container, got %d", ready)
+	}
+}
+
+func TestPoolControllerReapsIdle(t *testing.T) {
+	dindManager, fakeRuntime := newTestDindManager(t)
+	warmPool(dindManager, 4)
+	dindManager.MinIdle = 1
+	dindManager.MaxConcurrentWarmups = 1
+	dindManager.IdleTTL = time.Minute
+
+	// idle DIND containers are kept until the TTL expires
+	dindManager.controlPool()
+	if ready := countStates(dindManager)[DindReady]; ready != 4 {
+		t.Fatalf("expected 4 ready DIND containers before the TTL, got %d", ready)
+	}
+
+	dindManager.DindListMutex.Lock()
+	for i := range dindManager.DindList {
+		dindManager.DindList[i].ReadySince = time.Now().Add(-2 * time.Minute)
+	}
+	dindManager.DindListMutex.Unlock()
+
+	dindManager.controlPool()
+	if counts := countStates(dindManager); len(dindManager.DindList) != 1 || counts[DindReady] != 1 {
+		t.Fatalf("expected a single ready DIND container after the TTL, got %v", counts)
+	}
+	containers, err := fakeRuntime.ListContainers(context.Background(), runtime.ListOptions{All: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(containers) != 1 {
+		t.Errorf("expected the idle DIND containers to be removed, %d left", len(containers))
+	}
+}
+
+func TestCheckDindHealth(t *testing.T) {
+	dindManager, fakeRuntime := newTestDindManager(t)
+	warmPool(dindManager, 2)
+	assigned, err := dindManager.AcquireDind("uid-1", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	idleID := ""
+	for _, dind := range dindManager.DindList {
+		if dind.State == DindReady {
+			idleID = dind.DindID
+		}
+	}
+
+	// the inner daemon of the idle DIND container stops answering
+	idle, err := fakeRuntime.InspectContainer(context.Background(), idleID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	endpoint, err := InnerEndpoint(idle)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fakeRuntime.InnerFake(endpoint).PingErr = fmt.Errorf("connection refused")
+
+	for i := 0; i < dindHealthThreshold-1; i++ {
+		dindManager.checkDindHealth()
+	}
+	if counts := countStates(dindManager); counts[DindReady] != 1 {
+		t.Fatalf("expected the idle DIND container to be kept until the threshold, got %v", counts)
+	}
+	dindManager.checkDindHealth()
+	if _, err := fakeRuntime.InspectContainer(context.Background(), idleID); !runtime.IsNotFound(err) {
+		t.Errorf("expected the failed idle DIND container to be removed, got %v", err)
+	}
+	if fakeRuntime.InnerFake(endpoint).PingErr != nil {
+		t.Error("expected the client of the removed DIND container to be forgotten")
+	}
+
+	// the assigned DIND container stops: it is failed at once, and kept for the status of its pod
+	fakeRuntime.SetState(assigned.DindID, runtime.ContainerState{Status: "exited", ExitCode: 1})
+	dindManager.checkDindHealth()
+	dind, err := dindManager.GetDindFromPodUID("uid-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dind.State != DindFailed || dind.Message == "" {
+		t.Errorf("expected the DIND container of uid-1 to be failed with a message, got %+v", dind)
+	}
+}
+
+func TestCheckDindHealthConcurrently(t *testing.T) {
+	defer func(timeout time.Duration) { dindProbeTimeout = timeout }(dindProbeTimeout)
+	dindProbeTimeout = 200 * time.Millisecond
+
+	dindManager, fakeRuntime := newTestDindManager(t)
+	warmPool(dindManager, 4)
+
+	// none of the inner daemons answers
+	for _, dindSpec := range dindManager.DindList {
+		dind, err := fakeRuntime.InspectContainer(context.Background(), dindSpec.DindID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		endpoint, err := InnerEndpoint(dind)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fakeRuntime.InnerFake(endpoint).PingHangs = true
+	}
+
+	start := time.Now()
+	dindManager.checkDindHealth()
+	if elapsed := time.Since(start); elapsed > 3*dindProbeTimeout {
+		t.Errorf("expected the DIND containers to be probed at once, took %s", elapsed)
+	}
+	for _, dindSpec := range dindManager.DindList {
+		if dindSpec.HealthFailures != 1 {
+			t.Errorf("expected a failed probe of DIND container %s, got %d", dindSpec.DindID, dindSpec.HealthFailures)
+		}
+	}
+}
@@ -0,0 +1,412 @@
+package docker
+
+import (
+	"bufio"
+	"fmt"
+	"math"
+	"os"
+	goruntime "runtime"
+	"sort"
+	"strconv"
+	"strings"
+
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+
+	commonIL "github.com/intertwin-eu/interlink-docker-plugin/pkg/common"
+)
+
+// podEnvSources holds the ConfigMaps and Secrets retrieved by interLink for the containers of a pod, by name
+type podEnvSources struct {
+	configMaps map[string]v1.ConfigMap
+	secrets    map[string]v1.Secret
+}
+
+func newPodEnvSources(podData commonIL.RetrievedPodData) podEnvSources {
+	sources := podEnvSources{configMaps: map[string]v1.ConfigMap{}, secrets: map[string]v1.Secret{}}
+	for _, container := range append(append([]commonIL.RetrievedContainer{}, podData.InitContainers...), podData.Containers...) {
+		for _, configMap := range container.ConfigMaps {
+			sources.configMaps[configMap.Name] = configMap
+		}
+		for _, secret := range container.Secrets {
+			sources.secrets[secret.Name] = secret
+		}
+	}
+	return sources
+}
+
+// configMapValue returns the value of a key of a ConfigMap, and whether it exists
+func (s podEnvSources) configMapValue(name string, key string) (string, bool, error) {
+	configMap, ok := s.configMaps[name]
+	if !ok {
+		return "", false, fmt.Errorf("configmap %q not found", name)
+	}
+	if value, ok := configMap.Data[key]; ok {
+		return value, true, nil
+	}
+	if value, ok := configMap.BinaryData[key]; ok {
+		return string(value), true, nil
+	}
+	return "", false, nil
+}
+
+// secretValue returns the value of a key of a Secret, and whether it exists
+func (s podEnvSources) secretValue(name string, key string) (string, bool, error) {
+	secret, ok := s.secrets[name]
+	if !ok {
+		return "", false, fmt.Errorf("secret %q not found", name)
+	}
+	if value, ok := secret.Data[key]; ok {
+		return string(value), true, nil
+	}
+	if value, ok := secret.StringData[key]; ok {
+		return value, true, nil
+	}
+	return "", false, nil
+}
+
+// envList is the environment of a container, in the order its variables are defined. A variable defined again keeps
+// its place and takes the new value.
+type envList struct {
+	names  []string
+	values map[string]string
+}
+
+func (l *envList) set(name string, value string) {
+	if l.values == nil {
+		l.values = map[string]string{}
+	}
+	if _, ok := l.values[name]; !ok {
+		l.names = append(l.names, name)
+	}
+	l.values[name] = value
+}
+
+func (l *envList) list() []string {
+	env := make([]string, 0, len(l.names))
+	for _, name := range l.names {
+		env = append(env, name+"="+l.values[name])
+	}
+	return env
+}
+
+// containerEnv resolves the environment of a container of a pod like the kubelet does: the variables of envFrom first,
+// then the ones of env, whose values come from ConfigMaps, Secrets, fields of the pod or resources of its containers,
+// or are expanded from the variables defined before them. A missing ConfigMap, Secret or key is an error, unless it is
+// optional.
+func containerEnv(pod *v1.Pod, sources podEnvSources, container v1.Container) ([]string, error) {
+	var env envList
+
+	for _, envFrom := range container.EnvFrom {
+		var data map[string]string
+		switch {
+		case envFrom.ConfigMapRef != nil:
+			configMap, ok := sources.configMaps[envFrom.ConfigMapRef.Name]
+			if !ok {
+				if envFrom.ConfigMapRef.Optional != nil && *envFrom.ConfigMapRef.Optional {
+					continue
+				}
+				return nil, fmt.Errorf("configmap %q not found", envFrom.ConfigMapRef.Name)
+			}
+			data = map[string]string{}
+			for key, value := range configMap.BinaryData {
+				data[key] = string(value)
+			}
+			for key, value := range configMap.Data {
+				data[key] = value
+			}
+		case envFrom.SecretRef != nil:
+			secret, ok := sources.secrets[envFrom.SecretRef.Name]
+			if !ok {
+				if envFrom.SecretRef.Optional != nil && *envFrom.SecretRef.Optional {
+					continue
+				}
+				return nil, fmt.Errorf("secret %q not found", envFrom.SecretRef.Name)
+			}
+			data = map[string]string{}
+			for key, value := range secret.StringData {
+				data[key] = value
+			}
+			for key, value := range secret.Data {
+				data[key] = string(value)
+			}
+		}
+
+		// the keys are added in a stable order, the ones that cannot be variable names are skipped
+		for _, key := range sortedKeys(data) {
+			if strings.Contains(envFrom.Prefix+key, "=") {
+				continue
+			}
+			env.set(envFrom.Prefix+key, data[key])
+		}
+	}
+
+	for _, envVar := range container.Env {
+		if envVar.ValueFrom == nil {
+			// a value may refer to the variables defined before it
+			env.set(envVar.Name, expandVariables(envVar.Value, env.values))
+			continue
+		}
+
+		value, ok, err := envVarSourceValue(pod, sources, container, envVar.ValueFrom)
+		if err != nil {
+			return nil, fmt.Errorf("environment variable %s: %w", envVar.Name, err)
+		} else if ok {
+			env.set(envVar.Name, value)
+		}
+	}
+
+	return env.list(), nil
+}
+
+// expandVariables expands the $(VAR) references of input to the values of variables like Kubernetes does, without any
+// shell: $$ is an escaped $, and references to unknown variables, as well as a $ not followed by ( or $, are left as
+// they are
+func expandVariables(input string, variables map[string]string) string {
+	var expanded strings.Builder
+	for i := 0; i < len(input); i++ {
+		if input[i] != '$' || i+1 == len(input) {
+			expanded.WriteByte(input[i])
+			continue
+		}
+
+		switch input[i+1] {
+		case '$':
+			expanded.WriteByte('$')
+			i++
+		case '(':
+			end := strings.IndexByte(input[i+2:], ')')
+			if end < 0 {
+				expanded.WriteString("$(")
+				i++
+				continue
+			}
+			name := input[i+2 : i+2+end]
+			if value, ok := variables[name]; ok {
+				expanded.WriteString(value)
+			} else {
+				expanded.WriteString("$(" + name + ")")
+			}
+			i += 2 + end
+		default:
+			expanded.WriteByte('$')
+		}
+	}
+	return expanded.String()
+}
+
+// expandCommand returns the command and the args of a container expanded with its environment, as KEY=value pairs.
+// Like in Kubernetes, the command replaces the entrypoint of the image and the args its cmd: both are nil when unset, so
+// that the defaults of the image apply, but the cmd of the image is ignored when only the command is set.
+func expandCommand(container v1.Container, env []string) ([]string, []string) {
+	variables := map[string]string{}
+	for _, variable := range env {
+		name, value, _ := strings.Cut(variable, "=")
+		variables[name] = value
+	}
+
+	expand := func(words []string) []string {
+		if len(words) == 0 {
+			return nil
+		}
+		expanded := make([]string, len(words))
+		for i, word := range words {
+			expanded[i] = expandVariables(word, variables)
+		}
+		return expanded
+	}
+	return expand(container.Command), expand(container.Args)
+}
+
+// resolveEnv resolves again the environment of the containers of a pod, e.g. once its address is known, along with the
+// references to it in their command and args
+func resolveEnv(podData commonIL.RetrievedPodData, runSpecs []DockerRunSpec) error {
+	sources := newPodEnvSources(podData)
+	for i := range runSpecs {
+		container, ok := podContainer(&podData.Pod, runSpecs[i].ContainerName)
+		if !ok {
+			continue
+		}
+		env, err := containerEnv(&podData.Pod, sources, container)
+		if err != nil {
+			return fmt.Errorf("environment of container %s: %w", container.Name, err)
+		}
+		runSpecs[i].Env = env
+		runSpecs[i].Entrypoint, runSpecs[i].Args = expandCommand(container, env)
+	}
+	return nil
+}
+
+// envVarSourceValue returns the value of an environment variable taken from a source, or false if it comes from an
+// optional ConfigMap, Secret or key that does not exist
+func envVarSourceValue(pod *v1.Pod, sources podEnvSources, container v1.Container, source *v1.EnvVarSource) (string, bool, error) {
+	switch {
+	case source.ConfigMapKeyRef != nil:
+		ref := source.ConfigMapKeyRef
+		optional := ref.Optional != nil && *ref.Optional
+		value, ok, err := sources.configMapValue(ref.Name, ref.Key)
+		if optional && (err != nil || !ok) {
+			return "", false, nil
+		} else if err != nil {
+			return "", false, err
+		} else if !ok {
+			return "", false, fmt.Errorf("couldn't find key %s in ConfigMap %s/%s", ref.Key, pod.Namespace, ref.Name)
+		}
+		return value, true, nil
+
+	case source.SecretKeyRef != nil:
+		ref := source.SecretKeyRef
+		optional := ref.Optional != nil && *ref.Optional
+		value, ok, err := sources.secretValue(ref.Name, ref.Key)
+		if optional && (err != nil || !ok) {
+			return "", false, nil
+		} else if err != nil {
+			return "", false, err
+		} else if !ok {
+			return "", false, fmt.Errorf("couldn't find key %s in Secret %s/%s", ref.Key, pod.Namespace, ref.Name)
+		}
+		return value, true, nil
+
+	case source.FieldRef != nil:
+		value, err := podFieldValue(pod, source.FieldRef.FieldPath)
+		return value, err == nil, err
+
+	case source.ResourceFieldRef != nil:
+		value, err := containerResourceValue(pod, container, source.ResourceFieldRef)
+		return value, err == nil, err
+	}
+
+	return "", false, fmt.Errorf("no value source")
+}
+
+// podFieldValue returns the value of a field of a pod selected by a fieldRef
+func podFieldValue(pod *v1.Pod, fieldPath string) (string, error) {
+	if path, subscript, ok := strings.Cut(fieldPath, "["); ok && strings.HasSuffix(subscript, "]") {
+		key := strings.Trim(strings.TrimSuffix(subscript, "]"), `'"`)
+		switch path {
+		case "metadata.labels":
+			return pod.Labels[key], nil
+		case "metadata.annotations":
+			return pod.Annotations[key], nil
+		}
+		return "", fmt.Errorf("unsupported fieldRef %s", fieldPath)
+	}
+
+	switch fieldPath {
+	case "metadata.name":
+		return pod.Name, nil
+	case "metadata.namespace":
+		return pod.Namespace, nil
+	case "metadata.uid":
+		return string(pod.UID), nil
+	case "metadata.labels":
+		return formatMap(pod.Labels), nil
+	case "metadata.annotations":
+		return formatMap(pod.Annotations), nil
+	case "spec.nodeName":
+		return pod.Spec.NodeName, nil
+	case "spec.serviceAccountName":
+		return pod.Spec.ServiceAccountName, nil
+	case "status.hostIP":
+		return pod.Status.HostIP, nil
+	case "status.podIP":
+		return pod.Status.PodIP, nil
+	case "status.podIPs":
+		var ips []string
+		for _, ip := range pod.Status.PodIPs {
+			ips = append(ips, ip.IP)
+		}
+		if len(ips) == 0 && pod.Status.PodIP != "" {
+			ips = append(ips, pod.Status.PodIP)
+		}
+		return strings.Join(ips, ","), nil
+	}
+	return "", fmt.Errorf("unsupported fieldRef %s", fieldPath)
+}
+
+// formatMap renders labels or annotations like the downward API does, one key="value" per line
+func formatMap(values map[string]string) string {
+	var lines []string
+	for _, key := range sortedKeys(values) {
+		lines = append(lines, key+"="+strconv.Quote(values[key]))
+	}
+	return strings.Join(lines, "\n")
+}
+
+// containerResourceValue returns a resource of a container selected by a resourceFieldRef, divided by its divisor and
+// rounded up. Like in the kubelet, a limit that is not set is the capacity of the host.
+func containerResourceValue(pod *v1.Pod, container v1.Container, ref *v1.ResourceFieldSelector) (string, error) {
+	if ref.ContainerName != "" {
+		var ok bool
+		container, ok = podContainer(pod, ref.ContainerName)
+		if !ok {
+			return "", fmt.Errorf("container %s not found", ref.ContainerName)
+		}
+	}
+
+	kind, name, _ := strings.Cut(ref.Resource, ".")
+	var resources v1.ResourceList
+	switch kind {
+	case "limits":
+		resources = container.Resources.Limits
+	case "requests":
+		resources = container.Resources.Requests
+	default:
+		return "", fmt.Errorf("unsupported resourceFieldRef %s", ref.Resource)
+	}
+
+	quantity, ok := resources[v1.ResourceName(name)]
+	if !ok && kind == "limits" {
+		var err error
+		quantity, err = hostCapacity(v1.ResourceName(name))
+		if err != nil {
+			return "", err
+		}
+	}
+
+	divisor := ref.Divisor
+	if divisor.IsZero() {
+		divisor = resource.MustParse("1")
+	}
+	if name == string(v1.ResourceCPU) {
+		return strconv.FormatInt(int64(math.Ceil(float64(quantity.MilliValue())/float64(divisor.MilliValue()))), 10), nil
+	}
+	return strconv.FormatInt(int64(math.Ceil(float64(quantity.Value())/float64(divisor.Value()))), 10), nil
+}
+
+// hostCapacity returns the CPUs or the memory of the host
+func hostCapacity(name v1.ResourceName) (resource.Quantity, error) {
+	switch name {
+	case v1.ResourceCPU:
+		return *resource.NewQuantity(int64(goruntime.NumCPU()), resource.DecimalSI), nil
+
+	case v1.ResourceMemory:
+		file, err := os.Open("/proc/meminfo")
+		if err != nil {
+			return resource.Quantity{}, fmt.Errorf("unable to read the memory of the host: %w", err)
+		}
+		defer file.Close()
+		scanner := bufio.NewScanner(file)
+		for scanner.Scan() {
+			fields := strings.Fields(scanner.Text())
+			if len(fields) >= 2 && fields[0] == "MemTotal:" {
+				kilobytes, err := strconv.ParseInt(fields[1], 10, 64)
+				if err != nil {
+					return resource.Quantity{}, fmt.Errorf("unable to read the memory of the host: %w", err)
+				}
+				return *resource.NewQuantity(kilobytes*1024, resource.BinarySI), nil
+			}
+		}
+		return resource.Quantity{}, fmt.Errorf("unable to read the memory of the host")
+	}
+	return resource.Quantity{}, fmt.Errorf("the limit of %s is not set", name)
+}
+
+func sortedKeys(values map[string]string) []string {
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
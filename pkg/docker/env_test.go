@@ -0,0 +1,90 @@
+package docker
+
+import (
+	"slices"
+	"strings"
+	"testing"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	commonIL "github.com/intertwin-eu/interlink-docker-plugin/pkg/common"
+)
+
+func TestContainerEnv(t *testing.T) {
+	optional := true
+	sources := podEnvSources{
+		configMaps: map[string]v1.ConfigMap{"settings": {ObjectMeta: metav1.ObjectMeta{Name: "settings"}, Data: map[string]string{"mode": "fast"}}},
+		secrets:    map[string]v1.Secret{},
+	}
+	keyRef := func(name string, key string, optional *bool) *v1.EnvVarSource {
+		return &v1.EnvVarSource{ConfigMapKeyRef: &v1.ConfigMapKeySelector{LocalObjectReference: v1.LocalObjectReference{Name: name}, Key: key, Optional: optional}}
+	}
+
+	for _, test := range []struct {
+		name  string
+		env   []v1.EnvVar
+		err   string
+		value string
+	}{
+		{name: "missing key", env: []v1.EnvVar{{Name: "MODE", ValueFrom: keyRef("settings", "missing", nil)}}, err: "couldn't find key missing in ConfigMap default/settings"},
+		{name: "missing configmap", env: []v1.EnvVar{{Name: "MODE", ValueFrom: keyRef("other", "mode", nil)}}, err: `configmap "other" not found`},
+		{name: "missing secret", env: []v1.EnvVar{{Name: "PASSWORD", ValueFrom: &v1.EnvVarSource{SecretKeyRef: &v1.SecretKeySelector{LocalObjectReference: v1.LocalObjectReference{Name: "credentials"}, Key: "password"}}}}, err: `secret "credentials" not found`},
+		{name: "optional key", env: []v1.EnvVar{{Name: "MODE", ValueFrom: keyRef("settings", "missing", &optional)}}},
+		{name: "optional configmap", env: []v1.EnvVar{{Name: "MODE", ValueFrom: keyRef("other", "mode", &optional)}}},
+		{name: "override", env: []v1.EnvVar{{Name: "MODE", Value: "slow"}, {Name: "MODE", ValueFrom: keyRef("settings", "mode", nil)}}, value: "MODE=fast"},
+		{name: "unsupported fieldRef", env: []v1.EnvVar{{Name: "PHASE", ValueFrom: &v1.EnvVarSource{FieldRef: &v1.ObjectFieldSelector{FieldPath: "status.phase"}}}}, err: "unsupported fieldRef status.phase"},
+	} {
+		pod := testPod("1", "main")
+		env, err := containerEnv(pod, sources, v1.Container{Name: "main", Env: test.env})
+		if test.err != "" {
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("%s: expected error %q, got %v", test.name, test.err, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error %v", test.name, err)
+		} else if test.value == "" && len(env) != 0 {
+			t.Errorf("%s: expected no variable, got %v", test.name, env)
+		} else if test.value != "" && !slices.Equal(env, []string{test.value}) {
+			t.Errorf("%s: expected %s, got %v", test.name, test.value, env)
+		}
+	}
+}
+
+func TestResolveEnvPodIP(t *testing.T) {
+	pod := testPod("1", "main")
+	pod.Spec.Containers[0].Env = []v1.EnvVar{{Name: "POD_IP", ValueFrom: &v1.EnvVarSource{FieldRef: &v1.ObjectFieldSelector{FieldPath: "status.podIP"}}}}
+	pod.Status.PodIP = "10.0.0.2"
+	runSpecs := []DockerRunSpec{{Name: "default-uid-1-main", ContainerName: "main"}}
+
+	if err := resolveEnv(commonIL.RetrievedPodData{Pod: *pod}, runSpecs); err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(runSpecs[0].Env, []string{"POD_IP=10.0.0.2"}) {
+		t.Errorf("expected the address of the pod, got %v", runSpecs[0].Env)
+	}
+}
+
+func TestExpandVariables(t *testing.T) {
+	variables := map[string]string{"NAME": "world", "EMPTY": ""}
+	for input, expected := range map[string]string{
+		"hello $(NAME)":        "hello world",
+		"$(NAME)$(NAME)":       "worldworld",
+		"$$(NAME)":             "$(NAME)",
+		"$$$(NAME)":            "$world",
+		"[$(EMPTY)]":           "[]",
+		"$(MISSING)":           "$(MISSING)",
+		"$(NAME":               "$(NAME",
+		"$NAME and ${NAME}":    "$NAME and ${NAME}",
+		"cost: 5$":             "cost: 5$",
+		"$(echo $(NAME))":      "$(echo $(NAME))",
+		"`date` $(date +%s)":   "`date` $(date +%s)",
+		"no references at all": "no references at all",
+	} {
+		if expanded := expandVariables(input, variables); expanded != expected {
+			t.Errorf("%q: expected %q, got %q", input, expected, expanded)
+		}
+	}
+}
@@ -0,0 +1,1028 @@
+package docker
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+
+	commonIL "github.com/intertwin-eu/interlink-docker-plugin/pkg/common"
+	"github.com/intertwin-eu/interlink-docker-plugin/pkg/docker/dindmanager"
+	"github.com/intertwin-eu/interlink-docker-plugin/pkg/docker/gpustrategies"
+	"github.com/intertwin-eu/interlink-docker-plugin/pkg/docker/runtime"
+	"github.com/intertwin-eu/interlink-docker-plugin/pkg/docker/statestore"
+)
+
+type fakeGPUManager struct {
+	released []string
+	assigned []string
+}
+
+func (g *fakeGPUManager) Init() error     { return nil }
+func (g *fakeGPUManager) Shutdown() error { return nil }
+func (g *fakeGPUManager) GetGPUSpecsList() []gpustrategies.GPUSpecs {
+	return []gpustrategies.GPUSpecs{{UUID: "GPU-0", Index: 0, Available: true}, {UUID: "GPU-1", Index: 1, Available: true}}
+}
+func (g *fakeGPUManager) Dump() error     { return nil }
+func (g *fakeGPUManager) Discover() error { return nil }
+func (g *fakeGPUManager) Check() error    { return nil }
+func (g *fakeGPUManager) GetAvailableGPUs(numGPUs int) ([]gpustrategies.GPUSpecs, error) {
+	return nil, nil
+}
+func (g *fakeGPUManager) Assign(UUID string, containerID string) error {
+	g.assigned = append(g.assigned, UUID+"="+containerID)
+	return nil
+}
+func (g *fakeGPUManager) Release(containerID string) error {
+	g.released = append(g.released, containerID)
+	return nil
+}
+func (g *fakeGPUManager) GetAndAssignAvailableGPUs(numGPUs int, containerID string) ([]gpustrategies.GPUSpecs, error) {
+	var gpuSpecs []gpustrategies.GPUSpecs
+	for i := 0; i < numGPUs; i++ {
+		gpuSpecs = append(gpuSpecs, gpustrategies.GPUSpecs{UUID: "GPU-" + strconv.Itoa(i), Index: i, ContainerID: containerID})
+	}
+	return gpuSpecs, nil
+}
+
+// newTestHandler returns a SidecarHandler backed by a FakeRuntime, whose data root is a temporary directory, given
+// relative to the working directory as in production. The background work of the handler is stopped at the end of the
+// test, before the directory is removed.
+func newTestHandler(t *testing.T) (*SidecarHandler, *runtime.FakeRuntime) {
+	t.Helper()
+
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dataRoot, err := filepath.Rel(wd, filepath.Join(t.TempDir(), "jobs"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fakeRuntime := runtime.NewFakeRuntime()
+	stateStore, err := statestore.Open(filepath.Join(dataRoot, "state.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	h := &SidecarHandler{
+		Config:     commonIL.InterLinkConfig{DataRootFolder: dataRoot, InstanceID: "test", InfraImage: commonIL.DefaultInfraImage},
+		Ctx:        ctx,
+		GpuManager: &fakeGPUManager{},
+		DindManager: &dindmanager.DindManager{
+			Ctx:           context.Background(),
+			Runtime:       fakeRuntime,
+			SocketsFolder: filepath.Join(dataRoot, "dinds"),
+			InstanceID:    "test",
+		},
+		Runtime:    fakeRuntime,
+		StateStore: stateStore,
+	}
+	t.Cleanup(func() {
+		cancel()
+		h.workers.wait()
+	})
+	return h, fakeRuntime
+}
+
+// startTestDind creates the running DIND container of a pod and returns the fake runtime of its inner daemon
+func startTestDind(t *testing.T, fakeRuntime *runtime.FakeRuntime, podUID string) *runtime.FakeRuntime {
+	t.Helper()
+
+	socketDir := filepath.Join(t.TempDir(), podUID)
+	id, err := fakeRuntime.CreateContainer(context.Background(), runtime.ContainerSpec{
+		Name:   podUID + "_dind",
+		Image:  "docker:dind",
+		Mounts: []runtime.Mount{{Source: socketDir, Target: dindmanager.DindSocketDir}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := fakeRuntime.StartContainer(context.Background(), id); err != nil {
+		t.Fatal(err)
+	}
+	return fakeRuntime.InnerFake("unix://" + filepath.Join(socketDir, "docker.sock"))
+}
+
+func startTestContainer(t *testing.T, fakeRuntime *runtime.FakeRuntime, name string) {
+	t.Helper()
+
+	id, err := fakeRuntime.CreateContainer(context.Background(), runtime.ContainerSpec{Name: name, Image: "busybox"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := fakeRuntime.StartContainer(context.Background(), id); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func testPod(uid string, containers ...string) *v1.Pod {
+	pod := &v1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "test-pod", Namespace: "default", UID: types.UID("uid-" + uid)}}
+	for _, name := range containers {
+		pod.Spec.Containers = append(pod.Spec.Containers, v1.Container{Name: name, Image: "busybox"})
+	}
+	return pod
+}
+
+// waitForWorker waits for the worker of a pod to be done with the creation of its containers
+func waitForWorker(t *testing.T, h *SidecarHandler, podUID string) {
+	t.Helper()
+	waitFor(t, "the creation of the containers of pod "+podUID, func() bool {
+		return !h.workers.running(podUID)
+	})
+}
+
+func doRequest(t *testing.T, handler http.HandlerFunc, body interface{}) *httptest.ResponseRecorder {
+	t.Helper()
+
+	bodyBytes, err := json.Marshal(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	recorder := httptest.NewRecorder()
+	handler(recorder, httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(bodyBytes)))
+	return recorder
+}
+
+func TestStatusHandler(t *testing.T) {
+	h, fakeRuntime := newTestHandler(t)
+	pod := testPod("1", "running", "exited", "missing", "oom")
+	pod.Spec.RestartPolicy = v1.RestartPolicyNever
+	innerRuntime := startTestDind(t, fakeRuntime, string(pod.UID))
+
+	startTestContainer(t, innerRuntime, "default-uid-1-running")
+	startTestContainer(t, innerRuntime, "default-uid-1-exited")
+	startTestContainer(t, innerRuntime, "default-uid-1-oom")
+	finishedAt := time.Now().Truncate(time.Second)
+	innerRuntime.SetState("default-uid-1-exited", runtime.ContainerState{Status: "exited", ExitCode: 3, StartedAt: finishedAt.Add(-time.Minute), FinishedAt: finishedAt, Error: "failed"})
+	innerRuntime.SetState("default-uid-1-oom", runtime.ContainerState{Status: "exited", ExitCode: 137, OOMKilled: true})
+
+	recorder := doRequest(t, h.StatusHandler, []*v1.Pod{pod})
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("unexpected status code %d: %s", recorder.Code, recorder.Body.String())
+	}
+
+	var resp []commonIL.PodStatus
+	if err := json.Unmarshal(recorder.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	if len(resp) != 1 || len(resp[0].Containers) != 4 {
+		t.Fatalf("unexpected response %+v", resp)
+	}
+
+	dind, _ := fakeRuntime.InspectContainer(context.Background(), "uid-1_dind")
+	if resp[0].JobID != dind.ID {
+		t.Errorf("expected JID %s, got %s", dind.ID, resp[0].JobID)
+	}
+
+	containers := resp[0].Containers
+	running, _ := innerRuntime.InspectContainer(context.Background(), "default-uid-1-running")
+	if containers[0].State.Running == nil || !containers[0].Ready || containers[0].State.Running.StartedAt.IsZero() {
+		t.Errorf("expected running and ready container, got %+v", containers[0])
+	}
+	if containers[0].ContainerID != "docker://"+running.ID || containers[0].ImageID != running.ImageID || containers[0].Image != "busybox" {
+		t.Errorf("unexpected IDs %s %s", containers[0].ContainerID, containers[0].ImageID)
+	}
+	if terminated := containers[1].State.Terminated; terminated == nil || terminated.ExitCode != 3 || terminated.Reason != "Error" || terminated.Message != "failed" || !terminated.FinishedAt.Time.Equal(finishedAt) {
+		t.Errorf("expected container terminated with exit code 3, got %+v", containers[1].State.Terminated)
+	}
+	if containers[2].State.Waiting == nil || containers[2].State.Waiting.Reason != "ContainerCreating" {
+		t.Errorf("expected waiting container, got %+v", containers[2])
+	}
+	if terminated := containers[3].State.Terminated; terminated == nil || terminated.Reason != "OOMKilled" {
+		t.Errorf("expected container killed by the OOM killer, got %+v", containers[3].State.Terminated)
+	}
+}
+
+func TestStatusHandlerInitContainers(t *testing.T) {
+	h, fakeRuntime := newTestHandler(t)
+	pod := testPod("3", "main")
+	pod.Spec.RestartPolicy = v1.RestartPolicyNever
+	pod.Spec.InitContainers = []v1.Container{{Name: "fetch", Image: "busybox"}, {Name: "unpack", Image: "busybox"}, {Name: "check", Image: "busybox"}}
+	innerRuntime := startTestDind(t, fakeRuntime, string(pod.UID))
+
+	startTestContainer(t, innerRuntime, "default-uid-3-fetch")
+	startTestContainer(t, innerRuntime, "default-uid-3-unpack")
+	innerRuntime.SetState("default-uid-3-fetch", runtime.ContainerState{Status: "exited", ExitCode: 0})
+	innerRuntime.SetState("default-uid-3-unpack", runtime.ContainerState{Status: "exited", ExitCode: 2})
+
+	recorder := doRequest(t, h.StatusHandler, []*v1.Pod{pod})
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("unexpected status code %d: %s", recorder.Code, recorder.Body.String())
+	}
+	var resp []commonIL.PodStatus
+	if err := json.Unmarshal(recorder.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	if len(resp) != 1 || len(resp[0].InitContainers) != 3 || len(resp[0].Containers) != 1 {
+		t.Fatalf("unexpected response %+v", resp)
+	}
+
+	// a failed init container fails the pod, whose containers never start
+	if resp[0].Phase != v1.PodFailed || !strings.Contains(resp[0].Message, "unpack") {
+		t.Errorf("expected the pod to be failed by its init container, got %s %s", resp[0].Phase, resp[0].Message)
+	}
+	initContainers := resp[0].InitContainers
+	if terminated := initContainers[0].State.Terminated; terminated == nil || terminated.Reason != "Completed" || !initContainers[0].Ready {
+		t.Errorf("expected a completed init container, got %+v", initContainers[0])
+	}
+	if terminated := initContainers[1].State.Terminated; terminated == nil || terminated.ExitCode != 2 || terminated.Reason != "Error" || initContainers[1].Ready {
+		t.Errorf("expected a failed init container, got %+v", initContainers[1])
+	}
+	if waiting := initContainers[2].State.Waiting; waiting == nil || waiting.Reason != "PodInitializing" {
+		t.Errorf("expected a waiting init container, got %+v", initContainers[2])
+	}
+	if waiting := resp[0].Containers[0].State.Waiting; waiting == nil || waiting.Reason != "PodInitializing" {
+		t.Errorf("expected the container to wait for the init containers, got %+v", resp[0].Containers[0])
+	}
+}
+
+func TestStatusHandlerMissingDind(t *testing.T) {
+	h, _ := newTestHandler(t)
+
+	recorder := doRequest(t, h.StatusHandler, []*v1.Pod{testPod("2", "main")})
+	if recorder.Code != http.StatusNotFound {
+		t.Fatalf("expected status code %d, got %d", http.StatusNotFound, recorder.Code)
+	}
+}
+
+func TestStatusHandlerFailedDind(t *testing.T) {
+	h, fakeRuntime := newTestHandler(t)
+	dindManager := h.DindManager.(*dindmanager.DindManager)
+
+	// a DIND container marked as failed by the health checks, and a DIND container that exited
+	failedPod := testPod("9", "main")
+	failedPod.Spec.InitContainers = []v1.Container{{Name: "setup", Image: "busybox"}}
+	dindManager.DindList = append(dindManager.DindList, dindmanager.DindSpecs{DindID: "failed", PodUID: string(failedPod.UID), State: dindmanager.DindFailed, Message: "docker daemon is not answering"})
+	exitedPod := testPod("10", "main")
+	startTestDind(t, fakeRuntime, string(exitedPod.UID))
+	fakeRuntime.SetState("uid-10_dind", runtime.ContainerState{Status: "exited", ExitCode: 1})
+
+	recorder := doRequest(t, h.StatusHandler, []*v1.Pod{failedPod, exitedPod})
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("unexpected status code %d: %s", recorder.Code, recorder.Body.String())
+	}
+
+	var resp []commonIL.PodStatus
+	if err := json.Unmarshal(recorder.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	if len(resp) != 2 {
+		t.Fatalf("unexpected response %+v", resp)
+	}
+	for _, podStatus := range resp {
+		if podStatus.Phase != v1.PodFailed || podStatus.Reason != "DindFailed" || podStatus.Message == "" {
+			t.Errorf("expected pod %s to be failed with a message, got %+v", podStatus.PodUID, podStatus)
+		}
+		if terminated := podStatus.Containers[0].State.Terminated; terminated == nil || terminated.Reason != "DindFailed" {
+			t.Errorf("expected the containers of pod %s to be terminated, got %+v", podStatus.PodUID, podStatus.Containers[0])
+		}
+	}
+	if len(resp[0].InitContainers) != 1 || resp[0].InitContainers[0].State.Terminated == nil || resp[0].InitContainers[0].State.Terminated.Reason != "DindFailed" {
+		t.Errorf("expected the init container of pod uid-9 to be terminated, got %+v", resp[0].InitContainers)
+	}
+}
+
+func TestGetLogsHandler(t *testing.T) {
+	h, fakeRuntime := newTestHandler(t)
+	innerRuntime := startTestDind(t, fakeRuntime, "uid-3")
+	startTestContainer(t, innerRuntime, "default-uid-3-main")
+	innerRuntime.SetLogs("default-uid-3-main", []byte("first line\nsecond line\n"))
+
+	recorder := doRequest(t, h.GetLogsHandler, commonIL.LogStruct{Namespace: "default", PodUID: "uid-3", PodName: "test-pod", ContainerName: "main"})
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("unexpected status code %d", recorder.Code)
+	}
+	if recorder.Body.String() != "first line\nsecond line\n" {
+		t.Errorf("unexpected logs %q", recorder.Body.String())
+	}
+
+	recorder = doRequest(t, h.GetLogsHandler, commonIL.LogStruct{Namespace: "default", PodUID: "uid-3", PodName: "test-pod", ContainerName: "other"})
+	if recorder.Code != http.StatusOK || !bytes.Contains(recorder.Body.Bytes(), []byte("Container not found")) {
+		t.Errorf("unexpected answer for a missing container: %d %s", recorder.Code, recorder.Body.String())
+	}
+}
+
+func TestDeleteHandler(t *testing.T) {
+	h, fakeRuntime := newTestHandler(t)
+	pod := testPod("4", "main")
+	pod.Spec.InitContainers = []v1.Container{{Name: "setup", Image: "busybox"}}
+	startTestDind(t, fakeRuntime, string(pod.UID))
+	networkID, err := fakeRuntime.CreateNetwork(context.Background(), "pool_dind_network", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dindManager := h.DindManager.(*dindmanager.DindManager)
+	dind, err := fakeRuntime.InspectContainer(context.Background(), "uid-4_dind")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dindManager.DindList = []dindmanager.DindSpecs{{DindID: dind.ID, PodUID: string(pod.UID), DindNetworkID: networkID, State: dindmanager.DindAssigned}}
+
+	recorder := doRequest(t, h.DeleteHandler, pod)
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("unexpected status code %d: %s", recorder.Code, recorder.Body.String())
+	}
+
+	if _, err := fakeRuntime.InspectContainer(context.Background(), "uid-4_dind"); !runtime.IsNotFound(err) {
+		t.Errorf("expected DIND container to be removed, got %v", err)
+	}
+	if _, err := fakeRuntime.InspectNetwork(context.Background(), networkID); !runtime.IsNotFound(err) {
+		t.Errorf("expected DIND network to be removed, got %v", err)
+	}
+	if len(dindManager.DindList) != 0 {
+		t.Errorf("expected DIND to be removed from the list, got %+v", dindManager.DindList)
+	}
+	if released := h.GpuManager.(*fakeGPUManager).released; !slices.Equal(released, []string{"default-uid-4-setup", "default-uid-4-main"}) {
+		t.Errorf("expected GPUs of the init container and of the container to be released, got %v", released)
+	}
+}
+
+// buildTestDind builds a DIND container through the DindManager and returns it along with the fake runtime of its inner
+// daemon. If podUID is set, the DIND container is renamed as when it is assigned to the pod, otherwise it keeps the name
+// of a pool DIND container.
+func buildTestDind(t *testing.T, h *SidecarHandler, fakeRuntime *runtime.FakeRuntime, podUID string) (runtime.ContainerInfo, *runtime.FakeRuntime) {
+	t.Helper()
+	ctx := context.Background()
+
+	dindManager := h.DindManager.(*dindmanager.DindManager)
+	dindSpec, err := dindManager.AcquireDind("build-"+strconv.Itoa(len(dindManager.DindList)), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dindID := dindSpec.DindID
+	if podUID != "" {
+		if err := fakeRuntime.RenameContainer(ctx, dindID, podUID+"_dind"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	dind, err := fakeRuntime.InspectContainer(ctx, dindID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	endpoint, err := dindmanager.InnerEndpoint(dind)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dind, fakeRuntime.InnerFake(endpoint)
+}
+
+func TestReconcile(t *testing.T) {
+	h, fakeRuntime := newTestHandler(t)
+	ctx := context.Background()
+
+	// a pod running in its DIND container, with a GPU, and whose record was lost
+	podDind, podRuntime := buildTestDind(t, h, fakeRuntime, "uid-5")
+	_, err := podRuntime.CreateContainer(ctx, runtime.ContainerSpec{
+		Name:   "default-uid-5-main",
+		Env:    []string{"NVIDIA_VISIBLE_DEVICES=1"},
+		Labels: map[string]string{dindmanager.LabelInstance: "test", dindmanager.LabelRole: dindmanager.RolePod, LabelPodUID: "uid-5", LabelPodNamespace: "default", LabelPodName: "pod-5"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// an idle pool DIND container
+	idleDind, _ := buildTestDind(t, h, fakeRuntime, "")
+	// a DIND container running a container the plugin does not know
+	unknownDind, unknownRuntime := buildTestDind(t, h, fakeRuntime, "")
+	startTestContainer(t, unknownRuntime, "unknown")
+	// a DIND container assigned to a pod whose creation failed
+	failedDind, _ := buildTestDind(t, h, fakeRuntime, "uid-8")
+	// a container not created by the plugin, and a DIND container of another plugin instance
+	startTestContainer(t, fakeRuntime, "unrelated_dind")
+	otherID, _ := fakeRuntime.CreateContainer(ctx, runtime.ContainerSpec{Name: "other_dind", Labels: map[string]string{dindmanager.LabelInstance: "other", dindmanager.LabelRole: dindmanager.RolePool}})
+
+	if err := h.StateStore.PutPod(statestore.PodRecord{PodUID: "uid-6"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// the sidecar restarts with an empty DIND list
+	dindManager := h.DindManager.(*dindmanager.DindManager)
+	dindManager.DindList = nil
+
+	adopted, err := h.Reconcile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if adopted != 1 {
+		t.Errorf("expected 1 idle DIND container re-adopted, got %d", adopted)
+	}
+
+	if dindSpec, err := dindManager.GetDindFromPodUID("uid-5"); err != nil || dindSpec.DindID != podDind.ID || dindSpec.State != dindmanager.DindAssigned {
+		t.Errorf("expected the DIND container of uid-5 to be re-adopted, got %+v %v", dindSpec, err)
+	}
+	idleFound := false
+	for _, dindSpec := range dindManager.DindList {
+		idleFound = idleFound || (dindSpec.DindID == idleDind.ID && dindSpec.State == dindmanager.DindReady)
+	}
+	if !idleFound {
+		t.Errorf("expected %s to be ready, got %+v", idleDind.ID, dindManager.DindList)
+	}
+	if assigned := h.GpuManager.(*fakeGPUManager).assigned; len(assigned) != 1 || assigned[0] != "GPU-1=default-uid-5-main" {
+		t.Errorf("expected GPU 1 to be assigned again, got %v", assigned)
+	}
+
+	if pod, ok := h.StateStore.GetPod("uid-5"); !ok || pod.PodName != "pod-5" || pod.GPUs["default-uid-5-main"][0] != "1" {
+		t.Errorf("expected uid-5 to be recorded again from the labels, got %+v", pod)
+	}
+
+	// a pod whose DIND container did not survive the restart is reported as failed until it is deleted
+	recorder := doRequest(t, h.StatusHandler, []*v1.Pod{testPod("6", "main")})
+	var resp []commonIL.PodStatus
+	if err := json.Unmarshal(recorder.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("unexpected status %d: %s", recorder.Code, recorder.Body.String())
+	}
+	if len(resp) != 1 || resp[0].Phase != v1.PodFailed || resp[0].Reason != "DindFailed" {
+		t.Errorf("expected uid-6 to be failed, got %+v", resp)
+	}
+	if recorder := doRequest(t, h.DeleteHandler, testPod("6", "main")); recorder.Code != http.StatusOK {
+		t.Errorf("unexpected status code %d deleting uid-6: %s", recorder.Code, recorder.Body.String())
+	}
+	if _, ok := h.StateStore.GetPod("uid-6"); ok {
+		t.Error("expected uid-6 to be removed from the state store once deleted")
+	}
+	if _, err := dindManager.GetDindFromPodUID("uid-6"); err == nil {
+		t.Error("expected the failed DIND container of uid-6 to be forgotten once deleted")
+	}
+
+	for _, removed := range []runtime.ContainerInfo{unknownDind, failedDind} {
+		if _, err := fakeRuntime.InspectContainer(ctx, removed.ID); !runtime.IsNotFound(err) {
+			t.Errorf("expected %s to be removed, got %v", removed.Name, err)
+		}
+		for network := range removed.Networks {
+			if _, err := fakeRuntime.InspectNetwork(ctx, network); !runtime.IsNotFound(err) {
+				t.Errorf("expected network %s to be removed, got %v", network, err)
+			}
+		}
+	}
+	for _, kept := range []string{podDind.ID, idleDind.ID, "unrelated_dind", otherID} {
+		if _, err := fakeRuntime.InspectContainer(ctx, kept); err != nil {
+			t.Errorf("expected %s to be kept, got %v", kept, err)
+		}
+	}
+}
+
+func TestHostMode(t *testing.T) {
+	h, fakeRuntime := newTestHandler(t)
+	h.Config.ExecutionMode = commonIL.ExecutionModeHost
+	ctx := context.Background()
+	pod := testPod("11", "main", "sidecar")
+	h.Config.PodIP = "10.0.0.1"
+	pod.Spec.Containers[0].Ports = []v1.ContainerPort{{HostPort: 8080, ContainerPort: 80}}
+	pod.Spec.Containers[1].Ports = []v1.ContainerPort{{ContainerPort: 9090}}
+	shareProcessNamespace := true
+	pod.Spec.ShareProcessNamespace = &shareProcessNamespace
+
+	recorder := doRequest(t, h.CreateHandler, []commonIL.RetrievedPodData{{Pod: *pod}})
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("unexpected status code %d: %s", recorder.Code, recorder.Body.String())
+	}
+	waitForWorker(t, h, string(pod.UID))
+	var createResponse CreateStruct
+	if err := json.Unmarshal(recorder.Body.Bytes(), &createResponse); err != nil {
+		t.Fatal(err)
+	}
+
+	// the containers run on the host daemon, in the network of the pod
+	network, err := fakeRuntime.InspectNetwork(ctx, "uid-11_network")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if createResponse.PodJID != network.ID || network.Labels[LabelPodUID] != "uid-11" {
+		t.Errorf("unexpected network %+v for JID %s", network, createResponse.PodJID)
+	}
+	// the infra container holds the namespaces of the pod and publishes its ports
+	infra, ok := fakeRuntime.Spec("uid-11_infra")
+	if !ok || infra.Image != commonIL.DefaultInfraImage || infra.NetworkMode != "uid-11_network" || infra.IpcMode != "shareable" || len(infra.Ports) != 2 || infra.Ports[0].HostPort != 8080 {
+		t.Errorf("unexpected infra container %+v", infra)
+	}
+	// a port without host port is published on a free port of the host, returned to interLink
+	if len(createResponse.Ports) != 2 || createResponse.Ports[1].ContainerName != "sidecar" || createResponse.Ports[1].HostPort == 0 || int(createResponse.Ports[1].HostPort) != infra.Ports[1].HostPort {
+		t.Errorf("unexpected port mapping %+v", createResponse.Ports)
+	}
+	for _, name := range []string{"default-uid-11-main", "default-uid-11-sidecar"} {
+		spec, ok := fakeRuntime.Spec(name)
+		if !ok || spec.NetworkMode != "container:uid-11_infra" || spec.IpcMode != "container:uid-11_infra" || spec.PidMode != "container:uid-11_infra" || len(spec.Ports) != 0 {
+			t.Errorf("expected %s to join the namespaces of the infra container, got %+v", name, spec)
+		}
+	}
+
+	fakeRuntime.SetNetworkAddress("uid-11_infra", "uid-11_network", "172.18.0.2")
+	recorder = doRequest(t, h.StatusHandler, []*v1.Pod{pod})
+	var resp []commonIL.PodStatus
+	if err := json.Unmarshal(recorder.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	if len(resp) != 1 || resp[0].JobID != network.ID || len(resp[0].Containers) != 2 || resp[0].Containers[0].State.Running == nil {
+		t.Fatalf("unexpected response %+v", resp)
+	}
+	if resp[0].PodIP != "172.18.0.2" || resp[0].HostIP != "10.0.0.1" || len(resp[0].Ports) != 2 {
+		t.Errorf("unexpected addresses %s %s and ports %+v", resp[0].PodIP, resp[0].HostIP, resp[0].Ports)
+	}
+
+	fakeRuntime.SetLogs("default-uid-11-main", []byte("hello\n"))
+	recorder = doRequest(t, h.GetLogsHandler, commonIL.LogStruct{Namespace: "default", PodUID: "uid-11", PodName: "test-pod", ContainerName: "main"})
+	if recorder.Code != http.StatusOK || recorder.Body.String() != "hello\n" {
+		t.Errorf("unexpected logs %d %q", recorder.Code, recorder.Body.String())
+	}
+
+	recorder = doRequest(t, h.DeleteHandler, pod)
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("unexpected status code %d: %s", recorder.Code, recorder.Body.String())
+	}
+	if containers, _ := fakeRuntime.ListContainers(ctx, runtime.ListOptions{All: true}); len(containers) != 0 {
+		t.Errorf("expected the containers of the pod to be removed, got %+v", containers)
+	}
+	if _, err := fakeRuntime.InspectNetwork(ctx, "uid-11_network"); !runtime.IsNotFound(err) {
+		t.Errorf("expected the network of the pod to be removed, got %v", err)
+	}
+	if _, ok := h.StateStore.GetPod("uid-11"); ok {
+		t.Error("expected uid-11 to be removed from the state store")
+	}
+
+	recorder = doRequest(t, h.StatusHandler, []*v1.Pod{pod})
+	if recorder.Code != http.StatusNotFound {
+		t.Errorf("expected status code %d for a deleted pod, got %d", http.StatusNotFound, recorder.Code)
+	}
+}
+
+func TestImagePullBackOff(t *testing.T) {
+	defer func(backoff time.Duration) { initialImagePullBackoff = backoff }(initialImagePullBackoff)
+	initialImagePullBackoff = 10 * time.Millisecond
+
+	h, fakeRuntime := newTestHandler(t)
+	h.Config.ExecutionMode = commonIL.ExecutionModeHost
+	pod := testPod("12", "main")
+	pod.Spec.Containers[0].Image = "registry.example.com/missing"
+	fakeRuntime.SetPullError("registry.example.com/missing", errors.New("manifest unknown"))
+
+	// the pod waits for its image instead of failing
+	recorder := doRequest(t, h.CreateHandler, []commonIL.RetrievedPodData{{Pod: *pod}})
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("unexpected status code %d: %s", recorder.Code, recorder.Body.String())
+	}
+	waitFor(t, "the image pull back-off", func() bool {
+		waiting := h.images.status("uid-12", "registry.example.com/missing")
+		return waiting != nil && waiting.Reason == "ImagePullBackOff"
+	})
+
+	recorder = doRequest(t, h.StatusHandler, []*v1.Pod{pod})
+	var resp []commonIL.PodStatus
+	if err := json.Unmarshal(recorder.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	if waiting := resp[0].Containers[0].State.Waiting; waiting == nil || waiting.Reason != "ImagePullBackOff" || !strings.Contains(waiting.Message, "manifest unknown") {
+		t.Errorf("expected the container to wait for its image, got %+v", resp[0].Containers[0].State)
+	}
+
+	// once the image can be pulled, the containers of the pod are created
+	fakeRuntime.SetPullError("registry.example.com/missing", nil)
+	waitFor(t, "the container to be created", func() bool {
+		info, err := fakeRuntime.InspectContainer(context.Background(), "default-uid-12-main")
+		return err == nil && info.State.Running
+	})
+	if waiting := h.images.status("uid-12", "registry.example.com/missing"); waiting != nil {
+		t.Errorf("expected the pod not to wait for its images anymore, got %+v", waiting)
+	}
+
+	recorder = doRequest(t, h.DeleteHandler, pod)
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("unexpected status code %d: %s", recorder.Code, recorder.Body.String())
+	}
+}
+
+func TestAsyncCreate(t *testing.T) {
+	defer func(interval time.Duration) { initContainerPollInterval = interval }(initContainerPollInterval)
+	initContainerPollInterval = 10 * time.Millisecond
+
+	h, fakeRuntime := newTestHandler(t)
+	h.Config.ExecutionMode = commonIL.ExecutionModeHost
+	ctx := context.Background()
+	pod := testPod("13", "main")
+	pod.Spec.InitContainers = []v1.Container{{Name: "fetch", Image: "alpine", ImagePullPolicy: v1.PullAlways}}
+	failedPod := testPod("14", "main")
+	failedPod.Spec.RestartPolicy = v1.RestartPolicyNever
+	failedPod.Spec.InitContainers = []v1.Container{{Name: "fetch", Image: "alpine"}}
+
+	// the JID is returned while the init containers still run
+	recorder := doRequest(t, h.CreateHandler, []commonIL.RetrievedPodData{{Pod: *pod}})
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("unexpected status code %d: %s", recorder.Code, recorder.Body.String())
+	}
+	recorder = doRequest(t, h.CreateHandler, []commonIL.RetrievedPodData{{Pod: *failedPod}})
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("unexpected status code %d: %s", recorder.Code, recorder.Body.String())
+	}
+	waitFor(t, "the init containers to run", func() bool {
+		record, _ := h.StateStore.GetPod("uid-13")
+		_, err := fakeRuntime.InspectContainer(ctx, "default-uid-14-fetch")
+		return record.Phase == workerInitializing && err == nil
+	})
+	if !slices.Contains(fakeRuntime.Calls, "pull alpine") || !slices.Contains(fakeRuntime.Calls, "pull busybox") {
+		t.Errorf("expected the images of the pods to be pulled, got %v", fakeRuntime.Calls)
+	}
+
+	recorder = doRequest(t, h.StatusHandler, []*v1.Pod{pod})
+	var resp []commonIL.PodStatus
+	if err := json.Unmarshal(recorder.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp[0].Phase != v1.PodPending || resp[0].InitContainers[0].State.Running == nil || resp[0].Containers[0].State.Waiting == nil || resp[0].Containers[0].State.Waiting.Reason != "PodInitializing" {
+		t.Errorf("expected the pod to be initializing, got %+v", resp[0])
+	}
+
+	// the containers are started once the init containers completed, a failed init container fails the pod
+	fakeRuntime.SetState("default-uid-13-fetch", runtime.ContainerState{Status: "exited", ExitCode: 0})
+	fakeRuntime.SetState("default-uid-14-fetch", runtime.ContainerState{Status: "exited", ExitCode: 1})
+	waitForWorker(t, h, "uid-13")
+	waitForWorker(t, h, "uid-14")
+	if info, err := fakeRuntime.InspectContainer(ctx, "default-uid-13-main"); err != nil || !info.State.Running {
+		t.Errorf("expected the container to run, got %+v %v", info.State, err)
+	}
+	if _, err := fakeRuntime.InspectContainer(ctx, "default-uid-14-main"); !runtime.IsNotFound(err) {
+		t.Errorf("expected the container of the failed pod not to be created, got %v", err)
+	}
+	if record, _ := h.StateStore.GetPod("uid-13"); record.Phase != workerRunning {
+		t.Errorf("expected the pod to be running, got %s", record.Phase)
+	}
+	if record, _ := h.StateStore.GetPod("uid-14"); record.Phase != workerFailed || !strings.Contains(record.Message, "exited with code 1") {
+		t.Errorf("expected the pod to be failed, got %s %s", record.Phase, record.Message)
+	}
+
+	// a pod whose creation was not resumed after a restart is failed
+	record, _ := h.StateStore.GetPod("uid-13")
+	record.Phase = workerPulling
+	h.StateStore.PutPod(record)
+	recorder = doRequest(t, h.StatusHandler, []*v1.Pod{pod})
+	if err := json.Unmarshal(recorder.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp[0].Phase != v1.PodFailed || resp[0].Reason != "CreationInterrupted" {
+		t.Errorf("expected the interrupted pod to be failed, got %s %s", resp[0].Phase, resp[0].Reason)
+	}
+}
+
+func TestInitContainersOrder(t *testing.T) {
+	defer func(interval time.Duration, backoff time.Duration) {
+		initContainerPollInterval, initContainerBackoff = interval, backoff
+	}(initContainerPollInterval, initContainerBackoff)
+	initContainerPollInterval, initContainerBackoff = 10*time.Millisecond, 10*time.Millisecond
+
+	h, fakeRuntime := newTestHandler(t)
+	h.Config.ExecutionMode = commonIL.ExecutionModeHost
+	ctx := context.Background()
+	pod := testPod("15", "main")
+	pod.Spec.RestartPolicy = v1.RestartPolicyOnFailure
+	pod.Spec.InitContainers = []v1.Container{{Name: "fetch", Image: "alpine"}, {Name: "unpack", Image: "alpine"}}
+
+	recorder := doRequest(t, h.CreateHandler, []commonIL.RetrievedPodData{{Pod: *pod}})
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("unexpected status code %d: %s", recorder.Code, recorder.Body.String())
+	}
+
+	// the second init container waits for the first one, which is restarted after a failure
+	waitFor(t, "the first init container to run", func() bool {
+		_, err := fakeRuntime.InspectContainer(ctx, "default-uid-15-fetch")
+		return err == nil
+	})
+	fetch, _ := fakeRuntime.InspectContainer(ctx, "default-uid-15-fetch")
+	fakeRuntime.SetState("default-uid-15-fetch", runtime.ContainerState{Status: "exited", ExitCode: 1, StartedAt: fetch.State.StartedAt, FinishedAt: time.Now()})
+	waitFor(t, "the failed init container to be restarted", func() bool {
+		info, _ := fakeRuntime.InspectContainer(ctx, "default-uid-15-fetch")
+		return info.State.Running && info.State.StartedAt.After(fetch.State.StartedAt)
+	})
+	if _, err := fakeRuntime.InspectContainer(ctx, "default-uid-15-unpack"); !runtime.IsNotFound(err) {
+		t.Errorf("expected the second init container to wait for the first one, got %v", err)
+	}
+
+	fakeRuntime.SetState("default-uid-15-fetch", runtime.ContainerState{Status: "exited", ExitCode: 0})
+	waitFor(t, "the second init container to run", func() bool {
+		_, err := fakeRuntime.InspectContainer(ctx, "default-uid-15-unpack")
+		return err == nil
+	})
+	if _, err := fakeRuntime.InspectContainer(ctx, "default-uid-15-main"); !runtime.IsNotFound(err) {
+		t.Errorf("expected the container to wait for the init containers, got %v", err)
+	}
+
+	fakeRuntime.SetState("default-uid-15-unpack", runtime.ContainerState{Status: "exited", ExitCode: 0})
+	waitForWorker(t, h, "uid-15")
+	if info, err := fakeRuntime.InspectContainer(ctx, "default-uid-15-main"); err != nil || !info.State.Running {
+		t.Errorf("expected the container to run, got %+v %v", info.State, err)
+	}
+
+	recorder = doRequest(t, h.StatusHandler, []*v1.Pod{pod})
+	var resp []commonIL.PodStatus
+	if err := json.Unmarshal(recorder.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp[0].InitContainers[0].RestartCount != 1 || resp[0].InitContainers[0].State.Terminated == nil || resp[0].InitContainers[1].RestartCount != 0 {
+		t.Errorf("expected the restart of the first init container to be reported, got %+v", resp[0].InitContainers)
+	}
+}
+
+func TestSidecars(t *testing.T) {
+	defer func(interval time.Duration, pollInterval time.Duration) {
+		supervisorInterval, initContainerPollInterval = interval, pollInterval
+	}(supervisorInterval, initContainerPollInterval)
+	supervisorInterval, initContainerPollInterval = 10*time.Millisecond, 10*time.Millisecond
+
+	h, fakeRuntime := newTestHandler(t)
+	h.Config.ExecutionMode = commonIL.ExecutionModeHost
+	ctx := context.Background()
+	always := v1.ContainerRestartPolicyAlways
+	pod := testPod("17", "main")
+	pod.Spec.RestartPolicy = v1.RestartPolicyNever
+	pod.Spec.InitContainers = []v1.Container{{Name: "proxy", Image: "envoy", RestartPolicy: &always}, {Name: "fetch", Image: "alpine"}}
+
+	recorder := doRequest(t, h.CreateHandler, []commonIL.RetrievedPodData{{Pod: *pod}})
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("unexpected status code %d: %s", recorder.Code, recorder.Body.String())
+	}
+	defer h.supervisor.stop("uid-17")
+	defer h.probes.stop("uid-17")
+
+	// the sidecar is started before the next init container and keeps running along with the container
+	waitFor(t, "the init container to run", func() bool {
+		_, err := fakeRuntime.InspectContainer(ctx, "default-uid-17-fetch")
+		return err == nil
+	})
+	fakeRuntime.SetState("default-uid-17-fetch", runtime.ContainerState{Status: "exited", ExitCode: 0})
+	waitForWorker(t, h, "uid-17")
+	for _, containerName := range []string{"default-uid-17-proxy", "default-uid-17-main"} {
+		if info, err := fakeRuntime.InspectContainer(ctx, containerName); err != nil || !info.State.Running {
+			t.Errorf("expected %s to run, got %+v %v", containerName, info.State, err)
+		}
+	}
+
+	status := func() commonIL.PodStatus {
+		recorder := doRequest(t, h.StatusHandler, []*v1.Pod{pod})
+		var resp []commonIL.PodStatus
+		if err := json.Unmarshal(recorder.Body.Bytes(), &resp); err != nil {
+			t.Fatal(err)
+		}
+		return resp[0]
+	}
+	if proxy := status().InitContainers[0]; proxy.State.Running == nil || !proxy.Ready {
+		t.Errorf("expected the sidecar to be running and ready, got %+v", proxy)
+	}
+
+	// the sidecar is stopped once the container completed, without failing the pod
+	fakeRuntime.SetState("default-uid-17-main", runtime.ContainerState{Status: "exited", ExitCode: 0, FinishedAt: time.Now()})
+	waitFor(t, "the sidecar to be stopped", func() bool {
+		return h.supervisor.completed("uid-17")
+	})
+	if info, _ := fakeRuntime.InspectContainer(ctx, "default-uid-17-proxy"); info.State.Running {
+		t.Error("expected the sidecar to be stopped")
+	}
+	if podStatus := status(); podStatus.InitContainers[0].State.Terminated == nil || podStatus.Containers[0].State.Terminated == nil {
+		t.Errorf("expected the sidecar and the container to be terminated, got %+v", podStatus)
+	}
+}
+
+func TestReconcileHost(t *testing.T) {
+	h, fakeRuntime := newTestHandler(t)
+	h.Config.ExecutionMode = commonIL.ExecutionModeHost
+	ctx := context.Background()
+
+	podLabels := func(podUID string) map[string]string {
+		return map[string]string{dindmanager.LabelInstance: "test", dindmanager.LabelRole: dindmanager.RolePod, LabelPodUID: podUID, LabelPodNamespace: "default", LabelPodName: "pod"}
+	}
+	// a running pod with a GPU, whose record was lost
+	if _, err := fakeRuntime.CreateNetwork(ctx, "uid-12_network", podLabels("uid-12")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fakeRuntime.CreateContainer(ctx, runtime.ContainerSpec{Name: "default-uid-12-main", Env: []string{"NVIDIA_VISIBLE_DEVICES=0"}, Labels: podLabels("uid-12")}); err != nil {
+		t.Fatal(err)
+	}
+	// a network left by a failed creation, and a container whose network was removed
+	if _, err := fakeRuntime.CreateNetwork(ctx, "uid-13_network", podLabels("uid-13")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fakeRuntime.CreateContainer(ctx, runtime.ContainerSpec{Name: "default-uid-14-main", Labels: podLabels("uid-14")}); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.StateStore.PutPod(statestore.PodRecord{PodUID: "uid-15"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := h.Reconcile(); err != nil {
+		t.Fatal(err)
+	}
+
+	if pod, ok := h.StateStore.GetPod("uid-12"); !ok || pod.GPUs["default-uid-12-main"][0] != "0" {
+		t.Errorf("expected uid-12 to be recorded again, got %+v", pod)
+	}
+	if assigned := h.GpuManager.(*fakeGPUManager).assigned; len(assigned) != 1 || assigned[0] != "GPU-0=default-uid-12-main" {
+		t.Errorf("expected GPU 0 to be assigned again, got %v", assigned)
+	}
+	// a pod whose sandbox did not survive the restart is reported as failed until it is deleted
+	recorder := doRequest(t, h.StatusHandler, []*v1.Pod{testPod("15", "main")})
+	var resp []commonIL.PodStatus
+	if err := json.Unmarshal(recorder.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("unexpected status %d: %s", recorder.Code, recorder.Body.String())
+	}
+	if len(resp) != 1 || resp[0].Phase != v1.PodFailed || resp[0].Reason != "SandboxNotFound" {
+		t.Errorf("expected uid-15 to be failed, got %+v", resp)
+	}
+	if recorder := doRequest(t, h.DeleteHandler, testPod("15", "main")); recorder.Code != http.StatusOK {
+		t.Errorf("unexpected status code %d deleting uid-15: %s", recorder.Code, recorder.Body.String())
+	}
+	if _, ok := h.StateStore.GetPod("uid-15"); ok {
+		t.Error("expected uid-15 to be removed from the state store once deleted")
+	}
+	if _, err := fakeRuntime.InspectNetwork(ctx, "uid-13_network"); !runtime.IsNotFound(err) {
+		t.Errorf("expected the network of uid-13 to be removed, got %v", err)
+	}
+	if _, err := fakeRuntime.InspectContainer(ctx, "default-uid-14-main"); !runtime.IsNotFound(err) {
+		t.Errorf("expected the container of uid-14 to be removed, got %v", err)
+	}
+	if _, err := fakeRuntime.InspectContainer(ctx, "default-uid-12-main"); err != nil {
+		t.Errorf("expected the container of uid-12 to be kept, got %v", err)
+	}
+}
+
+func TestResumeCreation(t *testing.T) {
+	defer func(interval time.Duration, backoff time.Duration) {
+		initContainerPollInterval, initContainerBackoff = interval, backoff
+	}(initContainerPollInterval, initContainerBackoff)
+	initContainerPollInterval, initContainerBackoff = 10*time.Millisecond, 10*time.Millisecond
+
+	h, fakeRuntime := newTestHandler(t)
+	h.Config.ExecutionMode = commonIL.ExecutionModeHost
+	ctx := context.Background()
+
+	pod := testPod("16", "main")
+	pod.Spec.InitContainers = []v1.Container{{Name: "setup", Image: "alpine"}}
+	if recorder := doRequest(t, h.CreateHandler, []commonIL.RetrievedPodData{{Pod: *pod}}); recorder.Code != http.StatusOK {
+		t.Fatalf("unexpected status code %d: %s", recorder.Code, recorder.Body.String())
+	}
+	waitFor(t, "the init container to run", func() bool {
+		record, _ := h.StateStore.GetPod("uid-16")
+		_, err := fakeRuntime.InspectContainer(ctx, "default-uid-16-setup")
+		return record.Phase == workerInitializing && err == nil
+	})
+
+	// the plugin restarts while the init container runs, which completes in the meantime
+	h.workers.stop("uid-16")
+	fakeRuntime.SetState("default-uid-16-setup", runtime.ContainerState{Status: "exited", ExitCode: 0})
+	if _, err := h.Reconcile(); err != nil {
+		t.Fatal(err)
+	}
+	waitForWorker(t, h, "uid-16")
+
+	created := 0
+	for _, call := range fakeRuntime.Calls {
+		if call == "create default-uid-16-setup" {
+			created++
+		}
+	}
+	if created != 1 {
+		t.Errorf("expected the completed init container not to run again, got %v", fakeRuntime.Calls)
+	}
+	if info, err := fakeRuntime.InspectContainer(ctx, "default-uid-16-main"); err != nil || !info.State.Running {
+		t.Errorf("expected the container to run, got %+v %v", info.State, err)
+	}
+	if record, _ := h.StateStore.GetPod("uid-16"); record.Phase != workerRunning {
+		t.Errorf("expected the pod to be running, got %s %s", record.Phase, record.Message)
+	}
+}
+
+// fakePodRuntime is a FakeRuntime with native pods, standing for Podman
+type fakePodRuntime struct {
+	*runtime.FakeRuntime
+	pods map[string]runtime.PodInfo
+}
+
+func (f *fakePodRuntime) CreatePod(ctx context.Context, spec runtime.PodSpec) (string, error) {
+	f.pods[spec.Name] = runtime.PodInfo{ID: "pod-" + spec.Name, Name: spec.Name, Labels: spec.Labels}
+	return "pod-" + spec.Name, nil
+}
+
+func (f *fakePodRuntime) InspectPod(ctx context.Context, id string) (runtime.PodInfo, error) {
+	for _, pod := range f.pods {
+		if pod.ID == id || pod.Name == id {
+			return pod, nil
+		}
+	}
+	return runtime.PodInfo{}, &runtime.Error{Op: "pod inspect", Target: id, Kind: runtime.ErrNotFound, Err: os.ErrNotExist}
+}
+
+func (f *fakePodRuntime) RemovePod(ctx context.Context, id string) error {
+	pod, err := f.InspectPod(ctx, id)
+	delete(f.pods, pod.Name)
+	return err
+}
+
+func (f *fakePodRuntime) ListPods(ctx context.Context, opts runtime.ListOptions) ([]runtime.PodInfo, error) {
+	var pods []runtime.PodInfo
+	for _, pod := range f.pods {
+		pods = append(pods, pod)
+	}
+	return pods, nil
+}
+
+func TestHostModeNativePod(t *testing.T) {
+	h, fakeRuntime := newTestHandler(t)
+	h.Config.ExecutionMode = commonIL.ExecutionModeHost
+	podRuntime := &fakePodRuntime{FakeRuntime: fakeRuntime, pods: map[string]runtime.PodInfo{}}
+	h.Runtime = podRuntime
+	pod := testPod("16", "main")
+	pod.Spec.Containers[0].Ports = []v1.ContainerPort{{HostPort: 8080, ContainerPort: 80}}
+
+	recorder := doRequest(t, h.CreateHandler, []commonIL.RetrievedPodData{{Pod: *pod}})
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("unexpected status code %d: %s", recorder.Code, recorder.Body.String())
+	}
+	waitForWorker(t, h, string(pod.UID))
+	if spec, ok := fakeRuntime.Spec("default-uid-16-main"); !ok || spec.Pod != "uid-16_pod" || spec.NetworkMode != "" || len(spec.Ports) != 0 {
+		t.Errorf("expected the container to join the native pod, got %+v", spec)
+	}
+
+	recorder = doRequest(t, h.StatusHandler, []*v1.Pod{pod})
+	var resp []commonIL.PodStatus
+	if err := json.Unmarshal(recorder.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	if len(resp) != 1 || resp[0].JobID != "pod-uid-16_pod" || resp[0].Containers[0].State.Running == nil {
+		t.Fatalf("unexpected response %+v", resp)
+	}
+
+	recorder = doRequest(t, h.DeleteHandler, pod)
+	if recorder.Code != http.StatusOK || len(podRuntime.pods) != 0 {
+		t.Errorf("expected the native pod to be removed, got %d %+v", recorder.Code, podRuntime.pods)
+	}
+}
+
+func TestTerminationMessage(t *testing.T) {
+	h, fakeRuntime := newTestHandler(t)
+	h.Config.ExecutionMode = commonIL.ExecutionModeHost
+	pod := testPod("18", "writer", "crasher", "silent")
+	pod.Spec.RestartPolicy = v1.RestartPolicyNever
+	for i := range pod.Spec.Containers {
+		pod.Spec.Containers[i].TerminationMessagePath = "/dev/termination-log"
+		pod.Spec.Containers[i].TerminationMessagePolicy = v1.TerminationMessageFallbackToLogsOnError
+	}
+	pod.Spec.Containers[0].WorkingDir = "/work"
+	pod.Spec.Containers[0].Stdin, pod.Spec.Containers[0].TTY = true, true
+
+	recorder := doRequest(t, h.CreateHandler, []commonIL.RetrievedPodData{{Pod: *pod}})
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("unexpected status code %d: %s", recorder.Code, recorder.Body.String())
+	}
+	waitForWorker(t, h, "uid-18")
+
+	spec, ok := fakeRuntime.Spec("default-uid-18-writer")
+	if !ok || spec.WorkingDir != "/work" || !spec.OpenStdin || !spec.Tty {
+		t.Errorf("expected the working directory, stdin and tty of the container, got %+v", spec)
+	}
+	var messagePath string
+	for _, mount := range spec.Mounts {
+		if mount.Target == "/dev/termination-log" {
+			messagePath = mount.Source
+		}
+	}
+	if messagePath == "" {
+		t.Fatalf("expected the termination message file to be mounted, got %+v", spec.Mounts)
+	}
+
+	// the message written by a container is reported, the tail of its logs only if it failed without writing one
+	if err := os.WriteFile(messagePath, []byte("wrote the results"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	fakeRuntime.SetLogs("default-uid-18-crasher", []byte("starting\npanic: boom\n"))
+	fakeRuntime.SetLogs("default-uid-18-silent", []byte("all good\n"))
+	fakeRuntime.SetState("default-uid-18-writer", runtime.ContainerState{Status: "exited", ExitCode: 1})
+	fakeRuntime.SetState("default-uid-18-crasher", runtime.ContainerState{Status: "exited", ExitCode: 2})
+	fakeRuntime.SetState("default-uid-18-silent", runtime.ContainerState{Status: "exited", ExitCode: 0})
+
+	recorder = doRequest(t, h.StatusHandler, []*v1.Pod{pod})
+	var resp []commonIL.PodStatus
+	if err := json.Unmarshal(recorder.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	var messages []string
+	for _, containerStatus := range resp[0].Containers {
+		if containerStatus.State.Terminated == nil {
+			t.Fatalf("expected %s to be terminated, got %+v", containerStatus.Name, containerStatus.State)
+		}
+		messages = append(messages, containerStatus.State.Terminated.Message)
+	}
+	if !slices.Equal(messages, []string{"wrote the results", "starting\npanic: boom\n", ""}) {
+		t.Errorf("unexpected termination messages %q", messages)
+	}
+}
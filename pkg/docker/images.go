@@ -0,0 +1,111 @@
+package docker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/containerd/containerd/log"
+	v1 "k8s.io/api/core/v1"
+
+	"github.com/intertwin-eu/interlink-docker-plugin/pkg/docker/runtime"
+)
+
+// initialImagePullBackoff is the delay before retrying a failed image pull, doubled after each failure up to
+// maxRestartBackoff
+var initialImagePullBackoff = initialRestartBackoff
+
+// podImagePull is the last failed image pull of a pod waiting for its images
+type podImagePull struct {
+	image    string
+	message  string
+	attempts int
+}
+
+// imagePullManager holds the failed image pulls of the pods waiting for their images
+type imagePullManager struct {
+	mutex sync.Mutex
+	pods  map[string]*podImagePull
+}
+
+// stop forgets the failed image pulls of a pod
+func (m *imagePullManager) stop(podUID string) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	delete(m.pods, podUID)
+}
+
+// status returns the waiting state of a container of image whose pod waits for its images, or nil. As in the kubelet,
+// the reason is ErrImagePull after the first failed pull and ImagePullBackOff afterwards.
+func (m *imagePullManager) status(podUID string, image string) *v1.ContainerStateWaiting {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	pull, ok := m.pods[podUID]
+	if !ok || pull.image != image {
+		return nil
+	}
+	if pull.attempts <= 1 {
+		return &v1.ContainerStateWaiting{Reason: "ErrImagePull", Message: pull.message}
+	}
+	return &v1.ContainerStateWaiting{Reason: "ImagePullBackOff", Message: fmt.Sprintf("Back-off pulling image %q: %s", image, pull.message)}
+}
+
+// failed records a failed pull of image for a pod
+func (m *imagePullManager) failed(podUID string, image string, err error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if m.pods == nil {
+		m.pods = map[string]*podImagePull{}
+	}
+	pull, ok := m.pods[podUID]
+	if !ok || pull.image != image {
+		pull = &podImagePull{image: image}
+		m.pods[podUID] = pull
+	}
+	pull.message = err.Error()
+	var runtimeErr *runtime.Error
+	if errors.As(err, &runtimeErr) {
+		pull.message = runtimeErr.Err.Error()
+	}
+	pull.attempts++
+}
+
+// pullImages pulls the images of the containers of a pod according to their pull policy: always with Always, only if
+// they are missing with IfNotPresent, never with Never. Like in the kubelet, a failed pull is retried after a back-off
+// starting at backoff, until ctx is done.
+func (h *SidecarHandler) pullImages(ctx context.Context, pod *v1.Pod, containerRuntime runtime.ContainerRuntime, backoff time.Duration) error {
+	podUID := string(pod.UID)
+	defer h.images.stop(podUID)
+
+	pulled := map[string]bool{}
+	for _, container := range append(append([]v1.Container{}, pod.Spec.InitContainers...), pod.Spec.Containers...) {
+		if container.ImagePullPolicy == v1.PullNever || pulled[container.Image] {
+			continue
+		}
+
+		for {
+			err := containerRuntime.PullImage(ctx, container.Image, container.ImagePullPolicy == v1.PullAlways)
+			if err == nil {
+				break
+			} else if !runtime.IsImagePull(err) {
+				return err
+			}
+
+			h.images.failed(podUID, container.Image, err)
+			log.G(h.Ctx).Warning(fmt.Sprintf("\u26A0 Error pulling image %s of pod %s, back-off %s before retrying: %s", container.Image, podUID, backoff, err.Error()))
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(backoff):
+			}
+			backoff = min(2*backoff, maxRestartBackoff)
+		}
+		pulled[container.Image] = true
+	}
+	return nil
+}
@@ -0,0 +1,150 @@
+package docker
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/containerd/containerd/log"
+	v1 "k8s.io/api/core/v1"
+
+	"github.com/intertwin-eu/interlink-docker-plugin/pkg/docker/runtime"
+)
+
+// minimumGracePeriod is the time a container is given to stop once its preStop hook used up the grace period of its
+// pod, like in the kubelet
+const minimumGracePeriod = 2 * time.Second
+
+// runLifecycleHandler runs a postStart or preStop hook of a container, until it completes or ctx is done
+func (h *SidecarHandler) runLifecycleHandler(ctx context.Context, handler *v1.LifecycleHandler, container v1.Container, containerName string, target probeTarget) error {
+	switch {
+	case handler.Exec != nil:
+		return execAction(ctx, handler.Exec, containerName, target)
+
+	case handler.HTTPGet != nil:
+		return httpGetAction(ctx, handler.HTTPGet, container, target, "kube-lifecycle/1.29")
+
+	case handler.Sleep != nil:
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(time.Duration(handler.Sleep.Seconds) * time.Second):
+		}
+		return nil
+	}
+
+	// like in the kubelet, tcpSocket hooks are not supported
+	return fmt.Errorf("hook has no supported handler")
+}
+
+// postStart runs the postStart hook of a container that just started. Like in the kubelet, a container whose hook failed
+// is killed: it is then restarted according to the restart policy of the pod.
+func (h *SidecarHandler) postStart(ctx context.Context, pod *v1.Pod, container v1.Container, target probeTarget) {
+	if container.Lifecycle == nil || container.Lifecycle.PostStart == nil {
+		return
+	}
+	containerName := pod.Namespace + "-" + string(pod.UID) + "-" + container.Name
+
+	err := h.runLifecycleHandler(ctx, container.Lifecycle.PostStart, container, containerName, target)
+	if err == nil {
+		log.G(h.Ctx).Info("\u2705 PostStart hook of container " + containerName + " completed")
+		return
+	} else if ctx.Err() != nil {
+		return
+	}
+
+	log.G(h.Ctx).Warning("\u26A0 PostStart hook of container " + containerName + " failed, killing it: " + err.Error())
+	err = target.runtime.StopContainer(ctx, containerName, terminationGracePeriod(pod))
+	if err != nil {
+		log.G(h.Ctx).Error("\u274C Error stopping container " + containerName + ": " + err.Error())
+	}
+}
+
+// podContainer returns the container or init container of a pod with the given name
+func podContainer(pod *v1.Pod, name string) (v1.Container, bool) {
+	for _, container := range append(append([]v1.Container{}, pod.Spec.InitContainers...), pod.Spec.Containers...) {
+		if container.Name == name {
+			return container, true
+		}
+	}
+	return v1.Container{}, false
+}
+
+// terminatePod stops the containers of a pod being deleted within its termination grace period, like the kubelet does:
+// the preStop hook of each running container runs, then the container gets its stop signal, SIGTERM unless its image
+// sets a STOPSIGNAL, and is killed if it still runs at the end of the grace period. The containers are stopped all at
+// once, then the sidecars one after the other in the reverse order of their start. The worker, the supervisor and the
+// probes of the pod are stopped first, so that its containers are not restarted anymore.
+func (h *SidecarHandler) terminatePod(pod *v1.Pod) {
+	podUID := string(pod.UID)
+	h.workers.stop(podUID)
+	h.supervisor.stop(podUID)
+	h.probes.stop(podUID)
+
+	sandbox, err := h.getSandbox(podUID)
+	if err != nil {
+		if !runtime.IsNotFound(err) {
+			log.G(h.Ctx).Warning("\u26A0 Unable to stop the containers of pod " + podUID + " gracefully: " + err.Error())
+		}
+		return
+	} else if sandbox.Failure != "" {
+		log.G(h.Ctx).Warning("\u26A0 Unable to stop the containers of pod " + podUID + " gracefully: " + sandbox.Failure)
+		return
+	}
+	target := h.probeTarget(podUID, sandbox)
+	deadline := time.Now().Add(terminationGracePeriod(pod))
+
+	var containers []v1.Container
+	for _, container := range pod.Spec.InitContainers {
+		if !isSidecar(container) {
+			containers = append(containers, container)
+		}
+	}
+	containers = append(containers, pod.Spec.Containers...)
+
+	var wg sync.WaitGroup
+	for _, container := range containers {
+		wg.Add(1)
+		go func(container v1.Container) {
+			defer wg.Done()
+			h.stopContainer(h.Ctx, pod, container, target, deadline)
+		}(container)
+	}
+	wg.Wait()
+
+	podSidecars := sidecars(pod)
+	for i := len(podSidecars) - 1; i >= 0; i-- {
+		h.stopContainer(h.Ctx, pod, podSidecars[i], target, deadline)
+	}
+}
+
+// stopContainer runs the preStop hook of a running container, then stops it: it is killed if it still runs at
+// deadline, or minimumGracePeriod after its preStop hook if later
+func (h *SidecarHandler) stopContainer(ctx context.Context, pod *v1.Pod, container v1.Container, target probeTarget, deadline time.Time) {
+	containerName := pod.Namespace + "-" + string(pod.UID) + "-" + container.Name
+	info, err := target.runtime.InspectContainer(ctx, containerName)
+	if err != nil || !info.State.Running {
+		return
+	}
+
+	if container.Lifecycle != nil && container.Lifecycle.PreStop != nil {
+		hookCtx, cancel := context.WithDeadline(ctx, deadline)
+		err = h.runLifecycleHandler(hookCtx, container.Lifecycle.PreStop, container, containerName, target)
+		cancel()
+		if err != nil {
+			log.G(h.Ctx).Warning("\u26A0 PreStop hook of container " + containerName + " failed: " + err.Error())
+		} else {
+			log.G(h.Ctx).Info("\u2705 PreStop hook of container " + containerName + " completed")
+		}
+	}
+
+	gracePeriod := max(time.Until(deadline), minimumGracePeriod)
+	log.G(h.Ctx).Info(fmt.Sprintf("\u23F3 Stopping container %s, it is killed if it still runs in %s", containerName, gracePeriod.Round(time.Second)))
+	err = target.runtime.StopContainer(ctx, containerName, gracePeriod)
+	if err != nil && !runtime.IsNotFound(err) {
+		log.G(h.Ctx).Error("\u274C Error stopping container " + containerName + ": " + err.Error())
+		return
+	}
+	log.G(h.Ctx).Info("\u2705 Container " + containerName + " stopped")
+}
@@ -0,0 +1,180 @@
+package docker
+
+import (
+	"context"
+	"net/http"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+
+	commonIL "github.com/intertwin-eu/interlink-docker-plugin/pkg/common"
+	"github.com/intertwin-eu/interlink-docker-plugin/pkg/docker/runtime"
+)
+
+func TestLifecycleHooks(t *testing.T) {
+	h, fakeRuntime := newTestHandler(t)
+	h.Config.ExecutionMode = commonIL.ExecutionModeHost
+	ctx := context.Background()
+	pod := testPod("1", "main", "broken")
+	pod.Spec.RestartPolicy = v1.RestartPolicyNever
+	pod.Spec.Containers[0].Lifecycle = &v1.Lifecycle{
+		PostStart: &v1.LifecycleHandler{Exec: &v1.ExecAction{Command: []string{"warm-up"}}},
+		PreStop:   &v1.LifecycleHandler{Exec: &v1.ExecAction{Command: []string{"flush"}}},
+	}
+	pod.Spec.Containers[1].Lifecycle = &v1.Lifecycle{PostStart: &v1.LifecycleHandler{Exec: &v1.ExecAction{Command: []string{"fail"}}}}
+	fakeRuntime.ExecFunc = func(id string, cmd []string) runtime.ExecResult {
+		if cmd[0] == "fail" {
+			return runtime.ExecResult{ExitCode: 1}
+		}
+		return runtime.ExecResult{}
+	}
+
+	recorder := doRequest(t, h.CreateHandler, []commonIL.RetrievedPodData{{Pod: *pod}})
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("unexpected status code %d: %s", recorder.Code, recorder.Body.String())
+	}
+	waitForWorker(t, h, "uid-1")
+
+	// the postStart hook runs once the container started, a container whose hook failed is killed
+	if !slices.Contains(fakeRuntime.Calls, "exec default-uid-1-main warm-up") {
+		t.Errorf("expected the postStart hook to run, got %v", fakeRuntime.Calls)
+	}
+	if info, err := fakeRuntime.InspectContainer(ctx, "default-uid-1-main"); err != nil || !info.State.Running {
+		t.Errorf("expected the container to run, got %+v %v", info.State, err)
+	}
+	if info, err := fakeRuntime.InspectContainer(ctx, "default-uid-1-broken"); err != nil || info.State.Running {
+		t.Errorf("expected the container whose postStart hook failed to be killed, got %+v %v", info.State, err)
+	}
+
+	// the preStop hook runs before the container is removed
+	recorder = doRequest(t, h.DeleteHandler, pod)
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("unexpected status code %d: %s", recorder.Code, recorder.Body.String())
+	}
+	hook := slices.Index(fakeRuntime.Calls, "exec default-uid-1-main flush")
+	remove := slices.IndexFunc(fakeRuntime.Calls, func(call string) bool { return strings.HasPrefix(call, "remove default-uid-1-main") })
+	if hook < 0 || remove < hook {
+		t.Errorf("expected the preStop hook to run before the container is removed, got %v", fakeRuntime.Calls)
+	}
+}
+
+func TestTerminatePod(t *testing.T) {
+	defer func(interval time.Duration) { initContainerPollInterval = interval }(initContainerPollInterval)
+	initContainerPollInterval = 10 * time.Millisecond
+
+	h, fakeRuntime := newTestHandler(t)
+	h.Config.ExecutionMode = commonIL.ExecutionModeHost
+	always := v1.ContainerRestartPolicyAlways
+	pod := testPod("2", "main")
+	pod.Spec.InitContainers = []v1.Container{{Name: "proxy", Image: "envoy", RestartPolicy: &always}}
+	pod.Spec.Containers[0].Lifecycle = &v1.Lifecycle{PreStop: &v1.LifecycleHandler{Exec: &v1.ExecAction{Command: []string{"checkpoint"}}}}
+
+	recorder := doRequest(t, h.CreateHandler, []commonIL.RetrievedPodData{{Pod: *pod}})
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("unexpected status code %d: %s", recorder.Code, recorder.Body.String())
+	}
+	waitForWorker(t, h, "uid-2")
+
+	// the container is stopped after its preStop hook, then the sidecar, and only then are they removed
+	recorder = doRequest(t, h.DeleteHandler, pod)
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("unexpected status code %d: %s", recorder.Code, recorder.Body.String())
+	}
+	var steps []int
+	for _, call := range []string{"exec default-uid-2-main checkpoint", "stop default-uid-2-main", "stop default-uid-2-proxy", "remove default-uid-2-main"} {
+		steps = append(steps, slices.Index(fakeRuntime.Calls, call))
+	}
+	if slices.Contains(steps, -1) || !slices.IsSorted(steps) {
+		t.Errorf("expected the containers to be stopped in order before they are removed, got %v", fakeRuntime.Calls)
+	}
+
+	// the grace period of the deletion overrides the one of the pod
+	gracePeriod, deletionGracePeriod := int64(60), int64(5)
+	pod.Spec.TerminationGracePeriodSeconds = &gracePeriod
+	if period := terminationGracePeriod(pod); period != time.Minute {
+		t.Errorf("expected the grace period of the pod, got %s", period)
+	}
+	pod.DeletionGracePeriodSeconds = &deletionGracePeriod
+	if period := terminationGracePeriod(pod); period != 5*time.Second {
+		t.Errorf("expected the grace period of the deletion, got %s", period)
+	}
+}
+
+func TestHangingPreStopHook(t *testing.T) {
+	h, fakeRuntime := newTestHandler(t)
+	h.Config.ExecutionMode = commonIL.ExecutionModeHost
+	ctx := context.Background()
+	gracePeriod := int64(1)
+	pod := testPod("3", "main")
+	pod.Spec.TerminationGracePeriodSeconds = &gracePeriod
+	pod.Spec.Containers[0].Lifecycle = &v1.Lifecycle{PreStop: &v1.LifecycleHandler{Exec: &v1.ExecAction{Command: []string{"hang"}}}}
+	hang := make(chan struct{})
+	defer close(hang)
+	fakeRuntime.ExecFunc = func(id string, cmd []string) runtime.ExecResult {
+		if cmd[0] == "hang" {
+			<-hang
+		}
+		return runtime.ExecResult{}
+	}
+
+	recorder := doRequest(t, h.CreateHandler, []commonIL.RetrievedPodData{{Pod: *pod}})
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("unexpected status code %d: %s", recorder.Code, recorder.Body.String())
+	}
+	waitForWorker(t, h, "uid-3")
+
+	// a preStop hook that never returns is abandoned at the end of the grace period, and the pod is deleted anyway
+	start := time.Now()
+	recorder = doRequest(t, h.DeleteHandler, pod)
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("unexpected status code %d: %s", recorder.Code, recorder.Body.String())
+	}
+	if elapsed := time.Since(start); elapsed > 3*time.Second {
+		t.Errorf("expected the deletion to end with the grace period of 1s, took %s", elapsed)
+	}
+	if _, err := fakeRuntime.InspectContainer(ctx, "default-uid-3-main"); !runtime.IsNotFound(err) {
+		t.Errorf("expected the container to be removed, got %v", err)
+	}
+}
+
+func TestDeleteDuringCreation(t *testing.T) {
+	h, fakeRuntime := newTestHandler(t)
+	h.Config.ExecutionMode = commonIL.ExecutionModeHost
+	pod := testPod("3", "main")
+	pod.Spec.Containers[0].Lifecycle = &v1.Lifecycle{PostStart: &v1.LifecycleHandler{Exec: &v1.ExecAction{Command: []string{"block"}}}}
+	started, release := make(chan struct{}), make(chan struct{})
+	fakeRuntime.ExecFunc = func(id string, cmd []string) runtime.ExecResult {
+		close(started)
+		<-release
+		return runtime.ExecResult{}
+	}
+
+	recorder := doRequest(t, h.CreateHandler, []commonIL.RetrievedPodData{{Pod: *pod}})
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("unexpected status code %d: %s", recorder.Code, recorder.Body.String())
+	}
+	<-started
+
+	// the pod is deleted while its worker runs the postStart hook: the supervisor and the probes are not started
+	deleted := make(chan int)
+	go func() { deleted <- doRequest(t, h.DeleteHandler, pod).Code }()
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	if code := <-deleted; code != http.StatusOK {
+		t.Fatalf("unexpected status code %d", code)
+	}
+	h.workers.wait()
+
+	h.supervisor.mutex.Lock()
+	_, supervised := h.supervisor.pods["uid-3"]
+	h.supervisor.mutex.Unlock()
+	h.probes.mutex.Lock()
+	_, probed := h.probes.pods["uid-3"]
+	h.probes.mutex.Unlock()
+	if supervised || probed {
+		t.Errorf("expected the deleted pod not to be supervised nor probed, got %v %v", supervised, probed)
+	}
+}
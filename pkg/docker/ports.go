@@ -0,0 +1,151 @@
+package docker
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/containerd/containerd/log"
+	v1 "k8s.io/api/core/v1"
+
+	commonIL "github.com/intertwin-eu/interlink-docker-plugin/pkg/common"
+)
+
+// portDialTimeout is how long a forwarded connection waits for the pod to accept it
+const portDialTimeout = 10 * time.Second
+
+// allocateHostPorts assigns a free port of the host to the container ports of runSpecs without a host port
+func allocateHostPorts(runSpecs []DockerRunSpec) error {
+	for i := range runSpecs {
+		for j := range runSpecs[i].Ports {
+			port := &runSpecs[i].Ports[j]
+			if port.HostPort != 0 {
+				continue
+			}
+			address := net.JoinHostPort(port.HostIP, "0")
+			if strings.EqualFold(port.Protocol, string(v1.ProtocolUDP)) {
+				conn, err := net.ListenPacket("udp", address)
+				if err != nil {
+					return fmt.Errorf("unable to allocate a host port for port %d of container %s: %w", port.ContainerPort, runSpecs[i].ContainerName, err)
+				}
+				port.HostPort = conn.LocalAddr().(*net.UDPAddr).Port
+				conn.Close()
+			} else {
+				listener, err := net.Listen("tcp", address)
+				if err != nil {
+					return fmt.Errorf("unable to allocate a host port for port %d of container %s: %w", port.ContainerPort, runSpecs[i].ContainerName, err)
+				}
+				port.HostPort = listener.Addr().(*net.TCPAddr).Port
+				listener.Close()
+			}
+		}
+	}
+	return nil
+}
+
+// podPortMappings returns the container ports of a pod along with the host ports they are published on
+func podPortMappings(runSpecs []DockerRunSpec) []commonIL.PortMapping {
+	var mappings []commonIL.PortMapping
+	for _, runSpec := range runSpecs {
+		for _, port := range runSpec.Ports {
+			protocol := v1.Protocol(strings.ToUpper(port.Protocol))
+			if protocol == "" {
+				protocol = v1.ProtocolTCP
+			}
+			mappings = append(mappings, commonIL.PortMapping{
+				ContainerName: runSpec.ContainerName,
+				ContainerPort: int32(port.ContainerPort),
+				HostPort:      int32(port.HostPort),
+				HostIP:        port.HostIP,
+				Protocol:      protocol,
+			})
+		}
+	}
+	return mappings
+}
+
+// portForwarder publishes the ports of the pods running in DIND containers, which are created before their pod is
+// known: the TCP connections accepted on the host ports are relayed to the address of the DIND container
+type portForwarder struct {
+	mutex     sync.Mutex
+	listeners map[string][]net.Listener
+}
+
+// forward starts relaying the host ports of a pod to address. Only TCP ports are forwarded.
+func (f *portForwarder) forward(ctx context.Context, podUID string, ports []commonIL.PortMapping, address string) error {
+	f.stop(podUID)
+
+	var listeners []net.Listener
+	for _, port := range ports {
+		if port.Protocol != v1.ProtocolTCP {
+			log.G(ctx).Warning(fmt.Sprintf("\u26A0 Port %d/%s of container %s of pod %s is not published: only TCP ports are forwarded to DIND containers", port.ContainerPort, port.Protocol, port.ContainerName, podUID))
+			continue
+		}
+		listener, err := net.Listen("tcp", net.JoinHostPort(port.HostIP, strconv.Itoa(int(port.HostPort))))
+		if err != nil {
+			for _, started := range listeners {
+				started.Close()
+			}
+			return fmt.Errorf("unable to publish port %d of container %s on host port %d: %w", port.ContainerPort, port.ContainerName, port.HostPort, err)
+		}
+		listeners = append(listeners, listener)
+		go acceptForwarded(ctx, listener, net.JoinHostPort(address, strconv.Itoa(int(port.ContainerPort))))
+	}
+
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if f.listeners == nil {
+		f.listeners = map[string][]net.Listener{}
+	}
+	f.listeners[podUID] = listeners
+	return nil
+}
+
+// stop closes the host ports of a pod
+func (f *portForwarder) stop(podUID string) {
+	f.mutex.Lock()
+	listeners := f.listeners[podUID]
+	delete(f.listeners, podUID)
+	f.mutex.Unlock()
+
+	for _, listener := range listeners {
+		listener.Close()
+	}
+}
+
+// acceptForwarded relays the connections accepted by listener to target, until the listener is closed
+func acceptForwarded(ctx context.Context, listener net.Listener, target string) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer conn.Close()
+
+			upstream, err := net.DialTimeout("tcp", target, portDialTimeout)
+			if err != nil {
+				log.G(ctx).Warning("\u26A0 Unable to forward a connection to " + target + ": " + err.Error())
+				return
+			}
+			defer upstream.Close()
+
+			done := make(chan struct{}, 2)
+			go func() {
+				io.Copy(upstream, conn)
+				done <- struct{}{}
+			}()
+			go func() {
+				io.Copy(conn, upstream)
+				done <- struct{}{}
+			}()
+			// either side closing ends the relay
+			<-done
+		}()
+	}
+}
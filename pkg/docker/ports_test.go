@@ -0,0 +1,65 @@
+package docker
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"strconv"
+	"testing"
+
+	"github.com/intertwin-eu/interlink-docker-plugin/pkg/docker/runtime"
+)
+
+func TestPortForwarder(t *testing.T) {
+	// the echo server stands for a pod listening in its DIND container
+	server, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	go func() {
+		for {
+			conn, err := server.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				line, _ := bufio.NewReader(conn).ReadString('\n')
+				conn.Write([]byte(line))
+			}()
+		}
+	}()
+
+	runSpecs := []DockerRunSpec{{ContainerName: "main", Ports: []runtime.PortBinding{{HostIP: "127.0.0.1", ContainerPort: server.Addr().(*net.TCPAddr).Port}}}}
+	if err := allocateHostPorts(runSpecs); err != nil {
+		t.Fatal(err)
+	}
+	ports := podPortMappings(runSpecs)
+	if len(ports) != 1 || ports[0].HostPort == 0 || ports[0].Protocol != "TCP" || ports[0].ContainerName != "main" {
+		t.Fatalf("unexpected port mappings %+v", ports)
+	}
+
+	var forwarder portForwarder
+	if err := forwarder.forward(context.Background(), "uid-1", ports, "127.0.0.1"); err != nil {
+		t.Fatal(err)
+	}
+	hostAddress := net.JoinHostPort("127.0.0.1", strconv.Itoa(int(ports[0].HostPort)))
+
+	conn, err := net.Dial("tcp", hostAddress)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Write([]byte("hello\n"))
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	conn.Close()
+	if err != nil || line != "hello\n" {
+		t.Errorf("expected the connection to be relayed to the pod, got %q %v", line, err)
+	}
+
+	forwarder.stop("uid-1")
+	if conn, err := net.Dial("tcp", hostAddress); err == nil {
+		conn.Close()
+		t.Error("expected the host port to be closed")
+	}
+}
@@ -0,0 +1,390 @@
+package docker
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/containerd/containerd/log"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+
+	commonIL "github.com/intertwin-eu/interlink-docker-plugin/pkg/common"
+	"github.com/intertwin-eu/interlink-docker-plugin/pkg/docker/runtime"
+)
+
+// kinds of probes
+const (
+	probeStartup   = "startup"
+	probeReadiness = "readiness"
+	probeLiveness  = "liveness"
+)
+
+// defaultGracePeriod is the grace period of the containers of a pod that does not set one
+const defaultGracePeriod = 30 * time.Second
+
+// terminationGracePeriod returns the time the containers of a pod are given to stop: the one of its deletion if it is
+// being deleted, its terminationGracePeriodSeconds otherwise
+func terminationGracePeriod(pod *v1.Pod) time.Duration {
+	if pod.DeletionGracePeriodSeconds != nil {
+		return time.Duration(*pod.DeletionGracePeriodSeconds) * time.Second
+	} else if pod.Spec.TerminationGracePeriodSeconds != nil {
+		return time.Duration(*pod.Spec.TerminationGracePeriodSeconds) * time.Second
+	}
+	return defaultGracePeriod
+}
+
+// probeTarget is where the probes of the containers of a pod run
+type probeTarget struct {
+	runtime runtime.ContainerRuntime
+	// podIP is the address network probes connect to. When empty, they go through the host ports of the pod.
+	podIP string
+	ports []commonIL.PortMapping
+}
+
+// containerProbes holds the outcome of the probes of a container. Started is true once the startup probe succeeded,
+// ready while the readiness probe succeeds. Both are reset when the container restarts.
+type containerProbes struct {
+	mutex   sync.Mutex
+	started bool
+	ready   bool
+}
+
+type podProbes struct {
+	cancel     context.CancelFunc
+	containers map[string]*containerProbes
+}
+
+// probeManager runs the startup, readiness and liveness probes of the containers of the pods
+type probeManager struct {
+	mutex sync.Mutex
+	pods  map[string]*podProbes
+}
+
+// stop stops probing the containers of a pod
+func (m *probeManager) stop(podUID string) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if probes, ok := m.pods[podUID]; ok {
+		probes.cancel()
+		delete(m.pods, podUID)
+	}
+}
+
+// status returns whether a container started and is ready according to its probes. A container without probes is
+// started and ready.
+func (m *probeManager) status(podUID string, containerName string) (bool, bool) {
+	m.mutex.Lock()
+	probes, ok := m.pods[podUID]
+	m.mutex.Unlock()
+	if !ok {
+		return true, true
+	}
+	state, ok := probes.containers[containerName]
+	if !ok {
+		return true, true
+	}
+
+	state.mutex.Lock()
+	defer state.mutex.Unlock()
+	return state.started, state.ready
+}
+
+// startProbes starts probing the containers of a pod, unless they are already probed
+func (h *SidecarHandler) startProbes(pod *v1.Pod, sandbox podSandbox) {
+	podUID := string(pod.UID)
+
+	h.probes.mutex.Lock()
+	defer h.probes.mutex.Unlock()
+	if _, ok := h.probes.pods[podUID]; ok {
+		return
+	}
+	if h.probes.pods == nil {
+		h.probes.pods = map[string]*podProbes{}
+	}
+
+	target := h.probeTarget(podUID, sandbox)
+	ctx, cancel := context.WithCancel(h.Ctx)
+	probes := &podProbes{cancel: cancel, containers: map[string]*containerProbes{}}
+	for _, container := range append(sidecars(pod), pod.Spec.Containers...) {
+		if container.StartupProbe == nil && container.ReadinessProbe == nil && container.LivenessProbe == nil {
+			continue
+		}
+		state := &containerProbes{started: container.StartupProbe == nil, ready: container.ReadinessProbe == nil}
+		probes.containers[container.Name] = state
+
+		for kind, probe := range map[string]*v1.Probe{probeStartup: container.StartupProbe, probeReadiness: container.ReadinessProbe, probeLiveness: container.LivenessProbe} {
+			if probe != nil {
+				go h.runProbe(ctx, pod, container, kind, probe, target, state)
+			}
+		}
+	}
+	h.probes.pods[podUID] = probes
+}
+
+// probeTarget returns where the probes and the lifecycle hooks of the containers of a pod run
+func (h *SidecarHandler) probeTarget(podUID string, sandbox podSandbox) probeTarget {
+	target := probeTarget{runtime: sandbox.Runtime, podIP: sandbox.IP}
+	if record, ok := h.StateStore.GetPod(podUID); ok {
+		target.ports = record.Ports
+	}
+	return target
+}
+
+func probeSeconds(seconds int32, defaultSeconds int32) time.Duration {
+	if seconds <= 0 {
+		seconds = defaultSeconds
+	}
+	return time.Duration(seconds) * time.Second
+}
+
+// runProbe runs a probe of a container every period until ctx is done. The probes of a container are started from
+// scratch, after the initial delay, each time the container restarts. Readiness and liveness probes wait for the
+// startup probe to succeed. A container failing its liveness or startup probe is killed.
+func (h *SidecarHandler) runProbe(ctx context.Context, pod *v1.Pod, container v1.Container, kind string, probe *v1.Probe, target probeTarget, state *containerProbes) {
+	containerName := pod.Namespace + "-" + string(pod.UID) + "-" + container.Name
+	period := probeSeconds(probe.PeriodSeconds, 10)
+	initialDelay := probeSeconds(probe.InitialDelaySeconds, 0)
+	successThreshold := max(int(probe.SuccessThreshold), 1)
+	failureThreshold := 3
+	if probe.FailureThreshold > 0 {
+		failureThreshold = int(probe.FailureThreshold)
+	}
+
+	var startedAt time.Time
+	successes, failures := 0, 0
+	for {
+		wait := period
+
+		info, err := target.runtime.InspectContainer(ctx, containerName)
+		if err == nil && info.State.Running {
+			if !info.State.StartedAt.Equal(startedAt) {
+				startedAt = info.State.StartedAt
+				successes, failures = 0, 0
+				state.mutex.Lock()
+				switch kind {
+				case probeStartup:
+					state.started = false
+				case probeReadiness:
+					state.ready = false
+				}
+				state.mutex.Unlock()
+			}
+
+			state.mutex.Lock()
+			started := state.started
+			state.mutex.Unlock()
+
+			if delay := initialDelay - time.Since(startedAt); delay > 0 {
+				wait = min(delay, period)
+			} else if (kind == probeStartup) != started {
+				err = h.probe(ctx, probe, container, containerName, target)
+				if err == nil {
+					successes, failures = successes+1, 0
+				} else {
+					successes, failures = 0, failures+1
+					log.G(h.Ctx).Warning(fmt.Sprintf("\u26A0 %s probe of container %s failed (%d/%d): %v", kind, containerName, failures, failureThreshold, err))
+				}
+
+				state.mutex.Lock()
+				switch {
+				case kind == probeStartup && successes >= 1:
+					state.started = true
+				case kind == probeReadiness && successes >= successThreshold:
+					state.ready = true
+				case kind == probeReadiness && failures >= failureThreshold:
+					state.ready = false
+				}
+				state.mutex.Unlock()
+
+				if kind != probeReadiness && failures >= failureThreshold {
+					h.killUnhealthy(ctx, pod, probe, target.runtime, containerName, kind)
+					successes, failures = 0, 0
+				}
+			}
+		} else {
+			state.mutex.Lock()
+			if kind == probeReadiness {
+				state.ready = false
+			}
+			state.mutex.Unlock()
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(wait):
+		}
+	}
+}
+
+// killUnhealthy stops a container that failed its liveness or startup probe. The supervisor of the pod restarts it
+// according to the restart policy of the pod.
+func (h *SidecarHandler) killUnhealthy(ctx context.Context, pod *v1.Pod, probe *v1.Probe, containerRuntime runtime.ContainerRuntime, containerName string, kind string) {
+	gracePeriod := terminationGracePeriod(pod)
+	if probe.TerminationGracePeriodSeconds != nil {
+		gracePeriod = time.Duration(*probe.TerminationGracePeriodSeconds) * time.Second
+	}
+
+	log.G(h.Ctx).Warning("\u26A0 Container " + containerName + " failed its " + kind + " probe, killing it")
+	err := containerRuntime.StopContainer(ctx, containerName, gracePeriod)
+	if err != nil {
+		log.G(h.Ctx).Error("\u274C Error stopping container " + containerName + ": " + err.Error())
+	}
+}
+
+// probe runs a probe once, returning nil if it succeeded
+func (h *SidecarHandler) probe(ctx context.Context, probe *v1.Probe, container v1.Container, containerName string, target probeTarget) error {
+	timeout := probeSeconds(probe.TimeoutSeconds, 1)
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	switch {
+	case probe.Exec != nil:
+		return execAction(ctx, probe.Exec, containerName, target)
+
+	case probe.HTTPGet != nil:
+		return httpGetAction(ctx, probe.HTTPGet, container, target, "kube-probe/1.29")
+
+	case probe.TCPSocket != nil:
+		port, err := probePort(probe.TCPSocket.Port, container)
+		if err != nil {
+			return err
+		}
+		address, err := target.address(probe.TCPSocket.Host, container.Name, port)
+		if err != nil {
+			return err
+		}
+		var dialer net.Dialer
+		conn, err := dialer.DialContext(ctx, "tcp", address)
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+
+	case probe.GRPC != nil:
+		address, err := target.address("", container.Name, int(probe.GRPC.Port))
+		if err != nil {
+			return err
+		}
+		conn, err := grpc.DialContext(ctx, address, grpc.WithTransportCredentials(insecure.NewCredentials()), grpc.WithBlock())
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+		service := ""
+		if probe.GRPC.Service != nil {
+			service = *probe.GRPC.Service
+		}
+		resp, err := healthpb.NewHealthClient(conn).Check(ctx, &healthpb.HealthCheckRequest{Service: service})
+		if err != nil {
+			return err
+		}
+		if resp.Status != healthpb.HealthCheckResponse_SERVING {
+			return fmt.Errorf("gRPC probe failed with status %s", resp.Status)
+		}
+		return nil
+	}
+
+	return fmt.Errorf("probe has no handler")
+}
+
+// execAction runs a command in a container, returning nil if it exited with code 0
+func execAction(ctx context.Context, action *v1.ExecAction, containerName string, target probeTarget) error {
+	result, err := target.runtime.Exec(ctx, containerName, action.Command)
+	if err != nil {
+		return err
+	}
+	if result.ExitCode != 0 {
+		return fmt.Errorf("command exited with code %d: %s", result.ExitCode, strings.TrimSpace(result.Stdout+result.Stderr))
+	}
+	return nil
+}
+
+// probeClient runs the httpGet probes and hooks. Like the kubelet, it does not verify certificates nor keep connections
+// alive, so that the periodic probes of a pod leave no idle connection behind.
+var probeClient = &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}, DisableKeepAlives: true}}
+
+// httpGetAction sends a GET request to a container, returning nil if it answered with a 2xx or 3xx status code
+func httpGetAction(ctx context.Context, action *v1.HTTPGetAction, container v1.Container, target probeTarget, userAgent string) error {
+	port, err := probePort(action.Port, container)
+	if err != nil {
+		return err
+	}
+	address, err := target.address(action.Host, container.Name, port)
+	if err != nil {
+		return err
+	}
+	scheme := strings.ToLower(string(action.Scheme))
+	if scheme == "" {
+		scheme = "http"
+	}
+	path := action.Path
+	if !strings.HasPrefix(path, "/") {
+		path = "/" + path
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, scheme+"://"+address+path, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("User-Agent", userAgent)
+	for _, header := range action.HTTPHeaders {
+		req.Header.Add(header.Name, header.Value)
+	}
+	resp, err := probeClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 400 {
+		return fmt.Errorf("HTTP request failed with status code %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// probePort resolves the port of a probe, which can be the name of a port of the container
+func probePort(port intstr.IntOrString, container v1.Container) (int, error) {
+	if port.Type == intstr.Int {
+		return port.IntValue(), nil
+	}
+	for _, containerPort := range container.Ports {
+		if containerPort.Name == port.StrVal {
+			return int(containerPort.ContainerPort), nil
+		}
+	}
+	if number, err := strconv.Atoi(port.StrVal); err == nil {
+		return number, nil
+	}
+	return 0, fmt.Errorf("container %s has no port named %s", container.Name, port.StrVal)
+}
+
+// address returns the address a network probe of a container connects to
+func (t probeTarget) address(host string, containerName string, port int) (string, error) {
+	if host != "" {
+		return net.JoinHostPort(host, strconv.Itoa(port)), nil
+	}
+	if t.podIP != "" {
+		return net.JoinHostPort(t.podIP, strconv.Itoa(port)), nil
+	}
+	// without a known address, the pod is reached through its host ports
+	for _, mapping := range t.ports {
+		if mapping.ContainerName == containerName && int(mapping.ContainerPort) == port {
+			hostIP := mapping.HostIP
+			if hostIP == "" {
+				hostIP = "127.0.0.1"
+			}
+			return net.JoinHostPort(hostIP, strconv.Itoa(int(mapping.HostPort))), nil
+		}
+	}
+	return "", fmt.Errorf("port %d of container %s is unreachable: the pod has no known address and the port is not published", port, containerName)
+}
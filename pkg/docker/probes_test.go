@@ -0,0 +1,153 @@
+package docker
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+
+	commonIL "github.com/intertwin-eu/interlink-docker-plugin/pkg/common"
+	"github.com/intertwin-eu/interlink-docker-plugin/pkg/docker/runtime"
+)
+
+// waitFor polls condition until it holds or a few seconds passed
+func waitFor(t *testing.T, description string, condition func() bool) {
+	t.Helper()
+	for deadline := time.Now().Add(3 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if condition() {
+			return
+		}
+	}
+	t.Fatal("timed out waiting for " + description)
+}
+
+func TestProbes(t *testing.T) {
+	h, fakeRuntime := newTestHandler(t)
+	ctx := context.Background()
+	pod := testPod("1", "ready", "unhealthy")
+	pod.Spec.RestartPolicy = v1.RestartPolicyAlways
+	pod.Spec.Containers[0].ReadinessProbe = &v1.Probe{ProbeHandler: v1.ProbeHandler{Exec: &v1.ExecAction{Command: []string{"check"}}}}
+	pod.Spec.Containers[1].LivenessProbe = &v1.Probe{ProbeHandler: v1.ProbeHandler{Exec: &v1.ExecAction{Command: []string{"fail"}}}, FailureThreshold: 1}
+	fakeRuntime.ExecFunc = func(id string, cmd []string) runtime.ExecResult {
+		if cmd[0] == "fail" {
+			return runtime.ExecResult{ExitCode: 1}
+		}
+		return runtime.ExecResult{}
+	}
+	startTestContainer(t, fakeRuntime, "default-uid-1-ready")
+	startTestContainer(t, fakeRuntime, "default-uid-1-unhealthy")
+	unhealthy, _ := fakeRuntime.InspectContainer(ctx, "default-uid-1-unhealthy")
+
+	// the supervisor restarts the containers killed by their liveness probe
+	h.startSupervisor(pod, podSandbox{Runtime: fakeRuntime})
+	defer h.supervisor.stop("uid-1")
+	h.startProbes(pod, podSandbox{Runtime: fakeRuntime})
+	defer h.probes.stop("uid-1")
+
+	// the readiness probe gates the readiness of the container
+	waitFor(t, "the container to be ready", func() bool {
+		started, ready := h.probes.status("uid-1", "ready")
+		return started && ready
+	})
+	// a container failing its liveness probe is restarted
+	waitFor(t, "the unhealthy container to be restarted", func() bool {
+		info, err := fakeRuntime.InspectContainer(ctx, "default-uid-1-unhealthy")
+		return err == nil && info.State.Running && info.State.StartedAt.After(unhealthy.State.StartedAt)
+	})
+
+	if started, ready := h.probes.status("uid-2", "main"); !started || !ready {
+		t.Error("expected a container without probes to be ready")
+	}
+}
+
+func TestExecProbeTimeout(t *testing.T) {
+	h, fakeRuntime := newTestHandler(t)
+	hang := make(chan struct{})
+	defer close(hang)
+	fakeRuntime.ExecFunc = func(id string, cmd []string) runtime.ExecResult {
+		<-hang
+		return runtime.ExecResult{}
+	}
+	startTestContainer(t, fakeRuntime, "default-uid-1-main")
+
+	// a hanging command fails the probe once its timeout passed
+	probe := &v1.Probe{ProbeHandler: v1.ProbeHandler{Exec: &v1.ExecAction{Command: []string{"hang"}}}, TimeoutSeconds: 1}
+	start := time.Now()
+	err := h.probe(context.Background(), probe, v1.Container{Name: "main"}, "default-uid-1-main", probeTarget{runtime: fakeRuntime})
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected the probe to time out, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < time.Second || elapsed > 2*time.Second {
+		t.Errorf("expected the probe to fail after its timeout of 1s, took %s", elapsed)
+	}
+}
+
+func TestProbeHandlers(t *testing.T) {
+	h, _ := newTestHandler(t)
+	var openConnections atomic.Int32
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/healthz" || r.Header.Get("X-Probe") != "1" {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	server.Config.ConnState = func(conn net.Conn, state http.ConnState) {
+		switch state {
+		case http.StateNew:
+			openConnections.Add(1)
+		case http.StateClosed, http.StateHijacked:
+			openConnections.Add(-1)
+		}
+	}
+	server.Start()
+	defer server.Close()
+	port := server.Listener.Addr().(*net.TCPAddr).Port
+
+	container := v1.Container{Name: "main", Ports: []v1.ContainerPort{{Name: "http", ContainerPort: int32(port)}}}
+	target := probeTarget{podIP: "127.0.0.1"}
+	httpProbe := func(path string) *v1.Probe {
+		return &v1.Probe{ProbeHandler: v1.ProbeHandler{HTTPGet: &v1.HTTPGetAction{Path: path, Port: intstr.FromString("http"), HTTPHeaders: []v1.HTTPHeader{{Name: "X-Probe", Value: "1"}}}}}
+	}
+
+	if err := h.probe(context.Background(), httpProbe("/healthz"), container, "default-uid-1-main", target); err != nil {
+		t.Errorf("expected the HTTP probe to succeed, got %v", err)
+	}
+	if err := h.probe(context.Background(), httpProbe("/missing"), container, "default-uid-1-main", target); err == nil {
+		t.Error("expected the HTTP probe to fail")
+	}
+	// the connections of the probes are not kept alive
+	waitFor(t, "the connections of the HTTP probes to be closed", func() bool {
+		return openConnections.Load() == 0
+	})
+
+	tcpProbe := &v1.Probe{ProbeHandler: v1.ProbeHandler{TCPSocket: &v1.TCPSocketAction{Port: intstr.FromInt(port)}}}
+	if err := h.probe(context.Background(), tcpProbe, container, "default-uid-1-main", target); err != nil {
+		t.Errorf("expected the TCP probe to succeed, got %v", err)
+	}
+	server.Close()
+	if err := h.probe(context.Background(), tcpProbe, container, "default-uid-1-main", target); err == nil {
+		t.Error("expected the TCP probe of a closed port to fail")
+	}
+
+	// without a pod address, network probes go through the host ports of the pod
+	published := probeTarget{ports: []commonIL.PortMapping{{ContainerName: "main", ContainerPort: 80, HostPort: 30080}}}
+	if address, err := published.address("", "main", 80); err != nil || address != "127.0.0.1:30080" {
+		t.Errorf("unexpected address %s %v", address, err)
+	}
+	if address, err := published.address("", "main", 81); err == nil {
+		t.Errorf("expected an unreachable port, got %s", address)
+	}
+	if _, err := probePort(intstr.FromString("metrics"), container); err == nil {
+		t.Error("expected an error for an unknown named port")
+	}
+	if number, err := probePort(intstr.FromString(strconv.Itoa(port)), container); err != nil || number != port {
+		t.Errorf("unexpected port %d %v", number, err)
+	}
+}
@@ -0,0 +1,378 @@
+package docker
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/containerd/containerd/log"
+
+	"github.com/intertwin-eu/interlink-docker-plugin/pkg/docker/dindmanager"
+	"github.com/intertwin-eu/interlink-docker-plugin/pkg/docker/runtime"
+	"github.com/intertwin-eu/interlink-docker-plugin/pkg/docker/statestore"
+)
+
+// Reconcile is called at startup, in place of cleaning every DIND container. The DIND containers and networks labeled
+// with the plugin instance are listed: the ones running the containers of a pod are re-adopted along with their GPUs,
+// idle ones still answering are put back in the pool, and the ones whose owning pod is unknown are removed.
+// Objects of other plugin instances are never touched. It returns the number of idle DIND containers re-adopted.
+// In host mode, the pods are reconciled from their networks or native pods instead.
+func (h *SidecarHandler) Reconcile() (int, error) {
+	if h.hostMode() {
+		return 0, h.reconcileHost()
+	}
+
+	log.G(h.Ctx).Info("\u23F3 Reconciling DIND containers of instance " + h.Config.InstanceID)
+
+	poolLabels := map[string]string{dindmanager.LabelInstance: h.Config.InstanceID, dindmanager.LabelRole: dindmanager.RolePool}
+
+	dinds, err := h.Runtime.ListContainers(h.Ctx, runtime.ListOptions{All: true, Labels: poolLabels})
+	if err != nil {
+		return 0, err
+	}
+
+	adopted := 0
+	usedNetworks := map[string]bool{}
+	knownPods := map[string]bool{}
+
+	for _, listed := range dinds {
+		// the list does not return the mounts and networks of the containers
+		dind, err := h.Runtime.InspectContainer(h.Ctx, listed.ID)
+		if runtime.IsNotFound(err) {
+			continue
+		} else if err != nil {
+			return adopted, err
+		}
+
+		networkID := ""
+		for network := range dind.Networks {
+			networkID = network
+		}
+
+		podUID, podContainers, err := h.inspectDindPod(dind)
+		if err == nil && podUID == "" && dind.Name+"_network" != networkID {
+			// renamed for a pod: it runs no container yet if the creation of the pod was interrupted before, otherwise
+			// the creation of the pod failed
+			if _, ok := h.StateStore.GetPod(strings.TrimSuffix(dind.Name, "_dind")); ok {
+				podUID = strings.TrimSuffix(dind.Name, "_dind")
+			} else {
+				err = fmt.Errorf("container was assigned to a pod but runs no container")
+			}
+		}
+		if err != nil {
+			log.G(h.Ctx).Warning("\u26A0 Removing DIND container " + dind.Name + ": " + err.Error())
+			h.removeDind(dind, networkID)
+			continue
+		}
+
+		if podUID == "" {
+			err = h.DindManager.AddDind(dindmanager.DindSpecs{DindID: dind.ID, DindNetworkID: networkID, State: dindmanager.DindReady})
+			if err != nil {
+				return adopted, err
+			}
+			adopted++
+			log.G(h.Ctx).Info("\u2705 Re-adopted idle DIND container " + dind.Name)
+		} else {
+			err = h.DindManager.AddDind(dindmanager.DindSpecs{DindID: dind.ID, PodUID: podUID, DindNetworkID: networkID, State: dindmanager.DindAssigned})
+			if err != nil {
+				return adopted, err
+			}
+			err = h.restorePod(podUID, dind.ID, networkID, podContainers)
+			if err != nil {
+				return adopted, err
+			}
+			// the ports of the pod were published by the previous sidecar process
+			if pod, ok := h.StateStore.GetPod(podUID); ok && len(pod.Ports) > 0 {
+				err = h.ports.forward(h.Ctx, podUID, pod.Ports, dindAddress(dind, networkID))
+				if err != nil {
+					log.G(h.Ctx).Error("\u274C Error publishing again the ports of pod " + podUID + ": " + err.Error())
+				}
+			}
+			knownPods[podUID] = true
+			log.G(h.Ctx).Info("\u2705 Re-adopted DIND container " + dind.Name + " of pod " + podUID)
+			h.resumeCreation(podUID)
+		}
+		usedNetworks[networkID] = true
+	}
+
+	// a pod whose DIND container did not survive the restart is failed, like when its DIND container dies at runtime:
+	// its record is kept so that its status reports the failure, until it is deleted
+	for _, pod := range h.StateStore.Pods() {
+		if !knownPods[pod.PodUID] {
+			log.G(h.Ctx).Warning("\u26A0 DIND container of pod " + pod.PodUID + " is not running anymore, the pod is failed")
+			err = h.DindManager.AddDind(dindmanager.DindSpecs{
+				DindID:        pod.PodUID + "_dind",
+				PodUID:        pod.PodUID,
+				DindNetworkID: pod.DindNetworkID,
+				State:         dindmanager.DindFailed,
+				Message:       "DIND container " + pod.PodUID + "_dind was not running anymore after a restart of the plugin",
+			})
+			if err != nil {
+				return adopted, err
+			}
+		}
+	}
+
+	networks, err := h.Runtime.ListNetworks(h.Ctx, runtime.ListOptions{Labels: poolLabels})
+	if err != nil {
+		return adopted, err
+	}
+	for _, network := range networks {
+		if !usedNetworks[network.Name] && !usedNetworks[network.ID] {
+			h.removeDindNetwork(network.ID)
+		}
+	}
+
+	log.G(h.Ctx).Info(fmt.Sprintf("\u2705 Reconciliation done, %d idle DIND containers re-adopted", adopted))
+
+	return adopted, nil
+}
+
+// reconcileHost is Reconcile in host mode: the pods whose network, or native pod, still exists are re-adopted along
+// with their GPUs,
+// while the containers left by unknown pods are removed
+func (h *SidecarHandler) reconcileHost() error {
+	log.G(h.Ctx).Info("\u23F3 Reconciling pods of instance " + h.Config.InstanceID)
+
+	podLabels := map[string]string{dindmanager.LabelInstance: h.Config.InstanceID, dindmanager.LabelRole: dindmanager.RolePod}
+
+	containers, err := h.Runtime.ListContainers(h.Ctx, runtime.ListOptions{All: true, Labels: podLabels})
+	if err != nil {
+		return err
+	}
+	podContainers := map[string][]runtime.ContainerInfo{}
+	for _, listed := range containers {
+		// the list does not return the environment of the containers
+		container, err := h.Runtime.InspectContainer(h.Ctx, listed.ID)
+		if runtime.IsNotFound(err) {
+			continue
+		} else if err != nil {
+			return err
+		}
+		podContainers[listed.Labels[LabelPodUID]] = append(podContainers[listed.Labels[LabelPodUID]], container)
+	}
+
+	sandboxes, err := h.listHostSandboxes(podLabels)
+	if err != nil {
+		return err
+	}
+	knownPods := map[string]bool{}
+	for _, sandbox := range sandboxes {
+		podUID := sandbox.Labels[LabelPodUID]
+		if _, ok := h.StateStore.GetPod(podUID); !ok && len(podContainers[podUID]) == 0 {
+			// created for a pod whose creation failed before any container was started
+			log.G(h.Ctx).Warning("\u26A0 Removing " + sandbox.Name + ": no pod runs in it")
+			err = h.removeHostSandbox(sandbox.ID)
+			if err != nil && !runtime.IsNotFound(err) {
+				log.G(h.Ctx).Error("\u274C Error deleting " + sandbox.Name + ": " + err.Error())
+			}
+			continue
+		}
+
+		err = h.restorePod(podUID, "", sandbox.ID, podContainers[podUID])
+		if err != nil {
+			return err
+		}
+		knownPods[podUID] = true
+		log.G(h.Ctx).Info("\u2705 Re-adopted pod " + podUID)
+		h.resumeCreation(podUID)
+	}
+
+	for podUID, containers := range podContainers {
+		if knownPods[podUID] {
+			continue
+		}
+		for _, container := range containers {
+			log.G(h.Ctx).Warning("\u26A0 Removing container " + container.Name + ": the sandbox of its pod does not exist anymore")
+			err = h.Runtime.RemoveContainer(h.Ctx, container.ID, true)
+			if err != nil && !runtime.IsNotFound(err) {
+				log.G(h.Ctx).Error("\u274C Error deleting container " + container.Name + ": " + err.Error())
+			}
+		}
+	}
+
+	// the record of a pod whose sandbox does not exist anymore is kept, so that its status reports the pod as failed
+	// until it is deleted
+	for _, pod := range h.StateStore.Pods() {
+		if !knownPods[pod.PodUID] {
+			log.G(h.Ctx).Warning("\u26A0 Sandbox of pod " + pod.PodUID + " does not exist anymore, the pod is failed")
+		}
+	}
+
+	log.G(h.Ctx).Info(fmt.Sprintf("\u2705 Reconciliation done, %d pods re-adopted", len(knownPods)))
+
+	return nil
+}
+
+// inspectDindPod returns the UID of the pod whose containers run in a DIND container, empty if the DIND container is idle,
+// along with the inspected containers of the pod. An error is returned if the DIND container cannot be used anymore.
+func (h *SidecarHandler) inspectDindPod(dind runtime.ContainerInfo) (string, []runtime.ContainerInfo, error) {
+	if !dind.State.Running {
+		return "", nil, fmt.Errorf("container is %s", dind.State.Status)
+	}
+
+	endpoint, err := dindmanager.InnerEndpoint(dind)
+	if err != nil {
+		return "", nil, err
+	}
+	innerRuntime, err := h.Runtime.Inner(endpoint)
+	if err != nil {
+		return "", nil, err
+	}
+
+	err = innerRuntime.Ping(h.Ctx)
+	if err != nil {
+		return "", nil, err
+	}
+
+	innerContainers, err := innerRuntime.ListContainers(h.Ctx, runtime.ListOptions{All: true})
+	if err != nil {
+		return "", nil, err
+	}
+
+	podUID := ""
+	var podContainers []runtime.ContainerInfo
+	for _, listed := range innerContainers {
+		labels := listed.Labels
+		if labels[dindmanager.LabelInstance] != h.Config.InstanceID || labels[dindmanager.LabelRole] != dindmanager.RolePod || labels[LabelPodUID] == "" {
+			return "", nil, fmt.Errorf("container %s has no known owning pod", listed.Name)
+		}
+		if podUID != "" && labels[LabelPodUID] != podUID {
+			return "", nil, fmt.Errorf("containers of pods %s and %s run in the same DIND container", podUID, labels[LabelPodUID])
+		}
+		podUID = labels[LabelPodUID]
+
+		container, err := innerRuntime.InspectContainer(h.Ctx, listed.ID)
+		if err != nil {
+			return "", nil, err
+		}
+		podContainers = append(podContainers, container)
+	}
+
+	return podUID, podContainers, nil
+}
+
+// restorePod assigns again the GPUs of the containers of a re-adopted pod, and records the pod in the state store
+// if it was lost. The containers not created yet by an interrupted creation get the GPUs recorded for them. dindID is
+// empty in host mode.
+func (h *SidecarHandler) restorePod(podUID string, dindID string, networkID string, podContainers []runtime.ContainerInfo) error {
+	podGPUs := map[string][]string{}
+	for _, container := range podContainers {
+		for _, env := range container.Env {
+			value, found := strings.CutPrefix(env, "NVIDIA_VISIBLE_DEVICES=")
+			if found && value != "" {
+				podGPUs[container.Name] = strings.Split(value, ",")
+			}
+		}
+	}
+
+	pod, ok := h.StateStore.GetPod(podUID)
+	for containerName, indexes := range pod.GPUs {
+		if _, found := podGPUs[containerName]; !found {
+			podGPUs[containerName] = indexes
+		}
+	}
+
+	gpuSpecsList := h.GpuManager.GetGPUSpecsList()
+	for containerName, indexes := range podGPUs {
+		for _, index := range indexes {
+			for _, gpuSpec := range gpuSpecsList {
+				if strconv.Itoa(gpuSpec.Index) != index {
+					continue
+				}
+				err := h.GpuManager.Assign(gpuSpec.UUID, containerName)
+				if err != nil {
+					log.G(h.Ctx).Error("\u274C Error restoring GPU " + index + " of container " + containerName + ": " + err.Error())
+				}
+			}
+		}
+	}
+
+	if !ok {
+		labels := podContainers[0].Labels
+		podDirectoryPath, err := podDirectory(h.Config, labels[LabelPodNamespace], podUID)
+		if err != nil {
+			return err
+		}
+		pod = statestore.PodRecord{
+			PodUID:       podUID,
+			PodNamespace: labels[LabelPodNamespace],
+			PodName:      labels[LabelPodName],
+			PodDirectory: podDirectoryPath,
+			CreatedAt:    time.Now(),
+		}
+	}
+	pod.DindID = dindID
+	pod.DindNetworkID = networkID
+	pod.GPUs = podGPUs
+
+	return h.StateStore.PutPod(pod)
+}
+
+// resumeCreation starts again the worker of a re-adopted pod whose creation was interrupted by a restart of the plugin,
+// from the phase it reached. The pods recorded without their run specs, by older versions of the plugin, cannot be
+// resumed: they are reported as failed.
+func (h *SidecarHandler) resumeCreation(podUID string) {
+	record, ok := h.StateStore.GetPod(podUID)
+	if !ok || (record.Phase != workerPulling && record.Phase != workerInitializing) || h.workers.running(podUID) {
+		return
+	}
+	if record.Pod == nil || len(record.RunSpecs) == 0 {
+		log.G(h.Ctx).Warning("\u26A0 The creation of pod " + podUID + " was interrupted and cannot be resumed, its run specs were not recorded")
+		return
+	}
+
+	var runSpecs []DockerRunSpec
+	err := json.Unmarshal(record.RunSpecs, &runSpecs)
+	if err != nil {
+		log.G(h.Ctx).Error("\u274C Error reading the run specs of pod " + podUID + ", its creation cannot be resumed: " + err.Error())
+		return
+	}
+	sandbox, err := h.getSandbox(podUID)
+	if err != nil || sandbox.Failure != "" {
+		log.G(h.Ctx).Warning("\u26A0 The creation of pod " + podUID + " cannot be resumed, its sandbox is not available")
+		return
+	}
+
+	var initContainers, containers []DockerRunSpec
+	for _, runSpec := range runSpecs {
+		if runSpec.IsInitContainer {
+			initContainers = append(initContainers, runSpec)
+		} else {
+			containers = append(containers, runSpec)
+		}
+	}
+	log.G(h.Ctx).Info("\u23F3 Resuming the creation of pod " + podUID + " from phase " + record.Phase)
+	h.startWorker(record.Pod, sandbox, record.PodDirectory, initContainers, containers, record.Phase)
+}
+
+// removeDind force-removes a DIND container along with its network and socket folder
+func (h *SidecarHandler) removeDind(dind runtime.ContainerInfo, networkID string) {
+	err := h.Runtime.RemoveContainer(h.Ctx, dind.ID, true)
+	if err != nil && !runtime.IsNotFound(err) {
+		log.G(h.Ctx).Error("\u274C Error deleting DIND container " + dind.Name + ": " + err.Error())
+	}
+
+	if networkID != "" {
+		h.removeDindNetwork(networkID)
+	}
+
+	if endpoint, err := dindmanager.InnerEndpoint(dind); err == nil {
+		h.Runtime.Forget(endpoint)
+	}
+	for _, mount := range dind.Mounts {
+		if mount.Target == dindmanager.DindSocketDir {
+			os.RemoveAll(mount.Source)
+		}
+	}
+}
+
+func (h *SidecarHandler) removeDindNetwork(networkID string) {
+	err := h.Runtime.RemoveNetwork(h.Ctx, networkID)
+	if err != nil && !runtime.IsNotFound(err) {
+		log.G(h.Ctx).Error("\u274C Error deleting network " + networkID + ": " + err.Error())
+	}
+}
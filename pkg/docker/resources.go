@@ -0,0 +1,98 @@
+package docker
+
+import (
+	"fmt"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/api/resource"
+
+	commonIL "github.com/intertwin-eu/interlink-docker-plugin/pkg/common"
+	"github.com/intertwin-eu/interlink-docker-plugin/pkg/docker/runtime"
+)
+
+// dindCgroupParent returns the cgroup parent of the DIND container of a pod, from the DindCgroupParent template of the
+// config where {namespace} is replaced by the namespace of the pod. It is empty if no template is configured.
+func dindCgroupParent(config commonIL.InterLinkConfig, podNamespace string) string {
+	return strings.ReplaceAll(config.DindCgroupParent, "{namespace}", podNamespace)
+}
+
+// sumResources returns the sum of the limits of runSpecs. A resource is 0, i.e. unlimited, if any of them has no limit.
+func sumResources(runSpecs []DockerRunSpec) runtime.Resources {
+	sum := runtime.Resources{}
+	memoryLimited, cpuLimited := true, true
+	for _, runSpec := range runSpecs {
+		sum.Memory += runSpec.Resources.Memory
+		sum.NanoCPUs += runSpec.Resources.NanoCPUs
+		memoryLimited = memoryLimited && runSpec.Resources.Memory != 0
+		cpuLimited = cpuLimited && runSpec.Resources.NanoCPUs != 0
+	}
+	if !memoryLimited {
+		sum.Memory = 0
+	}
+	if !cpuLimited {
+		sum.NanoCPUs = 0
+	}
+	return sum
+}
+
+// maxLimit returns the larger of two limits, where 0 means unlimited
+func maxLimit(a int64, b int64) int64 {
+	if a == 0 || b == 0 {
+		return 0
+	}
+	return max(a, b)
+}
+
+// maxResources returns the larger of two limits for each resource
+func maxResources(a runtime.Resources, b runtime.Resources) runtime.Resources {
+	return runtime.Resources{Memory: maxLimit(a.Memory, b.Memory), NanoCPUs: maxLimit(a.NanoCPUs, b.NanoCPUs)}
+}
+
+// dindResources returns the limits of the DIND container of a pod, computed like the effective resources of a pod in
+// Kubernetes, plus the overhead of the config for the inner daemon: the sum of the limits of its containers and
+// sidecars, or the limits of an init container plus the ones of the sidecars started before it if higher, since the
+// init containers run one at a time. A resource is left unlimited if any container has no limit for it.
+func dindResources(config commonIL.InterLinkConfig, runSpecs []DockerRunSpec) (runtime.Resources, error) {
+	var sidecars, containers []DockerRunSpec
+	var initResources *runtime.Resources
+	for _, runSpec := range runSpecs {
+		var running []DockerRunSpec
+		if runSpec.IsSidecar {
+			sidecars = append(sidecars, runSpec)
+			running = sidecars
+		} else if runSpec.IsInitContainer {
+			running = append(append([]DockerRunSpec{}, sidecars...), runSpec)
+		} else {
+			containers = append(containers, runSpec)
+			continue
+		}
+
+		resources := sumResources(running)
+		if initResources != nil {
+			resources = maxResources(*initResources, resources)
+		}
+		initResources = &resources
+	}
+
+	resources := sumResources(append(append([]DockerRunSpec{}, sidecars...), containers...))
+	if initResources != nil {
+		resources = maxResources(resources, *initResources)
+	}
+
+	if resources.Memory != 0 && config.DindMemoryOverhead != "" {
+		overhead, err := resource.ParseQuantity(config.DindMemoryOverhead)
+		if err != nil {
+			return resources, fmt.Errorf("invalid DindMemoryOverhead %s: %v", config.DindMemoryOverhead, err)
+		}
+		resources.Memory += overhead.Value()
+	}
+	if resources.NanoCPUs != 0 && config.DindCPUOverhead != "" {
+		overhead, err := resource.ParseQuantity(config.DindCPUOverhead)
+		if err != nil {
+			return resources, fmt.Errorf("invalid DindCPUOverhead %s: %v", config.DindCPUOverhead, err)
+		}
+		resources.NanoCPUs += overhead.MilliValue() * 1000000
+	}
+
+	return resources, nil
+}
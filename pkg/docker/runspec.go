@@ -0,0 +1,213 @@
+package docker
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	units "github.com/docker/go-units"
+
+	"github.com/intertwin-eu/interlink-docker-plugin/pkg/docker/runtime"
+)
+
+// ContainerSpec renders the DockerRunSpec to the spec used to create the container through the runtime
+func (s DockerRunSpec) ContainerSpec() runtime.ContainerSpec {
+	spec := runtime.ContainerSpec{
+		Name:        s.Name,
+		Image:       s.Image,
+		Entrypoint:  s.Entrypoint,
+		Cmd:         s.Args,
+		Env:         append([]string{}, s.Env...),
+		Labels:      s.Labels,
+		Mounts:      s.Mounts,
+		Ports:       s.Ports,
+		Resources:   s.Resources,
+		NetworkMode: s.NetworkMode,
+		Pod:         s.Pod,
+		IpcMode:     s.IpcMode,
+		PidMode:     s.PidMode,
+		Privileged:  s.Privileged,
+		User:        s.Options.User,
+		ShmSize:     s.Options.ShmSize,
+		CapAdd:      s.Options.CapAdd,
+		CapDrop:     s.Options.CapDrop,
+		SecurityOpt: s.Options.SecurityOpt,
+		ExtraHosts:  s.Options.ExtraHosts,
+		WorkingDir:  s.WorkingDir,
+		OpenStdin:   s.Stdin,
+		StdinOnce:   s.StdinOnce,
+		Tty:         s.TTY,
+	}
+
+	if len(s.GPUs) > 0 {
+		spec.Runtime = "nvidia"
+		spec.Env = append(spec.Env, "NVIDIA_VISIBLE_DEVICES="+strings.Join(s.GPUs, ","))
+	}
+
+	return spec
+}
+
+var shellSafe = regexp.MustCompile(`^[A-Za-z0-9_@%+=:,./-]+$`)
+
+// shellQuote quotes a word so that a POSIX shell reads it back unchanged
+func shellQuote(word string) string {
+	if shellSafe.MatchString(word) {
+		return word
+	}
+	return "'" + strings.ReplaceAll(word, "'", `'"'"'`) + "'"
+}
+
+// ShellCommand renders the DockerRunSpec to an equivalent docker (or podman) run command line, written in the pod folder
+// for debugging
+func (s DockerRunSpec) ShellCommand() string {
+	spec := s.ContainerSpec()
+	args := []string{"docker", "run", "-d", "--name", spec.Name}
+
+	if spec.Privileged {
+		args = append(args, "--privileged")
+	}
+	if spec.Runtime != "" {
+		args = append(args, "--runtime="+spec.Runtime)
+	}
+	if spec.OpenStdin {
+		args = append(args, "-i")
+	}
+	if spec.Tty {
+		args = append(args, "-t")
+	}
+	if spec.WorkingDir != "" {
+		args = append(args, "-w", spec.WorkingDir)
+	}
+	for _, env := range spec.Env {
+		args = append(args, "-e", env)
+	}
+	for _, mount := range spec.Mounts {
+		volume := mount.Source + ":" + mount.Target
+		if mount.ReadOnly {
+			volume += ":ro"
+		} else if mount.Propagation != "" {
+			volume += ":" + mount.Propagation
+		}
+		args = append(args, "-v", volume)
+	}
+	for _, port := range spec.Ports {
+		publish := strconv.Itoa(port.HostPort) + ":" + strconv.Itoa(port.ContainerPort)
+		if port.Protocol != "" {
+			publish += "/" + strings.ToLower(port.Protocol)
+		}
+		args = append(args, "-p", publish)
+	}
+	if spec.Resources.Memory != 0 {
+		args = append(args, "--memory", strconv.FormatInt(spec.Resources.Memory, 10)+"b")
+	}
+	if spec.Resources.NanoCPUs != 0 {
+		args = append(args, "--cpus", strconv.FormatFloat(float64(spec.Resources.NanoCPUs)/1e9, 'f', -1, 64))
+	}
+	if spec.NetworkMode != "" {
+		args = append(args, "--network="+spec.NetworkMode)
+	}
+	if spec.Pod != "" {
+		// native pods are a podman feature
+		args[0] = "podman"
+		args = append(args, "--pod", spec.Pod)
+	}
+	if spec.IpcMode != "" {
+		args = append(args, "--ipc="+spec.IpcMode)
+	}
+	if spec.PidMode != "" {
+		args = append(args, "--pid="+spec.PidMode)
+	}
+	if spec.User != "" {
+		args = append(args, "--user", spec.User)
+	}
+	if spec.ShmSize != 0 {
+		args = append(args, "--shm-size", strconv.FormatInt(spec.ShmSize, 10)+"b")
+	}
+	for _, capability := range spec.CapAdd {
+		args = append(args, "--cap-add", capability)
+	}
+	for _, capability := range spec.CapDrop {
+		args = append(args, "--cap-drop", capability)
+	}
+	for _, option := range spec.SecurityOpt {
+		args = append(args, "--security-opt", option)
+	}
+	for _, host := range spec.ExtraHosts {
+		args = append(args, "--add-host", host)
+	}
+
+	labelKeys := make([]string, 0, len(spec.Labels))
+	for key := range spec.Labels {
+		labelKeys = append(labelKeys, key)
+	}
+	sort.Strings(labelKeys)
+	for _, key := range labelKeys {
+		args = append(args, "--label", key+"="+spec.Labels[key])
+	}
+
+	// docker run only takes the first word of the entrypoint, the others go before the arguments
+	cmd := spec.Cmd
+	if len(spec.Entrypoint) > 0 {
+		args = append(args, "--entrypoint", spec.Entrypoint[0])
+		cmd = append(append([]string{}, spec.Entrypoint[1:]...), cmd...)
+	}
+
+	args = append(args, spec.Image)
+	args = append(args, cmd...)
+
+	quoted := make([]string, len(args))
+	for i, arg := range args {
+		quoted[i] = shellQuote(arg)
+	}
+	return strings.Join(quoted, " ")
+}
+
+// parseDockerOptions parses the docker run flags of the docker-options.vk.io/flags annotation.
+// Flags that cannot be expressed through the runtime are returned as unsupported.
+func parseDockerOptions(flags string) (DockerOptions, []string, error) {
+	options := DockerOptions{}
+	unsupported := []string{}
+
+	words := strings.Fields(flags)
+	for i := 0; i < len(words); i++ {
+		name, value, hasValue := strings.Cut(words[i], "=")
+
+		switch name {
+		case "-u", "--user", "--shm-size", "--cap-add", "--cap-drop", "--security-opt", "--add-host":
+		default:
+			unsupported = append(unsupported, words[i])
+			continue
+		}
+
+		if !hasValue {
+			if i+1 >= len(words) {
+				return options, unsupported, fmt.Errorf("docker option %s requires a value", name)
+			}
+			i++
+			value = words[i]
+		}
+
+		switch name {
+		case "-u", "--user":
+			options.User = value
+		case "--shm-size":
+			size, err := units.RAMInBytes(value)
+			if err != nil {
+				return options, unsupported, fmt.Errorf("invalid value %s for docker option --shm-size: %v", value, err)
+			}
+			options.ShmSize = size
+		case "--cap-add":
+			options.CapAdd = append(options.CapAdd, value)
+		case "--cap-drop":
+			options.CapDrop = append(options.CapDrop, value)
+		case "--security-opt":
+			options.SecurityOpt = append(options.SecurityOpt, value)
+		case "--add-host":
+			options.ExtraHosts = append(options.ExtraHosts, value)
+		}
+	}
+
+	return options, unsupported, nil
+}
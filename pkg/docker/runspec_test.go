@@ -0,0 +1,300 @@
+package docker
+
+import (
+	"encoding/json"
+	"flag"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	commonIL "github.com/intertwin-eu/interlink-docker-plugin/pkg/common"
+	"github.com/intertwin-eu/interlink-docker-plugin/pkg/docker/runtime"
+)
+
+var update = flag.Bool("update", false, "update the golden files in testdata")
+
+func goldenPod(name string, annotations map[string]string) v1.Pod {
+	return v1.Pod{ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default", UID: "uid-golden", Annotations: annotations}}
+}
+
+func prepareDockerRunsCases() map[string]commonIL.RetrievedPodData {
+	hostPathDirectory := v1.HostPathDirectory
+	privileged := true
+
+	basic := goldenPod("basic", nil)
+	basic.Spec.Volumes = []v1.Volume{{Name: "data", VolumeSource: v1.VolumeSource{HostPath: &v1.HostPathVolumeSource{Path: "/tmp", Type: &hostPathDirectory}}}}
+	basic.Spec.Containers = []v1.Container{{
+		Name:  "main",
+		Image: "busybox:1.36",
+		Env: []v1.EnvVar{
+			{Name: "GREETING", Value: "hello world"},
+			{Name: "QUOTED", Value: `it's "quoted"`},
+			{Name: "LIST", Value: "[a, b]"},
+			{Name: "EMPTY"},
+		},
+		VolumeMounts:    []v1.VolumeMount{{Name: "data", MountPath: "/data", ReadOnly: true}},
+		Ports:           []v1.ContainerPort{{ContainerPort: 8080, HostPort: 18080, Protocol: v1.ProtocolTCP}},
+		SecurityContext: &v1.SecurityContext{Privileged: &privileged},
+		Resources: v1.ResourceRequirements{Limits: v1.ResourceList{
+			v1.ResourceCPU:    resource.MustParse("500m"),
+			v1.ResourceMemory: resource.MustParse("256Mi"),
+		}},
+		WorkingDir:             "/work",
+		Stdin:                  true,
+		StdinOnce:              true,
+		TTY:                    true,
+		TerminationMessagePath: "/dev/termination-log",
+	}}
+
+	commands := goldenPod("commands", nil)
+	commands.Spec.InitContainers = []v1.Container{{Name: "init", Image: "busybox", Command: []string{"sh", "-c", "echo init"}}}
+	commands.Spec.Containers = []v1.Container{
+		{Name: "command-args", Image: "busybox", Command: []string{"echo"}, Args: []string{"a b", "c"}},
+		{
+			Name:    "expansion",
+			Image:   "busybox",
+			Env:     []v1.EnvVar{{Name: "NAME", Value: "world"}, {Name: "GREETING", Value: "hello $(NAME)"}},
+			Command: []string{"echo", "$(GREETING)"},
+			Args:    []string{"$$(GREETING)", "$(MISSING)", "$(date)", "it's $HOME"},
+		},
+		{Name: "args", Image: "busybox", Args: []string{"--flag", "value with spaces"}},
+	}
+
+	gpu := goldenPod("gpu", map[string]string{"docker-options.vk.io/flags": "--shm-size=1g --cap-add SYS_ADMIN --rm"})
+	gpu.Spec.Containers = []v1.Container{{
+		Name:  "cuda",
+		Image: "nvidia/cuda",
+		Resources: v1.ResourceRequirements{Limits: v1.ResourceList{
+			"nvidia.com/gpu": resource.MustParse("2"),
+		}},
+	}}
+
+	optional := true
+	env := goldenPod("env", nil)
+	env.Labels = map[string]string{"app": "web"}
+	env.Spec.NodeName = "interlink"
+	env.Spec.Containers = []v1.Container{{
+		Name:  "main",
+		Image: "busybox",
+		EnvFrom: []v1.EnvFromSource{
+			{ConfigMapRef: &v1.ConfigMapEnvSource{LocalObjectReference: v1.LocalObjectReference{Name: "settings"}}},
+			{Prefix: "DB_", SecretRef: &v1.SecretEnvSource{LocalObjectReference: v1.LocalObjectReference{Name: "credentials"}}},
+			{SecretRef: &v1.SecretEnvSource{LocalObjectReference: v1.LocalObjectReference{Name: "missing"}, Optional: &optional}},
+		},
+		Env: []v1.EnvVar{
+			{Name: "LOG_LEVEL", Value: "debug"},
+			{Name: "PASSWORD", ValueFrom: &v1.EnvVarSource{SecretKeyRef: &v1.SecretKeySelector{LocalObjectReference: v1.LocalObjectReference{Name: "credentials"}, Key: "password"}}},
+			{Name: "MODE", ValueFrom: &v1.EnvVarSource{ConfigMapKeyRef: &v1.ConfigMapKeySelector{LocalObjectReference: v1.LocalObjectReference{Name: "settings"}, Key: "mode"}}},
+			{Name: "UNSET", ValueFrom: &v1.EnvVarSource{ConfigMapKeyRef: &v1.ConfigMapKeySelector{LocalObjectReference: v1.LocalObjectReference{Name: "settings"}, Key: "unset", Optional: &optional}}},
+			{Name: "POD_NAME", ValueFrom: &v1.EnvVarSource{FieldRef: &v1.ObjectFieldSelector{FieldPath: "metadata.name"}}},
+			{Name: "POD_NAMESPACE", ValueFrom: &v1.EnvVarSource{FieldRef: &v1.ObjectFieldSelector{FieldPath: "metadata.namespace"}}},
+			{Name: "POD_UID", ValueFrom: &v1.EnvVarSource{FieldRef: &v1.ObjectFieldSelector{FieldPath: "metadata.uid"}}},
+			{Name: "APP", ValueFrom: &v1.EnvVarSource{FieldRef: &v1.ObjectFieldSelector{FieldPath: "metadata.labels['app']"}}},
+			{Name: "NODE_NAME", ValueFrom: &v1.EnvVarSource{FieldRef: &v1.ObjectFieldSelector{FieldPath: "spec.nodeName"}}},
+			{Name: "MEMORY_MB", ValueFrom: &v1.EnvVarSource{ResourceFieldRef: &v1.ResourceFieldSelector{Resource: "limits.memory", Divisor: resource.MustParse("1Mi")}}},
+			{Name: "CPUS", ValueFrom: &v1.EnvVarSource{ResourceFieldRef: &v1.ResourceFieldSelector{Resource: "limits.cpu"}}},
+		},
+		Resources: v1.ResourceRequirements{Limits: v1.ResourceList{
+			v1.ResourceCPU:    resource.MustParse("1500m"),
+			v1.ResourceMemory: resource.MustParse("512Mi"),
+		}},
+	}}
+	envContainers := []commonIL.RetrievedContainer{{
+		Name:       "main",
+		ConfigMaps: []v1.ConfigMap{{ObjectMeta: metav1.ObjectMeta{Name: "settings"}, Data: map[string]string{"mode": "fast", "THREADS": "4", "invalid=key": "x"}}},
+		Secrets:    []v1.Secret{{ObjectMeta: metav1.ObjectMeta{Name: "credentials"}, Data: map[string][]byte{"password": []byte("s3cr3t"), "USER": []byte("admin")}}},
+	}}
+
+	return map[string]commonIL.RetrievedPodData{
+		"basic":    {Pod: basic},
+		"commands": {Pod: commands},
+		"gpu":      {Pod: gpu},
+		"env":      {Pod: env, Containers: envContainers},
+	}
+}
+
+func checkGolden(t *testing.T, name string, actual string) {
+	t.Helper()
+
+	path := filepath.Join("testdata", name+".golden")
+	if *update {
+		if err := os.WriteFile(path, []byte(actual), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+
+	expected, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(expected) != actual {
+		t.Errorf("%s does not match the golden file:\n--- expected\n%s\n--- actual\n%s", name, expected, actual)
+	}
+}
+
+func TestPrepareDockerRunsGolden(t *testing.T) {
+	for name, podData := range prepareDockerRunsCases() {
+		t.Run(name, func(t *testing.T) {
+			h, _ := newTestHandler(t)
+			// the temporary directory holding the data root is masked in the golden files
+			dataRoot, err := commonIL.DataRootPath(h.Config)
+			if err != nil {
+				t.Fatal(err)
+			}
+			testWd := filepath.Dir(dataRoot)
+
+			runSpecs, err := h.prepareDockerRuns(podData, httptest.NewRecorder())
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			script := ""
+			var containerSpecs []interface{}
+			for _, runSpec := range runSpecs {
+				script += runSpec.ShellCommand() + "\n"
+				containerSpecs = append(containerSpecs, runSpec.ContainerSpec())
+			}
+			specsJSON, err := json.MarshalIndent(containerSpecs, "", "  ")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			checkGolden(t, name+".sh", strings.ReplaceAll(script, testWd, "$WD"))
+			checkGolden(t, name+".json", strings.ReplaceAll(string(specsJSON), testWd, "$WD")+"\n")
+		})
+	}
+}
+
+func TestParseDockerOptions(t *testing.T) {
+	options, unsupported, err := parseDockerOptions("--user=1000 --shm-size 64m --cap-drop ALL --security-opt=no-new-privileges --add-host db:10.0.0.2 --rm")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if options.User != "1000" || options.ShmSize != 64*1024*1024 || options.CapDrop[0] != "ALL" || options.SecurityOpt[0] != "no-new-privileges" || options.ExtraHosts[0] != "db:10.0.0.2" {
+		t.Errorf("unexpected options %+v", options)
+	}
+	if len(unsupported) != 1 || unsupported[0] != "--rm" {
+		t.Errorf("expected --rm to be unsupported, got %v", unsupported)
+	}
+
+	if _, _, err := parseDockerOptions("--cap-add"); err == nil {
+		t.Error("expected an error for a flag without value")
+	}
+}
+
+func TestShellQuote(t *testing.T) {
+	for word, expected := range map[string]string{
+		"plain":          "plain",
+		"KEY=/a/b:c":     "KEY=/a/b:c",
+		"two words":      "'two words'",
+		`it's`:           `'it'"'"'s'`,
+		"$(not-a-subst)": "'$(not-a-subst)'",
+	} {
+		if actual := shellQuote(word); actual != expected {
+			t.Errorf("shellQuote(%q) = %s, expected %s", word, actual, expected)
+		}
+	}
+}
+
+func TestDindResources(t *testing.T) {
+	config := commonIL.InterLinkConfig{DindCPUOverhead: "100m", DindMemoryOverhead: "256Mi"}
+	limited := func(memory int64, nanoCPUs int64, isInitContainer bool) DockerRunSpec {
+		return DockerRunSpec{IsInitContainer: isInitContainer, Resources: runtime.Resources{Memory: memory, NanoCPUs: nanoCPUs}}
+	}
+
+	for name, testCase := range map[string]struct {
+		runSpecs []DockerRunSpec
+		expected runtime.Resources
+	}{
+		"sum of containers": {
+			runSpecs: []DockerRunSpec{limited(1<<30, 1e9, false), limited(1<<30, 5e8, false)},
+			expected: runtime.Resources{Memory: 2<<30 + 256<<20, NanoCPUs: 1.6e9},
+		},
+		"larger init container": {
+			runSpecs: []DockerRunSpec{limited(4<<30, 1e8, true), limited(1<<30, 1e9, false)},
+			expected: runtime.Resources{Memory: 4<<30 + 256<<20, NanoCPUs: 1.1e9},
+		},
+		"init containers run one at a time": {
+			runSpecs: []DockerRunSpec{limited(2<<30, 1e9, true), limited(1<<30, 5e8, true), limited(512<<20, 1e8, false)},
+			expected: runtime.Resources{Memory: 2<<30 + 256<<20, NanoCPUs: 1.1e9},
+		},
+		"sidecar": {
+			runSpecs: []DockerRunSpec{limited(2<<30, 1e8, true), {IsInitContainer: true, IsSidecar: true, Resources: runtime.Resources{Memory: 1 << 30, NanoCPUs: 1e8}}, limited(1<<30, 1e9, false)},
+			expected: runtime.Resources{Memory: 2<<30 + 256<<20, NanoCPUs: 1.2e9},
+		},
+		"init container after a sidecar": {
+			runSpecs: []DockerRunSpec{{IsInitContainer: true, IsSidecar: true, Resources: runtime.Resources{Memory: 1 << 30, NanoCPUs: 1e8}}, limited(2<<30, 1e8, true), limited(1<<30, 1e9, false)},
+			expected: runtime.Resources{Memory: 3<<30 + 256<<20, NanoCPUs: 1.2e9},
+		},
+		"unlimited container": {
+			runSpecs: []DockerRunSpec{limited(1<<30, 0, false), limited(1<<30, 1e9, false)},
+			expected: runtime.Resources{Memory: 2<<30 + 256<<20},
+		},
+		"unlimited init container": {
+			runSpecs: []DockerRunSpec{limited(0, 1e9, true), limited(1<<30, 1e9, false)},
+			expected: runtime.Resources{NanoCPUs: 1.1e9},
+		},
+	} {
+		actual, err := dindResources(config, testCase.runSpecs)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if actual != testCase.expected {
+			t.Errorf("%s: expected %+v, got %+v", name, testCase.expected, actual)
+		}
+	}
+
+	if _, err := dindResources(commonIL.InterLinkConfig{DindMemoryOverhead: "lots"}, []DockerRunSpec{limited(1<<30, 0, false)}); err == nil {
+		t.Error("expected an error for an invalid overhead")
+	}
+	if parent := dindCgroupParent(commonIL.InterLinkConfig{DindCgroupParent: "/interlink/{namespace}"}, "team-a"); parent != "/interlink/team-a" {
+		t.Errorf("unexpected cgroup parent %s", parent)
+	}
+}
+
+func TestContainerCommand(t *testing.T) {
+	for _, test := range []struct {
+		name       string
+		command    []string
+		args       []string
+		entrypoint []string
+		cmd        []string
+	}{
+		// the entrypoint and the cmd of the image apply
+		{name: "image defaults"},
+		// the cmd of the image is ignored
+		{name: "command", command: []string{"/app/server", "--port=80"}, entrypoint: []string{"/app/server", "--port=80"}},
+		// the entrypoint of the image runs with the args
+		{name: "args", args: []string{"--config", "/etc/app config.yaml"}, cmd: []string{"--config", "/etc/app config.yaml"}},
+		{name: "command and args", command: []string{"sh", "-c"}, args: []string{`echo "$HOME" 'quoted' $(NAME)`}, entrypoint: []string{"sh", "-c"}, cmd: []string{`echo "$HOME" 'quoted' value`}},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			h, _ := newTestHandler(t)
+			pod := testPod("1")
+			pod.Spec.Containers = []v1.Container{{Name: "main", Image: "distroless", Command: test.command, Args: test.args, Env: []v1.EnvVar{{Name: "NAME", Value: "value"}}}}
+
+			runSpecs, err := h.prepareDockerRuns(commonIL.RetrievedPodData{Pod: *pod}, httptest.NewRecorder())
+			if err != nil {
+				t.Fatal(err)
+			}
+			spec := runSpecs[0].ContainerSpec()
+			if !slices.Equal(spec.Entrypoint, test.entrypoint) || (spec.Entrypoint == nil) != (test.entrypoint == nil) {
+				t.Errorf("expected the entrypoint %q, got %q", test.entrypoint, spec.Entrypoint)
+			}
+			if !slices.Equal(spec.Cmd, test.cmd) || (spec.Cmd == nil) != (test.cmd == nil) {
+				t.Errorf("expected the cmd %q, got %q", test.cmd, spec.Cmd)
+			}
+			if len(spec.Mounts) != 0 {
+				t.Errorf("expected no wrapper script to be mounted, got %v", spec.Mounts)
+			}
+		})
+	}
+}
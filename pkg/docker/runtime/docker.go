@@ -0,0 +1,401 @@
+package runtime
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/docker/docker/api/types/image"
+	"github.com/docker/docker/api/types/mount"
+	"github.com/docker/docker/client"
+	"github.com/docker/docker/errdefs"
+	"github.com/docker/docker/pkg/stdcopy"
+	"github.com/docker/go-connections/nat"
+)
+
+// DockerRuntime implements ContainerRuntime on top of the Docker Engine API client
+type DockerRuntime struct {
+	cli *client.Client
+
+	innerMutex sync.Mutex
+	inner      map[string]*DockerRuntime
+}
+
+// NewDockerRuntime returns a DockerRuntime configured from the DOCKER_* environment variables, like the docker CLI.
+// Additional client options override the environment.
+func NewDockerRuntime(opts ...client.Opt) (*DockerRuntime, error) {
+	opts = append([]client.Opt{client.FromEnv, client.WithAPIVersionNegotiation()}, opts...)
+	cli, err := client.NewClientWithOpts(opts...)
+	if err != nil {
+		return nil, err
+	}
+	return &DockerRuntime{cli: cli, inner: map[string]*DockerRuntime{}}, nil
+}
+
+func wrapError(op string, target string, err error) error {
+	if err == nil {
+		return nil
+	}
+	var kind error
+	switch {
+	case errdefs.IsNotFound(err):
+		kind = ErrNotFound
+	case errdefs.IsConflict(err):
+		kind = ErrConflict
+	case client.IsErrConnectionFailed(err), errdefs.IsUnavailable(err):
+		kind = ErrUnavailable
+	}
+	return &Error{Op: op, Target: target, Kind: kind, Err: err}
+}
+
+func (r *DockerRuntime) Ping(ctx context.Context) error {
+	_, err := r.cli.Ping(ctx)
+	return wrapError("ping", r.cli.DaemonHost(), err)
+}
+
+func (r *DockerRuntime) CreateContainer(ctx context.Context, spec ContainerSpec) (string, error) {
+	config := &container.Config{
+		Image:      spec.Image,
+		Entrypoint: spec.Entrypoint,
+		Cmd:        spec.Cmd,
+		Env:        spec.Env,
+		Labels:     spec.Labels,
+		User:       spec.User,
+		WorkingDir: spec.WorkingDir,
+		OpenStdin:  spec.OpenStdin,
+		StdinOnce:  spec.StdinOnce,
+		Tty:        spec.Tty,
+	}
+
+	hostConfig := &container.HostConfig{
+		NetworkMode: container.NetworkMode(spec.NetworkMode),
+		IpcMode:     container.IpcMode(spec.IpcMode),
+		PidMode:     container.PidMode(spec.PidMode),
+		Privileged:  spec.Privileged,
+		Runtime:     spec.Runtime,
+		ShmSize:     spec.ShmSize,
+		CapAdd:      spec.CapAdd,
+		CapDrop:     spec.CapDrop,
+		SecurityOpt: spec.SecurityOpt,
+		ExtraHosts:  spec.ExtraHosts,
+		Resources: container.Resources{
+			Memory:       spec.Resources.Memory,
+			NanoCPUs:     spec.Resources.NanoCPUs,
+			CgroupParent: spec.CgroupParent,
+		},
+	}
+	for _, binding := range spec.Ports {
+		protocol := strings.ToLower(binding.Protocol)
+		if protocol == "" {
+			protocol = "tcp"
+		}
+		port, err := nat.NewPort(protocol, strconv.Itoa(binding.ContainerPort))
+		if err != nil {
+			return "", &Error{Op: "container create", Target: spec.Name, Err: err}
+		}
+		if config.ExposedPorts == nil {
+			config.ExposedPorts = nat.PortSet{}
+			hostConfig.PortBindings = nat.PortMap{}
+		}
+		config.ExposedPorts[port] = struct{}{}
+		hostPort := ""
+		if binding.HostPort != 0 {
+			hostPort = strconv.Itoa(binding.HostPort)
+		}
+		hostConfig.PortBindings[port] = append(hostConfig.PortBindings[port], nat.PortBinding{HostIP: binding.HostIP, HostPort: hostPort})
+	}
+	for _, m := range spec.Mounts {
+		bind := mount.Mount{Type: mount.TypeBind, Source: m.Source, Target: m.Target, ReadOnly: m.ReadOnly}
+		if m.Propagation != "" {
+			bind.BindOptions = &mount.BindOptions{Propagation: mount.Propagation(m.Propagation)}
+		}
+		hostConfig.Mounts = append(hostConfig.Mounts, bind)
+	}
+
+	resp, err := r.cli.ContainerCreate(ctx, config, hostConfig, nil, nil, spec.Name)
+	if err != nil && errdefs.IsNotFound(err) {
+		// like docker run, pull the image if it is not present yet and try again
+		err = r.pullImage(ctx, spec.Image)
+		if err != nil {
+			return "", err
+		}
+		resp, err = r.cli.ContainerCreate(ctx, config, hostConfig, nil, nil, spec.Name)
+	}
+	if err != nil {
+		return "", wrapError("container create", spec.Name, err)
+	}
+	return resp.ID, nil
+}
+
+func (r *DockerRuntime) PullImage(ctx context.Context, ref string, always bool) error {
+	if !always {
+		_, _, err := r.cli.ImageInspectWithRaw(ctx, ref)
+		if err == nil {
+			return nil
+		} else if !errdefs.IsNotFound(err) {
+			return wrapError("image inspect", ref, err)
+		}
+	}
+	return r.pullImage(ctx, ref)
+}
+
+func (r *DockerRuntime) pullImage(ctx context.Context, ref string) error {
+	reader, err := r.cli.ImagePull(ctx, ref, image.PullOptions{})
+	if err != nil {
+		return imagePullError(wrapError("image pull", ref, err))
+	}
+	defer reader.Close()
+
+	// the pull is complete only when the progress stream has been consumed
+	_, err = io.Copy(io.Discard, reader)
+	return imagePullError(wrapError("image pull", ref, err))
+}
+
+func (r *DockerRuntime) StartContainer(ctx context.Context, id string) error {
+	return wrapError("container start", id, r.cli.ContainerStart(ctx, id, container.StartOptions{}))
+}
+
+func (r *DockerRuntime) StopContainer(ctx context.Context, id string, timeout time.Duration) error {
+	seconds := int(timeout.Seconds())
+	return wrapError("container stop", id, r.cli.ContainerStop(ctx, id, container.StopOptions{Timeout: &seconds}))
+}
+
+func (r *DockerRuntime) RemoveContainer(ctx context.Context, id string, force bool) error {
+	return wrapError("container remove", id, r.cli.ContainerRemove(ctx, id, container.RemoveOptions{Force: force}))
+}
+
+func (r *DockerRuntime) RenameContainer(ctx context.Context, id string, newName string) error {
+	return wrapError("container rename", id, r.cli.ContainerRename(ctx, id, newName))
+}
+
+func (r *DockerRuntime) UpdateContainerResources(ctx context.Context, id string, resources Resources) error {
+	update := container.UpdateConfig{Resources: container.Resources{Memory: resources.Memory, NanoCPUs: resources.NanoCPUs}}
+	if resources.Memory != 0 {
+		// without swap, the memory limit is the limit of the whole container
+		update.Resources.MemorySwap = resources.Memory
+	}
+	_, err := r.cli.ContainerUpdate(ctx, id, update)
+	return wrapError("container update", id, err)
+}
+
+func parseTime(value string) time.Time {
+	t, err := time.Parse(time.RFC3339Nano, value)
+	if err != nil || t.Year() <= 1 {
+		return time.Time{}
+	}
+	return t
+}
+
+func (r *DockerRuntime) InspectContainer(ctx context.Context, id string) (ContainerInfo, error) {
+	inspect, err := r.cli.ContainerInspect(ctx, id)
+	if err != nil {
+		return ContainerInfo{}, wrapError("container inspect", id, err)
+	}
+
+	info := ContainerInfo{
+		ID:       inspect.ID,
+		Name:     strings.TrimPrefix(inspect.Name, "/"),
+		ImageID:  inspect.Image,
+		Networks: map[string]string{},
+	}
+	if inspect.Config != nil {
+		info.Image = inspect.Config.Image
+		info.Labels = inspect.Config.Labels
+		info.Env = inspect.Config.Env
+	}
+	if inspect.State != nil {
+		info.State = ContainerState{
+			Status:     inspect.State.Status,
+			Running:    inspect.State.Running,
+			ExitCode:   inspect.State.ExitCode,
+			OOMKilled:  inspect.State.OOMKilled,
+			Error:      inspect.State.Error,
+			StartedAt:  parseTime(inspect.State.StartedAt),
+			FinishedAt: parseTime(inspect.State.FinishedAt),
+		}
+	}
+	for _, m := range inspect.Mounts {
+		info.Mounts = append(info.Mounts, Mount{Source: m.Source, Target: m.Destination, ReadOnly: !m.RW, Propagation: string(m.Propagation)})
+	}
+	if inspect.NetworkSettings != nil {
+		for name, endpoint := range inspect.NetworkSettings.Networks {
+			info.Networks[name] = endpoint.IPAddress
+		}
+	}
+	return info, nil
+}
+
+func labelFilters(opts ListOptions) filters.Args {
+	args := filters.NewArgs()
+	for k, v := range opts.Labels {
+		if v == "" {
+			args.Add("label", k)
+		} else {
+			args.Add("label", k+"="+v)
+		}
+	}
+	return args
+}
+
+func (r *DockerRuntime) ListContainers(ctx context.Context, opts ListOptions) ([]ContainerInfo, error) {
+	containers, err := r.cli.ContainerList(ctx, container.ListOptions{All: opts.All, Filters: labelFilters(opts)})
+	if err != nil {
+		return nil, wrapError("container list", r.cli.DaemonHost(), err)
+	}
+
+	var infos []ContainerInfo
+	for _, c := range containers {
+		info := ContainerInfo{
+			ID:      c.ID,
+			Image:   c.Image,
+			ImageID: c.ImageID,
+			Labels:  c.Labels,
+			State:   ContainerState{Status: c.State, Running: c.State == "running"},
+		}
+		if len(c.Names) > 0 {
+			info.Name = strings.TrimPrefix(c.Names[0], "/")
+		}
+		infos = append(infos, info)
+	}
+	return infos, nil
+}
+
+func (r *DockerRuntime) ContainerLogs(ctx context.Context, id string, opts LogOptions) ([]byte, error) {
+	inspect, err := r.cli.ContainerInspect(ctx, id)
+	if err != nil {
+		return nil, wrapError("container logs", id, err)
+	}
+
+	logsOptions := container.LogsOptions{ShowStdout: true, ShowStderr: true, Timestamps: opts.Timestamps}
+	if opts.Tail > 0 {
+		logsOptions.Tail = strconv.Itoa(opts.Tail)
+	}
+	if !opts.Since.IsZero() {
+		logsOptions.Since = opts.Since.Format(time.RFC3339Nano)
+	}
+
+	reader, err := r.cli.ContainerLogs(ctx, id, logsOptions)
+	if err != nil {
+		return nil, wrapError("container logs", id, err)
+	}
+	defer reader.Close()
+
+	var output bytes.Buffer
+	if inspect.Config != nil && inspect.Config.Tty {
+		// logs of a TTY container are a raw stream, not multiplexed
+		_, err = io.Copy(&output, reader)
+	} else {
+		_, err = stdcopy.StdCopy(&output, &output, reader)
+	}
+	if err != nil {
+		return nil, wrapError("container logs", id, err)
+	}
+	return output.Bytes(), nil
+}
+
+func (r *DockerRuntime) Exec(ctx context.Context, id string, cmd []string) (ExecResult, error) {
+	exec, err := r.cli.ContainerExecCreate(ctx, id, types.ExecConfig{Cmd: cmd, AttachStdout: true, AttachStderr: true})
+	if err != nil {
+		return ExecResult{}, wrapError("exec create", id, err)
+	}
+
+	attach, err := r.cli.ContainerExecAttach(ctx, exec.ID, types.ExecStartCheck{})
+	if err != nil {
+		return ExecResult{}, wrapError("exec attach", id, err)
+	}
+	defer attach.Close()
+
+	// the hijacked connection ignores ctx once established, it is closed to stop reading when ctx is done
+	copied := make(chan struct{})
+	defer close(copied)
+	go func() {
+		select {
+		case <-ctx.Done():
+			attach.Close()
+		case <-copied:
+		}
+	}()
+
+	var stdout, stderr bytes.Buffer
+	_, err = stdcopy.StdCopy(&stdout, &stderr, attach.Reader)
+	if ctx.Err() != nil {
+		return ExecResult{}, &Error{Op: "exec", Target: id, Err: ctx.Err()}
+	}
+	if err != nil {
+		return ExecResult{}, wrapError("exec", id, err)
+	}
+
+	inspect, err := r.cli.ContainerExecInspect(ctx, exec.ID)
+	if err != nil {
+		return ExecResult{}, wrapError("exec inspect", id, err)
+	}
+	return ExecResult{ExitCode: inspect.ExitCode, Stdout: stdout.String(), Stderr: stderr.String()}, nil
+}
+
+func (r *DockerRuntime) CreateNetwork(ctx context.Context, name string, labels map[string]string) (string, error) {
+	resp, err := r.cli.NetworkCreate(ctx, name, types.NetworkCreate{Driver: "bridge", Labels: labels})
+	if err != nil {
+		return "", wrapError("network create", name, err)
+	}
+	return resp.ID, nil
+}
+
+func (r *DockerRuntime) InspectNetwork(ctx context.Context, id string) (NetworkInfo, error) {
+	network, err := r.cli.NetworkInspect(ctx, id, types.NetworkInspectOptions{})
+	if err != nil {
+		return NetworkInfo{}, wrapError("network inspect", id, err)
+	}
+	return NetworkInfo{ID: network.ID, Name: network.Name, Driver: network.Driver, Labels: network.Labels}, nil
+}
+
+func (r *DockerRuntime) RemoveNetwork(ctx context.Context, id string) error {
+	return wrapError("network remove", id, r.cli.NetworkRemove(ctx, id))
+}
+
+func (r *DockerRuntime) ListNetworks(ctx context.Context, opts ListOptions) ([]NetworkInfo, error) {
+	networks, err := r.cli.NetworkList(ctx, types.NetworkListOptions{Filters: labelFilters(opts)})
+	if err != nil {
+		return nil, wrapError("network list", r.cli.DaemonHost(), err)
+	}
+
+	var infos []NetworkInfo
+	for _, network := range networks {
+		infos = append(infos, NetworkInfo{ID: network.ID, Name: network.Name, Driver: network.Driver, Labels: network.Labels})
+	}
+	return infos, nil
+}
+
+func (r *DockerRuntime) Inner(endpoint string) (ContainerRuntime, error) {
+	r.innerMutex.Lock()
+	defer r.innerMutex.Unlock()
+
+	if inner, ok := r.inner[endpoint]; ok {
+		return inner, nil
+	}
+
+	cli, err := client.NewClientWithOpts(client.WithHost(endpoint), client.WithAPIVersionNegotiation())
+	if err != nil {
+		return nil, wrapError("connect", endpoint, err)
+	}
+	inner := &DockerRuntime{cli: cli, inner: map[string]*DockerRuntime{}}
+	r.inner[endpoint] = inner
+	return inner, nil
+}
+
+func (r *DockerRuntime) Forget(endpoint string) {
+	r.innerMutex.Lock()
+	inner, ok := r.inner[endpoint]
+	delete(r.inner, endpoint)
+	r.innerMutex.Unlock()
+
+	if ok {
+		inner.cli.Close()
+	}
+}
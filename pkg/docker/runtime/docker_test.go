@@ -0,0 +1,55 @@
+package runtime
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/client"
+)
+
+func TestDockerExecTimeout(t *testing.T) {
+	// a daemon whose exec never ends: the attached stream stays open without output
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case strings.HasSuffix(r.URL.Path, "/containers/main/exec"):
+			writeJSON(w, http.StatusCreated, map[string]string{"Id": "exec-1"})
+		case strings.HasSuffix(r.URL.Path, "/exec/exec-1/start"):
+			conn, buf, err := w.(http.Hijacker).Hijack()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+			buf.WriteString("HTTP/1.1 101 UPGRADED\r\nContent-Type: application/vnd.docker.raw-stream\r\nConnection: Upgrade\r\nUpgrade: tcp\r\n\r\n")
+			buf.Flush()
+			<-release
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+	defer close(release)
+
+	cli, err := client.NewClientWithOpts(client.WithHost("tcp://" + server.Listener.Addr().String()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cli.Close()
+	r := &DockerRuntime{cli: cli, inner: map[string]*DockerRuntime{}}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err = r.Exec(ctx, "main", []string{"sleep", "infinity"})
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected the exec to time out, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("expected the exec to end at its deadline, took %s", elapsed)
+	}
+}
@@ -0,0 +1,437 @@
+package runtime
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// FakeRuntime is an in-memory ContainerRuntime used to unit-test the handlers and the DIND manager without a Docker daemon.
+// Containers are started as running and stay so until SetState is called.
+type FakeRuntime struct {
+	mutex      sync.Mutex
+	counter    int
+	containers map[string]*fakeContainer
+	networks   map[string]*NetworkInfo
+	inner      map[string]*FakeRuntime
+	pullErrors map[string]error
+
+	// ExecFunc, if set, computes the result of Exec calls
+	ExecFunc func(id string, cmd []string) ExecResult
+	// PingErr, if set, is returned by Ping
+	PingErr error
+	// PingHangs makes Ping wait for its context to be done, as with a daemon that does not answer
+	PingHangs bool
+	// Calls records every mutating call as "op target", in order
+	Calls []string
+}
+
+type fakeContainer struct {
+	info ContainerInfo
+	spec ContainerSpec
+	logs []byte
+}
+
+// NewFakeRuntime returns an empty FakeRuntime
+func NewFakeRuntime() *FakeRuntime {
+	return &FakeRuntime{
+		containers: map[string]*fakeContainer{},
+		networks:   map[string]*NetworkInfo{},
+		inner:      map[string]*FakeRuntime{},
+		pullErrors: map[string]error{},
+	}
+}
+
+func notFound(op string, target string) error {
+	return &Error{Op: op, Target: target, Kind: ErrNotFound, Err: errors.New("no such object: " + target)}
+}
+
+func (f *FakeRuntime) nextID() string {
+	f.counter++
+	return fmt.Sprintf("%064x", f.counter)
+}
+
+func (f *FakeRuntime) record(op string, target string) {
+	f.Calls = append(f.Calls, op+" "+target)
+}
+
+func (f *FakeRuntime) lookupContainer(id string) *fakeContainer {
+	if c, ok := f.containers[id]; ok {
+		return c
+	}
+	for _, c := range f.containers {
+		if c.info.Name == id {
+			return c
+		}
+	}
+	return nil
+}
+
+func (f *FakeRuntime) Ping(ctx context.Context) error {
+	f.mutex.Lock()
+	pingErr, pingHangs := f.PingErr, f.PingHangs
+	f.mutex.Unlock()
+
+	if pingHangs {
+		<-ctx.Done()
+		return &Error{Op: "ping", Target: "fake", Kind: ErrUnavailable, Err: ctx.Err()}
+	}
+	return pingErr
+}
+
+func (f *FakeRuntime) PullImage(ctx context.Context, ref string, always bool) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	f.record("pull", ref)
+	if err, ok := f.pullErrors[ref]; ok {
+		return &Error{Op: "image pull", Target: ref, Kind: ErrImagePull, Err: err}
+	}
+	return nil
+}
+
+func (f *FakeRuntime) CreateContainer(ctx context.Context, spec ContainerSpec) (string, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	if spec.Name != "" && f.lookupContainer(spec.Name) != nil {
+		return "", &Error{Op: "container create", Target: spec.Name, Kind: ErrConflict, Err: errors.New("name already in use")}
+	}
+	if err, ok := f.pullErrors[spec.Image]; ok {
+		f.record("pull", spec.Image)
+		return "", &Error{Op: "image pull", Target: spec.Image, Kind: ErrImagePull, Err: err}
+	}
+	id := f.nextID()
+	f.record("create", spec.Name)
+	f.containers[id] = &fakeContainer{
+		spec: spec,
+		info: ContainerInfo{
+			ID:       id,
+			Name:     spec.Name,
+			Image:    spec.Image,
+			ImageID:  "sha256:" + id,
+			Labels:   spec.Labels,
+			Env:      spec.Env,
+			Mounts:   spec.Mounts,
+			Networks: map[string]string{},
+			State:    ContainerState{Status: "created"},
+		},
+	}
+	// like the engine, a container is attached to the user-defined network it is created in
+	if spec.NetworkMode != "" && spec.NetworkMode != "host" && spec.NetworkMode != "none" && !strings.HasPrefix(spec.NetworkMode, "container:") {
+		f.containers[id].info.Networks[spec.NetworkMode] = ""
+	}
+	return id, nil
+}
+
+func (f *FakeRuntime) StartContainer(ctx context.Context, id string) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	c := f.lookupContainer(id)
+	if c == nil {
+		return notFound("container start", id)
+	}
+	f.record("start", c.info.Name)
+	c.info.State = ContainerState{Status: "running", Running: true, StartedAt: time.Now()}
+	return nil
+}
+
+func (f *FakeRuntime) StopContainer(ctx context.Context, id string, timeout time.Duration) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	c := f.lookupContainer(id)
+	if c == nil {
+		return notFound("container stop", id)
+	}
+	f.record("stop", c.info.Name)
+	if c.info.State.Running {
+		c.info.State = ContainerState{Status: "exited", ExitCode: 143, StartedAt: c.info.State.StartedAt, FinishedAt: time.Now()}
+	}
+	return nil
+}
+
+func (f *FakeRuntime) RemoveContainer(ctx context.Context, id string, force bool) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	c := f.lookupContainer(id)
+	if c == nil {
+		return notFound("container remove", id)
+	}
+	if c.info.State.Running && !force {
+		return &Error{Op: "container remove", Target: id, Kind: ErrConflict, Err: errors.New("container is running")}
+	}
+	f.record("remove", c.info.Name)
+	delete(f.containers, c.info.ID)
+	return nil
+}
+
+func (f *FakeRuntime) RenameContainer(ctx context.Context, id string, newName string) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	c := f.lookupContainer(id)
+	if c == nil {
+		return notFound("container rename", id)
+	}
+	if f.lookupContainer(newName) != nil {
+		return &Error{Op: "container rename", Target: id, Kind: ErrConflict, Err: errors.New("name already in use")}
+	}
+	f.record("rename", c.info.Name+" "+newName)
+	c.info.Name = newName
+	return nil
+}
+
+func (f *FakeRuntime) InspectContainer(ctx context.Context, id string) (ContainerInfo, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	c := f.lookupContainer(id)
+	if c == nil {
+		return ContainerInfo{}, notFound("container inspect", id)
+	}
+	return c.info, nil
+}
+
+func (f *FakeRuntime) ListContainers(ctx context.Context, opts ListOptions) ([]ContainerInfo, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	var infos []ContainerInfo
+	for _, c := range f.containers {
+		if !opts.All && !c.info.State.Running {
+			continue
+		}
+		if !matchLabels(c.info.Labels, opts.Labels) {
+			continue
+		}
+		infos = append(infos, c.info)
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].ID < infos[j].ID })
+	return infos, nil
+}
+
+func (f *FakeRuntime) ContainerLogs(ctx context.Context, id string, opts LogOptions) ([]byte, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	c := f.lookupContainer(id)
+	if c == nil {
+		return nil, notFound("container logs", id)
+	}
+	logs := c.logs
+	if opts.Tail > 0 {
+		lines := strings.SplitAfter(string(logs), "\n")
+		if lines[len(lines)-1] == "" {
+			lines = lines[:len(lines)-1]
+		}
+		if opts.Tail < len(lines) {
+			lines = lines[len(lines)-opts.Tail:]
+		}
+		logs = []byte(strings.Join(lines, ""))
+	}
+	return logs, nil
+}
+
+func (f *FakeRuntime) Exec(ctx context.Context, id string, cmd []string) (ExecResult, error) {
+	f.mutex.Lock()
+	c := f.lookupContainer(id)
+	if c == nil {
+		f.mutex.Unlock()
+		return ExecResult{}, notFound("exec create", id)
+	}
+	if !c.info.State.Running {
+		f.mutex.Unlock()
+		return ExecResult{}, &Error{Op: "exec create", Target: id, Kind: ErrConflict, Err: errors.New("container is not running")}
+	}
+	f.record("exec", c.info.Name+" "+strings.Join(cmd, " "))
+	execFunc := f.ExecFunc
+	f.mutex.Unlock()
+
+	if execFunc == nil {
+		return ExecResult{}, nil
+	}
+	// like the real runtimes, the exec is abandoned once ctx is done
+	result := make(chan ExecResult, 1)
+	go func() {
+		result <- execFunc(id, cmd)
+	}()
+	select {
+	case <-ctx.Done():
+		return ExecResult{}, &Error{Op: "exec", Target: id, Err: ctx.Err()}
+	case r := <-result:
+		return r, nil
+	}
+}
+
+func (f *FakeRuntime) CreateNetwork(ctx context.Context, name string, labels map[string]string) (string, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	for _, n := range f.networks {
+		if n.Name == name {
+			return "", &Error{Op: "network create", Target: name, Kind: ErrConflict, Err: errors.New("network already exists")}
+		}
+	}
+	id := f.nextID()
+	f.record("network create", name)
+	f.networks[id] = &NetworkInfo{ID: id, Name: name, Driver: "bridge", Labels: labels}
+	return id, nil
+}
+
+func (f *FakeRuntime) lookupNetwork(id string) *NetworkInfo {
+	if n, ok := f.networks[id]; ok {
+		return n
+	}
+	for _, n := range f.networks {
+		if n.Name == id {
+			return n
+		}
+	}
+	return nil
+}
+
+func (f *FakeRuntime) InspectNetwork(ctx context.Context, id string) (NetworkInfo, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	n := f.lookupNetwork(id)
+	if n == nil {
+		return NetworkInfo{}, notFound("network inspect", id)
+	}
+	return *n, nil
+}
+
+func (f *FakeRuntime) RemoveNetwork(ctx context.Context, id string) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	n := f.lookupNetwork(id)
+	if n == nil {
+		return notFound("network remove", id)
+	}
+	f.record("network remove", n.Name)
+	delete(f.networks, n.ID)
+	return nil
+}
+
+func (f *FakeRuntime) ListNetworks(ctx context.Context, opts ListOptions) ([]NetworkInfo, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	var infos []NetworkInfo
+	for _, n := range f.networks {
+		if matchLabels(n.Labels, opts.Labels) {
+			infos = append(infos, *n)
+		}
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].ID < infos[j].ID })
+	return infos, nil
+}
+
+func (f *FakeRuntime) Inner(endpoint string) (ContainerRuntime, error) {
+	return f.InnerFake(endpoint), nil
+}
+
+// InnerFake returns the FakeRuntime standing for the daemon at endpoint, creating it if needed
+func (f *FakeRuntime) InnerFake(endpoint string) *FakeRuntime {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	if inner, ok := f.inner[endpoint]; ok {
+		return inner
+	}
+	inner := NewFakeRuntime()
+	f.inner[endpoint] = inner
+	return inner
+}
+
+func (f *FakeRuntime) Forget(endpoint string) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	delete(f.inner, endpoint)
+}
+
+func (f *FakeRuntime) UpdateContainerResources(ctx context.Context, id string, resources Resources) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	c := f.lookupContainer(id)
+	if c == nil {
+		return notFound("container update", id)
+	}
+	f.record("update", c.info.Name)
+	c.spec.Resources = resources
+	return nil
+}
+
+// Spec returns the spec a container was created with, and the resources it was updated with
+func (f *FakeRuntime) Spec(id string) (ContainerSpec, bool) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	c := f.lookupContainer(id)
+	if c == nil {
+		return ContainerSpec{}, false
+	}
+	return c.spec, true
+}
+
+// SetState overrides the state of a container, e.g. to simulate its termination
+func (f *FakeRuntime) SetState(id string, state ContainerState) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	c := f.lookupContainer(id)
+	if c == nil {
+		return notFound("set state", id)
+	}
+	c.info.State = state
+	return nil
+}
+
+// SetPullError makes the creation of the containers of image fail as if its pull failed with err, until it is called
+// again with a nil err
+func (f *FakeRuntime) SetPullError(image string, err error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	if err == nil {
+		delete(f.pullErrors, image)
+		return
+	}
+	f.pullErrors[image] = err
+}
+
+// SetLogs sets the logs returned for a container
+func (f *FakeRuntime) SetLogs(id string, logs []byte) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	c := f.lookupContainer(id)
+	if c == nil {
+		return notFound("set logs", id)
+	}
+	c.logs = logs
+	return nil
+}
+
+// SetNetworkAddress sets the address of a container on a network
+func (f *FakeRuntime) SetNetworkAddress(id string, network string, address string) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	c := f.lookupContainer(id)
+	if c == nil {
+		return notFound("set network address", id)
+	}
+	c.info.Networks[network] = address
+	return nil
+}
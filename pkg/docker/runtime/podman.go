@@ -0,0 +1,754 @@
+package runtime
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/docker/docker/client"
+	"github.com/docker/docker/pkg/stdcopy"
+)
+
+// podmanAPIPrefix is the prefix of the libpod REST API paths, the API version 4 being supported by Podman 4 and later
+const podmanAPIPrefix = "/v4.0.0/libpod"
+
+// podmanCPUPeriod is the CFS period, in microseconds, the CPU limits are expressed in
+const podmanCPUPeriod = 100000
+
+// PodmanRuntime implements ContainerRuntime and PodRuntime on top of the native libpod REST API of Podman, which is
+// served by rootless Podman as well
+type PodmanRuntime struct {
+	endpoint string
+	baseURL  string
+	http     *http.Client
+
+	innerMutex sync.Mutex
+	inner      map[string]*DockerRuntime
+}
+
+// DefaultPodmanSocket returns the endpoint of the Podman service of the user: CONTAINER_HOST if set, like the podman
+// CLI, otherwise the rootless socket in XDG_RUNTIME_DIR or the rootful one
+func DefaultPodmanSocket() string {
+	if host := os.Getenv("CONTAINER_HOST"); host != "" {
+		return host
+	}
+	if runtimeDir := os.Getenv("XDG_RUNTIME_DIR"); runtimeDir != "" && os.Getuid() != 0 {
+		return "unix://" + filepath.Join(runtimeDir, "podman", "podman.sock")
+	}
+	return "unix:///run/podman/podman.sock"
+}
+
+// NewPodmanRuntime returns a PodmanRuntime talking to the Podman service listening at endpoint, either
+// unix:///path/podman.sock or tcp://host:port. An empty endpoint selects DefaultPodmanSocket.
+func NewPodmanRuntime(endpoint string) (*PodmanRuntime, error) {
+	if endpoint == "" {
+		endpoint = DefaultPodmanSocket()
+	}
+
+	r := &PodmanRuntime{endpoint: endpoint, inner: map[string]*DockerRuntime{}}
+	if socket, ok := strings.CutPrefix(endpoint, "unix://"); ok {
+		r.baseURL = "http://podman" + podmanAPIPrefix
+		r.http = &http.Client{Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _ string, _ string) (net.Conn, error) {
+				return (&net.Dialer{}).DialContext(ctx, "unix", socket)
+			},
+		}}
+	} else if address, ok := strings.CutPrefix(endpoint, "tcp://"); ok {
+		r.baseURL = "http://" + address + podmanAPIPrefix
+		r.http = &http.Client{}
+	} else {
+		return nil, &Error{Op: "connect", Target: endpoint, Err: errors.New("unsupported endpoint, expected unix:// or tcp://")}
+	}
+	return r, nil
+}
+
+// podmanErrorResponse is the body of the libpod API errors
+type podmanErrorResponse struct {
+	Cause    string `json:"cause"`
+	Message  string `json:"message"`
+	Response int    `json:"response"`
+}
+
+// request sends a request to the libpod API and returns the response if its status is a success. The caller must close
+// the body of the response.
+func (r *PodmanRuntime) request(ctx context.Context, op string, target string, method string, path string, query url.Values, body interface{}) (*http.Response, error) {
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return nil, &Error{Op: op, Target: target, Err: err}
+		}
+		reader = bytes.NewReader(data)
+	}
+
+	requestURL := r.baseURL + path
+	if len(query) > 0 {
+		requestURL += "?" + query.Encode()
+	}
+	req, err := http.NewRequestWithContext(ctx, method, requestURL, reader)
+	if err != nil {
+		return nil, &Error{Op: op, Target: target, Err: err}
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := r.http.Do(req)
+	if err != nil {
+		return nil, &Error{Op: op, Target: target, Kind: ErrUnavailable, Err: err}
+	}
+	if resp.StatusCode < 400 {
+		return resp, nil
+	}
+	defer resp.Body.Close()
+
+	var kind error
+	switch resp.StatusCode {
+	case http.StatusNotFound:
+		kind = ErrNotFound
+	case http.StatusConflict:
+		kind = ErrConflict
+	case http.StatusServiceUnavailable:
+		kind = ErrUnavailable
+	}
+	errorResponse := podmanErrorResponse{}
+	data, _ := io.ReadAll(resp.Body)
+	if json.Unmarshal(data, &errorResponse) != nil || errorResponse.Message == "" {
+		errorResponse.Message = strings.TrimSpace(string(data))
+	}
+	return nil, &Error{Op: op, Target: target, Kind: kind, Err: fmt.Errorf("%s (HTTP %d)", errorResponse.Message, resp.StatusCode)}
+}
+
+// call sends a request to the libpod API and decodes its JSON answer in out, if not nil
+func (r *PodmanRuntime) call(ctx context.Context, op string, target string, method string, path string, query url.Values, body interface{}, out interface{}) error {
+	resp, err := r.request(ctx, op, target, method, path, query, body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if out == nil {
+		_, err = io.Copy(io.Discard, resp.Body)
+	} else {
+		err = json.NewDecoder(resp.Body).Decode(out)
+	}
+	if err != nil {
+		return &Error{Op: op, Target: target, Err: err}
+	}
+	return nil
+}
+
+// podmanFilters encodes the label filters of opts as expected by the list calls of the libpod API
+func podmanFilters(opts ListOptions) url.Values {
+	query := url.Values{}
+	if len(opts.Labels) == 0 {
+		return query
+	}
+	var labels []string
+	for k, v := range opts.Labels {
+		if v == "" {
+			labels = append(labels, k)
+		} else {
+			labels = append(labels, k+"="+v)
+		}
+	}
+	filters, _ := json.Marshal(map[string][]string{"label": labels})
+	query.Set("filters", string(filters))
+	return query
+}
+
+func (r *PodmanRuntime) Ping(ctx context.Context) error {
+	return r.call(ctx, "ping", r.endpoint, http.MethodGet, "/_ping", nil, nil, nil)
+}
+
+// podmanMount is a mount of the libpod container spec
+type podmanMount struct {
+	Destination string   `json:"destination"`
+	Source      string   `json:"source"`
+	Type        string   `json:"type"`
+	Options     []string `json:"options,omitempty"`
+}
+
+// podmanPortMapping is a published port of the libpod container and pod specs
+type podmanPortMapping struct {
+	HostIP        string `json:"host_ip,omitempty"`
+	HostPort      int    `json:"host_port,omitempty"`
+	ContainerPort int    `json:"container_port"`
+	Protocol      string `json:"protocol,omitempty"`
+}
+
+// podmanResources are the limits of the libpod container spec and update calls, in the OCI format
+type podmanResources struct {
+	Memory *podmanMemory `json:"memory,omitempty"`
+	CPU    *podmanCPU    `json:"cpu,omitempty"`
+}
+
+type podmanMemory struct {
+	Limit int64 `json:"limit,omitempty"`
+	Swap  int64 `json:"swap,omitempty"`
+}
+
+type podmanCPU struct {
+	Quota  int64  `json:"quota,omitempty"`
+	Period uint64 `json:"period,omitempty"`
+}
+
+// podmanNamespace is a namespace of the libpod container spec
+type podmanNamespace struct {
+	NSMode string `json:"nsmode"`
+	Value  string `json:"value,omitempty"`
+}
+
+// podmanNamespaceMode translates a docker namespace mode, e.g. host or container:<id>, to a libpod namespace
+func podmanNamespaceMode(mode string) *podmanNamespace {
+	if mode == "" {
+		return nil
+	}
+	if id, found := strings.CutPrefix(mode, "container:"); found {
+		return &podmanNamespace{NSMode: "container", Value: id}
+	}
+	return &podmanNamespace{NSMode: mode}
+}
+
+// podmanContainerSpec is the subset of the libpod SpecGenerator used to create containers
+type podmanContainerSpec struct {
+	Name               string              `json:"name"`
+	Image              string              `json:"image"`
+	Entrypoint         []string            `json:"entrypoint,omitempty"`
+	Command            []string            `json:"command,omitempty"`
+	Env                map[string]string   `json:"env,omitempty"`
+	Labels             map[string]string   `json:"labels,omitempty"`
+	Mounts             []podmanMount       `json:"mounts,omitempty"`
+	PortMappings       []podmanPortMapping `json:"portmappings,omitempty"`
+	ResourceLimits     *podmanResources    `json:"resource_limits,omitempty"`
+	NetNS              *podmanNamespace    `json:"netns,omitempty"`
+	IpcNS              *podmanNamespace    `json:"ipcns,omitempty"`
+	PidNS              *podmanNamespace    `json:"pidns,omitempty"`
+	Networks           map[string]struct{} `json:"Networks,omitempty"`
+	Privileged         bool                `json:"privileged,omitempty"`
+	OCIRuntime         string              `json:"oci_runtime,omitempty"`
+	User               string              `json:"user,omitempty"`
+	ShmSize            int64               `json:"shm_size,omitempty"`
+	CapAdd             []string            `json:"cap_add,omitempty"`
+	CapDrop            []string            `json:"cap_drop,omitempty"`
+	NoNewPrivileges    bool                `json:"no_new_privileges,omitempty"`
+	SelinuxOpts        []string            `json:"selinux_opts,omitempty"`
+	SeccompProfilePath string              `json:"seccomp_profile_path,omitempty"`
+	ApparmorProfile    string              `json:"apparmor_profile,omitempty"`
+	HostAdd            []string            `json:"hostadd,omitempty"`
+	CgroupParent       string              `json:"cgroup_parent,omitempty"`
+	Pod                string              `json:"pod,omitempty"`
+	WorkDir            string              `json:"work_dir,omitempty"`
+	Stdin              bool                `json:"stdin,omitempty"`
+	Terminal           bool                `json:"terminal,omitempty"`
+}
+
+func podmanPorts(ports []PortBinding) []podmanPortMapping {
+	var mappings []podmanPortMapping
+	for _, binding := range ports {
+		mappings = append(mappings, podmanPortMapping{HostIP: binding.HostIP, HostPort: binding.HostPort, ContainerPort: binding.ContainerPort, Protocol: strings.ToLower(binding.Protocol)})
+	}
+	return mappings
+}
+
+func podmanResourceLimits(resources Resources) *podmanResources {
+	if resources.Memory == 0 && resources.NanoCPUs == 0 {
+		return nil
+	}
+	limits := &podmanResources{}
+	if resources.Memory != 0 {
+		// without swap, the memory limit is the limit of the whole container
+		limits.Memory = &podmanMemory{Limit: resources.Memory, Swap: resources.Memory}
+	}
+	if resources.NanoCPUs != 0 {
+		limits.CPU = &podmanCPU{Quota: resources.NanoCPUs * podmanCPUPeriod / 1e9, Period: podmanCPUPeriod}
+	}
+	return limits
+}
+
+// podmanSpec translates spec to the libpod container spec
+func podmanSpec(spec ContainerSpec) (podmanContainerSpec, error) {
+	podmanSpec := podmanContainerSpec{
+		Name:           spec.Name,
+		Image:          spec.Image,
+		Entrypoint:     spec.Entrypoint,
+		Command:        spec.Cmd,
+		Labels:         spec.Labels,
+		PortMappings:   podmanPorts(spec.Ports),
+		ResourceLimits: podmanResourceLimits(spec.Resources),
+		Privileged:     spec.Privileged,
+		OCIRuntime:     spec.Runtime,
+		User:           spec.User,
+		ShmSize:        spec.ShmSize,
+		CapAdd:         spec.CapAdd,
+		CapDrop:        spec.CapDrop,
+		HostAdd:        spec.ExtraHosts,
+		CgroupParent:   spec.CgroupParent,
+		Pod:            spec.Pod,
+		IpcNS:          podmanNamespaceMode(spec.IpcMode),
+		PidNS:          podmanNamespaceMode(spec.PidMode),
+		WorkDir:        spec.WorkingDir,
+		Stdin:          spec.OpenStdin,
+		Terminal:       spec.Tty,
+	}
+
+	if len(spec.Env) > 0 {
+		podmanSpec.Env = map[string]string{}
+		for _, env := range spec.Env {
+			key, value, _ := strings.Cut(env, "=")
+			podmanSpec.Env[key] = value
+		}
+	}
+
+	for _, m := range spec.Mounts {
+		mount := podmanMount{Destination: m.Target, Source: m.Source, Type: "bind", Options: []string{"rbind"}}
+		if m.ReadOnly {
+			mount.Options = append(mount.Options, "ro")
+		}
+		if m.Propagation != "" {
+			mount.Options = append(mount.Options, m.Propagation)
+		}
+		podmanSpec.Mounts = append(podmanSpec.Mounts, mount)
+	}
+
+	// the containers of a pod share its network namespace
+	if spec.Pod == "" {
+		switch spec.NetworkMode {
+		case "":
+		case "host", "none", "bridge":
+			podmanSpec.NetNS = podmanNamespaceMode(spec.NetworkMode)
+		default:
+			if strings.HasPrefix(spec.NetworkMode, "container:") {
+				podmanSpec.NetNS = podmanNamespaceMode(spec.NetworkMode)
+				break
+			}
+			podmanSpec.NetNS = &podmanNamespace{NSMode: "bridge"}
+			podmanSpec.Networks = map[string]struct{}{spec.NetworkMode: {}}
+		}
+	} else if len(spec.Ports) > 0 {
+		return podmanSpec, errors.New("the ports of the containers of a pod must be published by the pod")
+	}
+
+	for _, option := range spec.SecurityOpt {
+		name, value, _ := strings.Cut(strings.Replace(option, ":", "=", 1), "=")
+		switch name {
+		case "no-new-privileges":
+			podmanSpec.NoNewPrivileges = value == "" || value == "true"
+		case "label":
+			podmanSpec.SelinuxOpts = append(podmanSpec.SelinuxOpts, value)
+		case "seccomp":
+			podmanSpec.SeccompProfilePath = value
+		case "apparmor":
+			podmanSpec.ApparmorProfile = value
+		default:
+			return podmanSpec, fmt.Errorf("unsupported security option %s", option)
+		}
+	}
+
+	return podmanSpec, nil
+}
+
+func (r *PodmanRuntime) CreateContainer(ctx context.Context, spec ContainerSpec) (string, error) {
+	createSpec, err := podmanSpec(spec)
+	if err != nil {
+		return "", &Error{Op: "container create", Target: spec.Name, Err: err}
+	}
+
+	var created struct {
+		ID string `json:"Id"`
+	}
+	err = r.call(ctx, "container create", spec.Name, http.MethodPost, "/containers/create", nil, createSpec, &created)
+	if IsNotFound(err) {
+		// like podman run, pull the image if it is not present yet and try again
+		err = r.pullImage(ctx, spec.Image)
+		if err != nil {
+			return "", err
+		}
+		err = r.call(ctx, "container create", spec.Name, http.MethodPost, "/containers/create", nil, createSpec, &created)
+	}
+	if err != nil {
+		return "", err
+	}
+	return created.ID, nil
+}
+
+func (r *PodmanRuntime) PullImage(ctx context.Context, ref string, always bool) error {
+	if !always {
+		err := r.call(ctx, "image exists", ref, http.MethodGet, "/images/"+ref+"/exists", nil, nil, nil)
+		if err == nil {
+			return nil
+		} else if !IsNotFound(err) {
+			return err
+		}
+	}
+	return r.pullImage(ctx, ref)
+}
+
+func (r *PodmanRuntime) pullImage(ctx context.Context, ref string) error {
+	resp, err := r.request(ctx, "image pull", ref, http.MethodPost, "/images/pull", url.Values{"reference": {ref}}, nil)
+	if err != nil {
+		return imagePullError(err)
+	}
+	defer resp.Body.Close()
+
+	// the pull is complete only when the progress stream has been consumed, and a failure is reported in the stream
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		var progress struct {
+			Error string `json:"error"`
+		}
+		if json.Unmarshal(scanner.Bytes(), &progress) == nil && progress.Error != "" {
+			return &Error{Op: "image pull", Target: ref, Kind: ErrImagePull, Err: errors.New(progress.Error)}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return &Error{Op: "image pull", Target: ref, Kind: ErrImagePull, Err: err}
+	}
+	return nil
+}
+
+func (r *PodmanRuntime) StartContainer(ctx context.Context, id string) error {
+	return r.call(ctx, "container start", id, http.MethodPost, "/containers/"+url.PathEscape(id)+"/start", nil, nil, nil)
+}
+
+func (r *PodmanRuntime) StopContainer(ctx context.Context, id string, timeout time.Duration) error {
+	query := url.Values{"timeout": {strconv.Itoa(int(timeout.Seconds()))}}
+	return r.call(ctx, "container stop", id, http.MethodPost, "/containers/"+url.PathEscape(id)+"/stop", query, nil, nil)
+}
+
+func (r *PodmanRuntime) RemoveContainer(ctx context.Context, id string, force bool) error {
+	return r.call(ctx, "container remove", id, http.MethodDelete, "/containers/"+url.PathEscape(id), url.Values{"force": {strconv.FormatBool(force)}}, nil, nil)
+}
+
+func (r *PodmanRuntime) RenameContainer(ctx context.Context, id string, newName string) error {
+	return r.call(ctx, "container rename", id, http.MethodPost, "/containers/"+url.PathEscape(id)+"/rename", url.Values{"name": {newName}}, nil, nil)
+}
+
+func (r *PodmanRuntime) UpdateContainerResources(ctx context.Context, id string, resources Resources) error {
+	limits := podmanResourceLimits(resources)
+	if limits == nil {
+		return nil
+	}
+	return r.call(ctx, "container update", id, http.MethodPost, "/containers/"+url.PathEscape(id)+"/update", nil, limits, nil)
+}
+
+// podmanContainerInspect is the subset of the libpod container inspect answer used to fill ContainerInfo
+type podmanContainerInspect struct {
+	ID        string `json:"Id"`
+	Name      string `json:"Name"`
+	Image     string `json:"Image"`
+	ImageName string `json:"ImageName"`
+	Config    struct {
+		Labels map[string]string `json:"Labels"`
+		Env    []string          `json:"Env"`
+		Tty    bool              `json:"Tty"`
+	} `json:"Config"`
+	State struct {
+		Status     string    `json:"Status"`
+		Running    bool      `json:"Running"`
+		ExitCode   int       `json:"ExitCode"`
+		OOMKilled  bool      `json:"OOMKilled"`
+		Error      string    `json:"Error"`
+		StartedAt  time.Time `json:"StartedAt"`
+		FinishedAt time.Time `json:"FinishedAt"`
+	} `json:"State"`
+	Mounts []struct {
+		Source      string `json:"Source"`
+		Destination string `json:"Destination"`
+		RW          bool   `json:"RW"`
+		Propagation string `json:"Propagation"`
+	} `json:"Mounts"`
+	NetworkSettings struct {
+		Networks map[string]struct {
+			IPAddress string `json:"IPAddress"`
+		} `json:"Networks"`
+	} `json:"NetworkSettings"`
+}
+
+// podmanStatus translates the status of a libpod container to the Docker one expected by the handlers
+func podmanStatus(status string) string {
+	switch status {
+	case "configured", "initialized":
+		return "created"
+	case "stopped", "stopping":
+		return "exited"
+	case "removing":
+		return "dead"
+	}
+	return status
+}
+
+func zeroTime(t time.Time) time.Time {
+	if t.Year() <= 1 {
+		return time.Time{}
+	}
+	return t
+}
+
+func (r *PodmanRuntime) inspect(ctx context.Context, op string, id string) (podmanContainerInspect, error) {
+	var inspect podmanContainerInspect
+	err := r.call(ctx, op, id, http.MethodGet, "/containers/"+url.PathEscape(id)+"/json", nil, nil, &inspect)
+	return inspect, err
+}
+
+func (r *PodmanRuntime) InspectContainer(ctx context.Context, id string) (ContainerInfo, error) {
+	inspect, err := r.inspect(ctx, "container inspect", id)
+	if err != nil {
+		return ContainerInfo{}, err
+	}
+
+	info := ContainerInfo{
+		ID:       inspect.ID,
+		Name:     inspect.Name,
+		Image:    inspect.ImageName,
+		ImageID:  inspect.Image,
+		Labels:   inspect.Config.Labels,
+		Env:      inspect.Config.Env,
+		Networks: map[string]string{},
+		State: ContainerState{
+			Status:     podmanStatus(inspect.State.Status),
+			Running:    inspect.State.Running,
+			ExitCode:   inspect.State.ExitCode,
+			OOMKilled:  inspect.State.OOMKilled,
+			Error:      inspect.State.Error,
+			StartedAt:  zeroTime(inspect.State.StartedAt),
+			FinishedAt: zeroTime(inspect.State.FinishedAt),
+		},
+	}
+	for _, m := range inspect.Mounts {
+		info.Mounts = append(info.Mounts, Mount{Source: m.Source, Target: m.Destination, ReadOnly: !m.RW, Propagation: m.Propagation})
+	}
+	for name, endpoint := range inspect.NetworkSettings.Networks {
+		info.Networks[name] = endpoint.IPAddress
+	}
+	return info, nil
+}
+
+func (r *PodmanRuntime) ListContainers(ctx context.Context, opts ListOptions) ([]ContainerInfo, error) {
+	query := podmanFilters(opts)
+	query.Set("all", strconv.FormatBool(opts.All))
+
+	var containers []struct {
+		ID      string            `json:"Id"`
+		Names   []string          `json:"Names"`
+		Image   string            `json:"Image"`
+		ImageID string            `json:"ImageID"`
+		Labels  map[string]string `json:"Labels"`
+		State   string            `json:"State"`
+	}
+	err := r.call(ctx, "container list", r.endpoint, http.MethodGet, "/containers/json", query, nil, &containers)
+	if err != nil {
+		return nil, err
+	}
+
+	var infos []ContainerInfo
+	for _, c := range containers {
+		status := podmanStatus(c.State)
+		info := ContainerInfo{ID: c.ID, Image: c.Image, ImageID: c.ImageID, Labels: c.Labels, State: ContainerState{Status: status, Running: status == "running"}}
+		if len(c.Names) > 0 {
+			info.Name = c.Names[0]
+		}
+		infos = append(infos, info)
+	}
+	return infos, nil
+}
+
+func (r *PodmanRuntime) ContainerLogs(ctx context.Context, id string, opts LogOptions) ([]byte, error) {
+	inspect, err := r.inspect(ctx, "container logs", id)
+	if err != nil {
+		return nil, err
+	}
+
+	query := url.Values{"stdout": {"true"}, "stderr": {"true"}, "timestamps": {strconv.FormatBool(opts.Timestamps)}}
+	if opts.Tail > 0 {
+		query.Set("tail", strconv.Itoa(opts.Tail))
+	}
+	if !opts.Since.IsZero() {
+		query.Set("since", opts.Since.Format(time.RFC3339Nano))
+	}
+
+	resp, err := r.request(ctx, "container logs", id, http.MethodGet, "/containers/"+url.PathEscape(id)+"/logs", query, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var output bytes.Buffer
+	if inspect.Config.Tty {
+		// logs of a TTY container are a raw stream, not multiplexed
+		_, err = io.Copy(&output, resp.Body)
+	} else {
+		_, err = stdcopy.StdCopy(&output, &output, resp.Body)
+	}
+	if err != nil {
+		return nil, &Error{Op: "container logs", Target: id, Err: err}
+	}
+	return output.Bytes(), nil
+}
+
+func (r *PodmanRuntime) Exec(ctx context.Context, id string, cmd []string) (ExecResult, error) {
+	var exec struct {
+		ID string `json:"Id"`
+	}
+	execConfig := map[string]interface{}{"Cmd": cmd, "AttachStdout": true, "AttachStderr": true}
+	err := r.call(ctx, "exec create", id, http.MethodPost, "/containers/"+url.PathEscape(id)+"/exec", nil, execConfig, &exec)
+	if err != nil {
+		return ExecResult{}, err
+	}
+
+	resp, err := r.request(ctx, "exec start", id, http.MethodPost, "/exec/"+exec.ID+"/start", nil, map[string]bool{"Detach": false, "Tty": false})
+	if err != nil {
+		return ExecResult{}, err
+	}
+	defer resp.Body.Close()
+
+	var stdout, stderr bytes.Buffer
+	_, err = stdcopy.StdCopy(&stdout, &stderr, resp.Body)
+	if ctx.Err() != nil {
+		return ExecResult{}, &Error{Op: "exec", Target: id, Err: ctx.Err()}
+	}
+	if err != nil {
+		return ExecResult{}, &Error{Op: "exec", Target: id, Err: err}
+	}
+
+	var inspect struct {
+		ExitCode int `json:"ExitCode"`
+	}
+	err = r.call(ctx, "exec inspect", id, http.MethodGet, "/exec/"+exec.ID+"/json", nil, nil, &inspect)
+	if err != nil {
+		return ExecResult{}, err
+	}
+	return ExecResult{ExitCode: inspect.ExitCode, Stdout: stdout.String(), Stderr: stderr.String()}, nil
+}
+
+// podmanNetwork is the libpod network, as created, inspected and listed
+type podmanNetwork struct {
+	ID     string            `json:"id"`
+	Name   string            `json:"name"`
+	Driver string            `json:"driver"`
+	Labels map[string]string `json:"labels,omitempty"`
+}
+
+func (r *PodmanRuntime) CreateNetwork(ctx context.Context, name string, labels map[string]string) (string, error) {
+	var network podmanNetwork
+	err := r.call(ctx, "network create", name, http.MethodPost, "/networks/create", nil, podmanNetwork{Name: name, Driver: "bridge", Labels: labels}, &network)
+	return network.ID, err
+}
+
+func (r *PodmanRuntime) InspectNetwork(ctx context.Context, id string) (NetworkInfo, error) {
+	var network podmanNetwork
+	err := r.call(ctx, "network inspect", id, http.MethodGet, "/networks/"+url.PathEscape(id)+"/json", nil, nil, &network)
+	if err != nil {
+		return NetworkInfo{}, err
+	}
+	return NetworkInfo{ID: network.ID, Name: network.Name, Driver: network.Driver, Labels: network.Labels}, nil
+}
+
+func (r *PodmanRuntime) RemoveNetwork(ctx context.Context, id string) error {
+	return r.call(ctx, "network remove", id, http.MethodDelete, "/networks/"+url.PathEscape(id), nil, nil, nil)
+}
+
+func (r *PodmanRuntime) ListNetworks(ctx context.Context, opts ListOptions) ([]NetworkInfo, error) {
+	var networks []podmanNetwork
+	err := r.call(ctx, "network list", r.endpoint, http.MethodGet, "/networks/json", podmanFilters(opts), nil, &networks)
+	if err != nil {
+		return nil, err
+	}
+
+	var infos []NetworkInfo
+	for _, network := range networks {
+		infos = append(infos, NetworkInfo{ID: network.ID, Name: network.Name, Driver: network.Driver, Labels: network.Labels})
+	}
+	return infos, nil
+}
+
+// Inner returns a runtime talking to the Docker daemon of a DIND container, since the daemon running inside a DIND
+// container is always Docker
+func (r *PodmanRuntime) Inner(endpoint string) (ContainerRuntime, error) {
+	r.innerMutex.Lock()
+	defer r.innerMutex.Unlock()
+
+	if inner, ok := r.inner[endpoint]; ok {
+		return inner, nil
+	}
+
+	cli, err := client.NewClientWithOpts(client.WithHost(endpoint), client.WithAPIVersionNegotiation())
+	if err != nil {
+		return nil, wrapError("connect", endpoint, err)
+	}
+	inner := &DockerRuntime{cli: cli, inner: map[string]*DockerRuntime{}}
+	r.inner[endpoint] = inner
+	return inner, nil
+}
+
+func (r *PodmanRuntime) Forget(endpoint string) {
+	r.innerMutex.Lock()
+	inner, ok := r.inner[endpoint]
+	delete(r.inner, endpoint)
+	r.innerMutex.Unlock()
+
+	if ok {
+		inner.cli.Close()
+	}
+}
+
+func (r *PodmanRuntime) CreatePod(ctx context.Context, spec PodSpec) (string, error) {
+	var created struct {
+		ID string `json:"Id"`
+	}
+	podSpec := map[string]interface{}{"name": spec.Name, "labels": spec.Labels, "portmappings": podmanPorts(spec.Ports)}
+	if spec.SharePID {
+		// the default shared namespaces of podman, plus the PID one
+		podSpec["shared_namespaces"] = []string{"cgroup", "ipc", "net", "uts", "pid"}
+	}
+	err := r.call(ctx, "pod create", spec.Name, http.MethodPost, "/pods/create", nil, podSpec, &created)
+	return created.ID, err
+}
+
+func (r *PodmanRuntime) InspectPod(ctx context.Context, id string) (PodInfo, error) {
+	var pod struct {
+		ID     string            `json:"Id"`
+		Name   string            `json:"Name"`
+		Labels map[string]string `json:"Labels"`
+	}
+	err := r.call(ctx, "pod inspect", id, http.MethodGet, "/pods/"+url.PathEscape(id)+"/json", nil, nil, &pod)
+	if err != nil {
+		return PodInfo{}, err
+	}
+	return PodInfo{ID: pod.ID, Name: pod.Name, Labels: pod.Labels}, nil
+}
+
+func (r *PodmanRuntime) RemovePod(ctx context.Context, id string) error {
+	return r.call(ctx, "pod remove", id, http.MethodDelete, "/pods/"+url.PathEscape(id), url.Values{"force": {"true"}}, nil, nil)
+}
+
+func (r *PodmanRuntime) ListPods(ctx context.Context, opts ListOptions) ([]PodInfo, error) {
+	var pods []struct {
+		ID     string            `json:"Id"`
+		Name   string            `json:"Name"`
+		Labels map[string]string `json:"Labels"`
+	}
+	err := r.call(ctx, "pod list", r.endpoint, http.MethodGet, "/pods/json", podmanFilters(opts), nil, &pods)
+	if err != nil {
+		return nil, err
+	}
+
+	var infos []PodInfo
+	for _, pod := range pods {
+		infos = append(infos, PodInfo{ID: pod.ID, Name: pod.Name, Labels: pod.Labels})
+	}
+	return infos, nil
+}
@@ -0,0 +1,548 @@
+package runtime
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/pkg/stdcopy"
+)
+
+// fakeLibpod serves the subset of the libpod REST API driven by PodmanRuntime, keeping the objects in memory
+type fakeLibpod struct {
+	mutex      sync.Mutex
+	counter    int
+	images     map[string]bool
+	containers map[string]*fakeLibpodContainer
+	pods       map[string]*PodInfo
+	networks   map[string]*podmanNetwork
+	// updates records the bodies of the update calls, by container ID
+	updates map[string]podmanResources
+	// sharedNamespaces records the namespaces shared by the containers of the pods, by pod name
+	sharedNamespaces map[string][]string
+}
+
+type fakeLibpodContainer struct {
+	id     string
+	spec   podmanContainerSpec
+	status string
+	logs   string
+}
+
+// newFakeLibpod starts a fakeLibpod listening on a unix socket and returns it along with the PodmanRuntime talking to it
+func newFakeLibpod(t *testing.T) (*fakeLibpod, *PodmanRuntime) {
+	t.Helper()
+
+	f := &fakeLibpod{
+		images:     map[string]bool{},
+		containers: map[string]*fakeLibpodContainer{},
+		pods:       map[string]*PodInfo{},
+		networks:   map[string]*podmanNetwork{},
+		updates:    map[string]podmanResources{},
+
+		sharedNamespaces: map[string][]string{},
+	}
+
+	socket := filepath.Join(t.TempDir(), "podman.sock")
+	listener, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewUnstartedServer(f)
+	server.Listener = listener
+	server.Start()
+	t.Cleanup(server.Close)
+
+	r, err := NewPodmanRuntime("unix://" + socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return f, r
+}
+
+func writeJSON(w http.ResponseWriter, status int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
+
+func writeLibpodError(w http.ResponseWriter, status int, message string) {
+	writeJSON(w, status, podmanErrorResponse{Cause: message, Message: message, Response: status})
+}
+
+// matchFilters returns true if labels match the label filters of a list call
+func matchFilters(r *http.Request, labels map[string]string) bool {
+	var filters map[string][]string
+	if r.URL.Query().Get("filters") != "" {
+		json.Unmarshal([]byte(r.URL.Query().Get("filters")), &filters)
+	}
+	filter := map[string]string{}
+	for _, label := range filters["label"] {
+		key, value, _ := strings.Cut(label, "=")
+		filter[key] = value
+	}
+	return matchLabels(labels, filter)
+}
+
+func (f *fakeLibpod) lookupContainer(id string) *fakeLibpodContainer {
+	for _, c := range f.containers {
+		if c.id == id || c.spec.Name == id {
+			return c
+		}
+	}
+	return nil
+}
+
+func (f *fakeLibpod) lookupPod(id string) *PodInfo {
+	for _, pod := range f.pods {
+		if pod.ID == id || pod.Name == id {
+			return pod
+		}
+	}
+	return nil
+}
+
+func (f *fakeLibpod) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	path, ok := strings.CutPrefix(r.URL.Path, podmanAPIPrefix)
+	if !ok {
+		writeLibpodError(w, http.StatusNotFound, "unknown API version")
+		return
+	}
+	parts := strings.Split(strings.Trim(path, "/"), "/")
+	route := r.Method + " " + parts[0]
+	if len(parts) > 1 {
+		route += " " + parts[len(parts)-1]
+	}
+
+	switch {
+	case route == "GET _ping":
+		w.Write([]byte("OK"))
+
+	case route == "GET images exists":
+		if !f.images[strings.TrimSuffix(strings.TrimPrefix(path, "/images/"), "/exists")] {
+			writeLibpodError(w, http.StatusNotFound, "no such image")
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	case route == "POST images pull":
+		ref := r.URL.Query().Get("reference")
+		if ref == "missing" {
+			w.Write([]byte(`{"stream":"Trying to pull missing"}` + "\n" + `{"error":"manifest unknown"}` + "\n"))
+			return
+		}
+		f.images[ref] = true
+		w.Write([]byte(`{"stream":"Trying to pull ` + ref + `"}` + "\n" + `{"id":"sha256"}` + "\n"))
+
+	case route == "POST containers create":
+		var spec podmanContainerSpec
+		json.NewDecoder(r.Body).Decode(&spec)
+		if !f.images[spec.Image] {
+			writeLibpodError(w, http.StatusNotFound, spec.Image+": image not known")
+			return
+		}
+		if f.lookupContainer(spec.Name) != nil {
+			writeLibpodError(w, http.StatusConflict, "the container name "+spec.Name+" is already in use")
+			return
+		}
+		if spec.Pod != "" && f.lookupPod(spec.Pod) == nil {
+			writeLibpodError(w, http.StatusNotFound, "no pod with name or ID "+spec.Pod+" found")
+			return
+		}
+		f.counter++
+		c := &fakeLibpodContainer{id: fmt.Sprintf("%064x", f.counter), spec: spec, status: "created"}
+		f.containers[c.id] = c
+		writeJSON(w, http.StatusCreated, map[string]interface{}{"Id": c.id, "Warnings": []string{}})
+
+	case route == "GET containers json" && len(parts) == 2:
+		var list []map[string]interface{}
+		for _, c := range f.containers {
+			if (r.URL.Query().Get("all") == "true" || c.status == "running") && matchFilters(r, c.spec.Labels) {
+				list = append(list, map[string]interface{}{"Id": c.id, "Names": []string{c.spec.Name}, "Image": c.spec.Image, "Labels": c.spec.Labels, "State": c.status})
+			}
+		}
+		writeJSON(w, http.StatusOK, list)
+
+	case parts[0] == "containers":
+		c := f.lookupContainer(parts[1])
+		if c == nil {
+			writeLibpodError(w, http.StatusNotFound, "no container with name or ID "+parts[1]+" found")
+			return
+		}
+		switch route {
+		case "POST containers start":
+			c.status = "running"
+			w.WriteHeader(http.StatusNoContent)
+		case "POST containers stop":
+			c.status = "exited"
+			w.WriteHeader(http.StatusNoContent)
+		case "DELETE containers " + parts[1]:
+			if c.status == "running" && r.URL.Query().Get("force") != "true" {
+				writeLibpodError(w, http.StatusConflict, "container is running")
+				return
+			}
+			delete(f.containers, c.id)
+			writeJSON(w, http.StatusOK, []map[string]string{{"Id": c.id}})
+		case "POST containers rename":
+			c.spec.Name = r.URL.Query().Get("name")
+			w.WriteHeader(http.StatusNoContent)
+		case "POST containers update":
+			var resources podmanResources
+			json.NewDecoder(r.Body).Decode(&resources)
+			f.updates[c.id] = resources
+			writeJSON(w, http.StatusCreated, map[string]string{"Id": c.id})
+		case "GET containers json":
+			inspect := map[string]interface{}{
+				"Id":        c.id,
+				"Name":      c.spec.Name,
+				"Image":     "sha256",
+				"ImageName": c.spec.Image,
+				"Config":    map[string]interface{}{"Labels": c.spec.Labels, "Env": []string{"PATH=/bin"}},
+				"State":     map[string]interface{}{"Status": c.status, "Running": c.status == "running", "StartedAt": time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC), "FinishedAt": time.Time{}},
+				"Mounts":    []map[string]interface{}{},
+			}
+			for _, m := range c.spec.Mounts {
+				inspect["Mounts"] = append(inspect["Mounts"].([]map[string]interface{}), map[string]interface{}{"Source": m.Source, "Destination": m.Destination, "RW": !strings.Contains(strings.Join(m.Options, ","), "ro")})
+			}
+			networks := map[string]interface{}{}
+			for name := range c.spec.Networks {
+				networks[name] = map[string]string{"IPAddress": "10.88.0.2"}
+			}
+			inspect["NetworkSettings"] = map[string]interface{}{"Networks": networks}
+			writeJSON(w, http.StatusOK, inspect)
+		case "GET containers logs":
+			w.WriteHeader(http.StatusOK)
+			stdcopy.NewStdWriter(w, stdcopy.Stdout).Write([]byte(c.logs))
+		case "POST containers exec":
+			writeJSON(w, http.StatusCreated, map[string]string{"Id": "exec-" + c.id})
+		default:
+			writeLibpodError(w, http.StatusNotFound, "unknown route "+route)
+		}
+
+	case route == "POST exec start":
+		w.WriteHeader(http.StatusOK)
+		stdcopy.NewStdWriter(w, stdcopy.Stdout).Write([]byte("ok\n"))
+		stdcopy.NewStdWriter(w, stdcopy.Stderr).Write([]byte("warning\n"))
+
+	case route == "GET exec json":
+		writeJSON(w, http.StatusOK, map[string]int{"ExitCode": 3})
+
+	case route == "POST pods create":
+		var spec struct {
+			Name             string            `json:"name"`
+			Labels           map[string]string `json:"labels"`
+			SharedNamespaces []string          `json:"shared_namespaces"`
+		}
+		json.NewDecoder(r.Body).Decode(&spec)
+		if f.lookupPod(spec.Name) != nil {
+			writeLibpodError(w, http.StatusConflict, "the pod name "+spec.Name+" is already in use")
+			return
+		}
+		f.sharedNamespaces[spec.Name] = spec.SharedNamespaces
+		f.counter++
+		pod := &PodInfo{ID: fmt.Sprintf("%064x", f.counter), Name: spec.Name, Labels: spec.Labels}
+		f.pods[pod.ID] = pod
+		writeJSON(w, http.StatusCreated, map[string]string{"Id": pod.ID})
+
+	case route == "GET pods json" && len(parts) == 2:
+		var list []map[string]interface{}
+		for _, pod := range f.pods {
+			if matchFilters(r, pod.Labels) {
+				list = append(list, map[string]interface{}{"Id": pod.ID, "Name": pod.Name, "Labels": pod.Labels, "Status": "Running"})
+			}
+		}
+		writeJSON(w, http.StatusOK, list)
+
+	case parts[0] == "pods":
+		pod := f.lookupPod(parts[1])
+		if pod == nil {
+			writeLibpodError(w, http.StatusNotFound, "no pod with name or ID "+parts[1]+" found")
+			return
+		}
+		if r.Method == http.MethodDelete {
+			for id, c := range f.containers {
+				if c.spec.Pod == pod.Name || c.spec.Pod == pod.ID {
+					delete(f.containers, id)
+				}
+			}
+			delete(f.pods, pod.ID)
+			writeJSON(w, http.StatusOK, map[string]string{"Id": pod.ID})
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{"Id": pod.ID, "Name": pod.Name, "Labels": pod.Labels})
+
+	case route == "POST networks create":
+		var network podmanNetwork
+		json.NewDecoder(r.Body).Decode(&network)
+		f.counter++
+		network.ID = fmt.Sprintf("%064x", f.counter)
+		f.networks[network.ID] = &network
+		writeJSON(w, http.StatusOK, network)
+
+	case route == "GET networks json" && len(parts) == 2:
+		list := []podmanNetwork{}
+		for _, network := range f.networks {
+			if matchFilters(r, network.Labels) {
+				list = append(list, *network)
+			}
+		}
+		writeJSON(w, http.StatusOK, list)
+
+	case parts[0] == "networks":
+		for id, network := range f.networks {
+			if id == parts[1] || network.Name == parts[1] {
+				if r.Method == http.MethodDelete {
+					delete(f.networks, id)
+					writeJSON(w, http.StatusOK, []map[string]string{{"Name": network.Name}})
+				} else {
+					writeJSON(w, http.StatusOK, network)
+				}
+				return
+			}
+		}
+		writeLibpodError(w, http.StatusNotFound, "unable to find network with name or ID "+parts[1])
+
+	default:
+		writeLibpodError(w, http.StatusNotFound, "unknown route "+route)
+	}
+}
+
+func TestPodmanContainer(t *testing.T) {
+	fake, r := newFakeLibpod(t)
+	ctx := context.Background()
+
+	if err := r.Ping(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	networkID, err := r.CreateNetwork(ctx, "pod_network", map[string]string{"role": "pod"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the image is pulled on the first create
+	id, err := r.CreateContainer(ctx, ContainerSpec{
+		Name:        "main",
+		Image:       "busybox",
+		Entrypoint:  []string{"/bin/sh", "-c"},
+		Cmd:         []string{"echo hello"},
+		Env:         []string{"A=1", "B=x=y"},
+		Labels:      map[string]string{"role": "pod", "pod": "uid-1"},
+		Mounts:      []Mount{{Source: "/data", Target: "/mnt", ReadOnly: true}, {Source: "/shared", Target: "/shared", Propagation: "shared"}},
+		Ports:       []PortBinding{{HostPort: 8080, ContainerPort: 80, Protocol: "TCP"}},
+		Resources:   Resources{Memory: 1 << 30, NanoCPUs: 1.5e9},
+		NetworkMode: "pod_network",
+		SecurityOpt: []string{"no-new-privileges", "label=disable"},
+		ExtraHosts:  []string{"db:10.0.0.2"},
+		WorkingDir:  "/work",
+		OpenStdin:   true,
+		Tty:         true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	spec := fake.containers[id].spec
+	if spec.Env["A"] != "1" || spec.Env["B"] != "x=y" || spec.Command[0] != "echo hello" || spec.Entrypoint[1] != "-c" {
+		t.Errorf("unexpected command and environment %+v", spec)
+	}
+	if spec.Mounts[0].Type != "bind" || strings.Join(spec.Mounts[0].Options, ",") != "rbind,ro" || strings.Join(spec.Mounts[1].Options, ",") != "rbind,shared" {
+		t.Errorf("unexpected mounts %+v", spec.Mounts)
+	}
+	if spec.PortMappings[0].HostPort != 8080 || spec.PortMappings[0].ContainerPort != 80 || spec.PortMappings[0].Protocol != "tcp" {
+		t.Errorf("unexpected ports %+v", spec.PortMappings)
+	}
+	if spec.ResourceLimits.Memory.Limit != 1<<30 || spec.ResourceLimits.CPU.Quota != 150000 || spec.ResourceLimits.CPU.Period != podmanCPUPeriod {
+		t.Errorf("unexpected resources %+v %+v", spec.ResourceLimits.Memory, spec.ResourceLimits.CPU)
+	}
+	if _, ok := spec.Networks["pod_network"]; !ok || spec.NetNS.NSMode != "bridge" {
+		t.Errorf("expected the container in pod_network, got %+v %+v", spec.Networks, spec.NetNS)
+	}
+	if !spec.NoNewPrivileges || spec.SelinuxOpts[0] != "disable" || spec.HostAdd[0] != "db:10.0.0.2" {
+		t.Errorf("unexpected security options %+v", spec)
+	}
+	if spec.WorkDir != "/work" || !spec.Stdin || !spec.Terminal {
+		t.Errorf("unexpected working directory and terminal %+v", spec)
+	}
+
+	// a container joining the namespaces of another one
+	joinedID, err := r.CreateContainer(ctx, ContainerSpec{Name: "sidecar", Image: "busybox", NetworkMode: "container:" + id, IpcMode: "container:" + id, PidMode: "container:" + id})
+	if err != nil {
+		t.Fatal(err)
+	}
+	joined := fake.containers[joinedID].spec
+	for _, ns := range []*podmanNamespace{joined.NetNS, joined.IpcNS, joined.PidNS} {
+		if ns == nil || ns.NSMode != "container" || ns.Value != id {
+			t.Errorf("expected the namespaces of container %s, got %+v", id, ns)
+		}
+	}
+	if len(joined.Networks) != 0 {
+		t.Errorf("expected no network, got %+v", joined.Networks)
+	}
+
+	if err := r.StartContainer(ctx, id); err != nil {
+		t.Fatal(err)
+	}
+	info, err := r.InspectContainer(ctx, "main")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.ID != id || info.Image != "busybox" || !info.State.Running || info.State.Status != "running" || info.Labels["pod"] != "uid-1" {
+		t.Errorf("unexpected inspect %+v", info)
+	}
+	if info.Networks["pod_network"] != "10.88.0.2" || !info.Mounts[0].ReadOnly || !info.State.FinishedAt.IsZero() {
+		t.Errorf("unexpected networks, mounts or times %+v", info)
+	}
+
+	fake.containers[id].logs = "hello\n"
+	logs, err := r.ContainerLogs(ctx, id, LogOptions{Tail: 10})
+	if err != nil || string(logs) != "hello\n" {
+		t.Errorf("unexpected logs %q %v", logs, err)
+	}
+
+	result, err := r.Exec(ctx, id, []string{"true"})
+	if err != nil || result.ExitCode != 3 || result.Stdout != "ok\n" || result.Stderr != "warning\n" {
+		t.Errorf("unexpected exec result %+v %v", result, err)
+	}
+
+	if err := r.UpdateContainerResources(ctx, id, Resources{Memory: 2 << 30}); err != nil {
+		t.Fatal(err)
+	}
+	if update := fake.updates[id]; update.Memory.Limit != 2<<30 || update.Memory.Swap != 2<<30 || update.CPU != nil {
+		t.Errorf("unexpected update %+v", update)
+	}
+
+	if err := r.RenameContainer(ctx, id, "renamed"); err != nil {
+		t.Fatal(err)
+	}
+	list, err := r.ListContainers(ctx, ListOptions{All: true, Labels: map[string]string{"pod": "uid-1"}})
+	if err != nil || len(list) != 1 || list[0].Name != "renamed" || !list[0].State.Running {
+		t.Errorf("unexpected list %+v %v", list, err)
+	}
+	if list, _ := r.ListContainers(ctx, ListOptions{All: true, Labels: map[string]string{"pod": "uid-2"}}); len(list) != 0 {
+		t.Errorf("expected no container of uid-2, got %+v", list)
+	}
+
+	if err := r.StopContainer(ctx, id, time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if info, err := r.InspectContainer(ctx, id); err != nil || info.State.Running {
+		t.Errorf("expected the container to be stopped, got %+v %v", info.State, err)
+	}
+
+	if err := r.RemoveContainer(ctx, id, false); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.InspectContainer(ctx, id); !IsNotFound(err) {
+		t.Errorf("expected a not found error, got %v", err)
+	}
+
+	networks, err := r.ListNetworks(ctx, ListOptions{Labels: map[string]string{"role": "pod"}})
+	if err != nil || len(networks) != 1 || networks[0].ID != networkID || networks[0].Name != "pod_network" {
+		t.Errorf("unexpected networks %+v %v", networks, err)
+	}
+	if err := r.RemoveNetwork(ctx, "pod_network"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.InspectNetwork(ctx, networkID); !IsNotFound(err) {
+		t.Errorf("expected a not found error, got %v", err)
+	}
+}
+
+func TestPodmanPod(t *testing.T) {
+	fake, r := newFakeLibpod(t)
+	ctx := context.Background()
+	fake.images["busybox"] = true
+
+	podID, err := r.CreatePod(ctx, PodSpec{Name: "uid-1_pod", Labels: map[string]string{"pod": "uid-1"}, Ports: []PortBinding{{HostPort: 8080, ContainerPort: 80}}, SharePID: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Contains(fake.sharedNamespaces["uid-1_pod"], "pid") {
+		t.Errorf("expected the pod to share its PID namespace, got %v", fake.sharedNamespaces["uid-1_pod"])
+	}
+
+	// the containers of a pod share its network namespace, and its ports are published by the pod
+	id, err := r.CreateContainer(ctx, ContainerSpec{Name: "main", Image: "busybox", Pod: "uid-1_pod", NetworkMode: "host"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if spec := fake.containers[id].spec; spec.Pod != "uid-1_pod" || spec.NetNS != nil {
+		t.Errorf("expected the container to join the network of the pod, got %+v", spec)
+	}
+	if _, err := r.CreateContainer(ctx, ContainerSpec{Name: "web", Image: "busybox", Pod: "uid-1_pod", Ports: []PortBinding{{HostPort: 80, ContainerPort: 80}}}); err == nil {
+		t.Error("expected an error for a container of a pod publishing ports")
+	}
+
+	pod, err := r.InspectPod(ctx, "uid-1_pod")
+	if err != nil || pod.ID != podID || pod.Labels["pod"] != "uid-1" {
+		t.Errorf("unexpected pod %+v %v", pod, err)
+	}
+	pods, err := r.ListPods(ctx, ListOptions{Labels: map[string]string{"pod": "uid-1"}})
+	if err != nil || len(pods) != 1 || pods[0].Name != "uid-1_pod" {
+		t.Errorf("unexpected pods %+v %v", pods, err)
+	}
+
+	// removing the pod removes its containers
+	if err := r.RemovePod(ctx, podID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.InspectContainer(ctx, id); !IsNotFound(err) {
+		t.Errorf("expected the container of the pod to be removed, got %v", err)
+	}
+	if _, err := r.InspectPod(ctx, podID); !IsNotFound(err) {
+		t.Errorf("expected a not found error, got %v", err)
+	}
+}
+
+func TestPodmanErrors(t *testing.T) {
+	fake, r := newFakeLibpod(t)
+	ctx := context.Background()
+	fake.images["busybox"] = true
+
+	if _, err := r.CreateContainer(ctx, ContainerSpec{Name: "main", Image: "busybox"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.CreateContainer(ctx, ContainerSpec{Name: "main", Image: "busybox"}); !IsConflict(err) {
+		t.Errorf("expected a conflict error, got %v", err)
+	}
+	if err := r.PullImage(ctx, "alpine", false); err != nil || !fake.images["alpine"] {
+		t.Errorf("expected the missing image to be pulled, got %v", err)
+	}
+	if err := r.PullImage(ctx, "missing", true); !IsImagePull(err) {
+		t.Errorf("expected an image pull error, got %v", err)
+	}
+	if _, err := r.CreateContainer(ctx, ContainerSpec{Name: "other", Image: "missing"}); !IsImagePull(err) || !strings.Contains(err.Error(), "manifest unknown") {
+		t.Errorf("expected the pull error, got %v", err)
+	}
+	if _, err := r.CreateContainer(ctx, ContainerSpec{Name: "other", Image: "busybox", SecurityOpt: []string{"systempaths=unconfined"}}); err == nil {
+		t.Error("expected an error for an unsupported security option")
+	}
+	if err := r.StartContainer(ctx, "unknown"); !IsNotFound(err) {
+		t.Errorf("expected a not found error, got %v", err)
+	}
+
+	unreachable, err := NewPodmanRuntime("unix://" + filepath.Join(t.TempDir(), "none.sock"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := unreachable.Ping(ctx); !errors.Is(err, ErrUnavailable) {
+		t.Errorf("expected an unavailable error, got %v", err)
+	}
+	if _, err := NewPodmanRuntime("ssh://host"); err == nil {
+		t.Error("expected an error for an unsupported endpoint")
+	}
+}
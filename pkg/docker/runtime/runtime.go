@@ -0,0 +1,245 @@
+package runtime
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// Error kinds returned (wrapped in *Error) by every ContainerRuntime implementation.
+// Use errors.Is or the Is* helpers to check them.
+var (
+	ErrNotFound    = errors.New("not found")
+	ErrConflict    = errors.New("conflict")
+	ErrUnavailable = errors.New("runtime unavailable")
+	ErrImagePull   = errors.New("image pull failed")
+)
+
+// Error is the typed error returned by a ContainerRuntime. Op is the operation that failed (e.g. "container inspect"),
+// Target the container, network or endpoint it acted on, Kind one of the Err* values above (or nil) and Err the underlying error.
+type Error struct {
+	Op     string
+	Target string
+	Kind   error
+	Err    error
+}
+
+func (e *Error) Error() string {
+	return e.Op + " " + e.Target + ": " + e.Err.Error()
+}
+
+func (e *Error) Unwrap() []error {
+	if e.Kind == nil {
+		return []error{e.Err}
+	}
+	return []error{e.Kind, e.Err}
+}
+
+// IsNotFound returns true if err reports a missing container, network or image
+func IsNotFound(err error) bool {
+	return errors.Is(err, ErrNotFound)
+}
+
+// IsConflict returns true if err reports a name already in use or an object in the wrong state
+func IsConflict(err error) bool {
+	return errors.Is(err, ErrConflict)
+}
+
+// IsImagePull returns true if err reports an image that could not be pulled
+func IsImagePull(err error) bool {
+	return errors.Is(err, ErrImagePull)
+}
+
+// imagePullError marks an error returned by an image pull as an ErrImagePull, unless the runtime itself is unavailable
+func imagePullError(err error) error {
+	var runtimeErr *Error
+	if errors.As(err, &runtimeErr) && runtimeErr.Kind != ErrUnavailable {
+		runtimeErr.Kind = ErrImagePull
+	}
+	return err
+}
+
+// Mount is a bind mount of a host path into a container
+type Mount struct {
+	Source      string `json:"source"`
+	Target      string `json:"target"`
+	ReadOnly    bool   `json:"readOnly,omitempty"`
+	Propagation string `json:"propagation,omitempty"`
+}
+
+// PortBinding publishes a container port on the host
+type PortBinding struct {
+	HostIP        string `json:"hostIP,omitempty"`
+	HostPort      int    `json:"hostPort"`
+	ContainerPort int    `json:"containerPort"`
+	Protocol      string `json:"protocol,omitempty"`
+}
+
+// Resources are the limits applied to a container. Zero values mean unlimited.
+type Resources struct {
+	Memory   int64 `json:"memory,omitempty"`
+	NanoCPUs int64 `json:"nanoCPUs,omitempty"`
+}
+
+// ContainerSpec holds everything needed to create a container
+type ContainerSpec struct {
+	Name        string            `json:"name"`
+	Image       string            `json:"image"`
+	Entrypoint  []string          `json:"entrypoint,omitempty"`
+	Cmd         []string          `json:"cmd,omitempty"`
+	Env         []string          `json:"env,omitempty"`
+	Labels      map[string]string `json:"labels,omitempty"`
+	Mounts      []Mount           `json:"mounts,omitempty"`
+	Ports       []PortBinding     `json:"ports,omitempty"`
+	Resources   Resources         `json:"resources,omitempty"`
+	NetworkMode string            `json:"networkMode,omitempty"`
+	Privileged  bool              `json:"privileged,omitempty"`
+	Runtime     string            `json:"runtime,omitempty"`
+	User        string            `json:"user,omitempty"`
+	ShmSize     int64             `json:"shmSize,omitempty"`
+	CapAdd      []string          `json:"capAdd,omitempty"`
+	CapDrop     []string          `json:"capDrop,omitempty"`
+	SecurityOpt []string          `json:"securityOpt,omitempty"`
+	ExtraHosts  []string          `json:"extraHosts,omitempty"`
+	// CgroupParent can only be set when the container is created
+	CgroupParent string `json:"cgroupParent,omitempty"`
+	// Pod is the native pod the container joins, sharing its network namespace, on runtimes implementing PodRuntime
+	Pod string `json:"pod,omitempty"`
+	// WorkingDir overrides the working directory of the image
+	WorkingDir string `json:"workingDir,omitempty"`
+	// OpenStdin keeps the stdin of the container open, StdinOnce closes it once the first attached client detaches. Tty
+	// allocates a terminal to the container.
+	OpenStdin bool `json:"openStdin,omitempty"`
+	StdinOnce bool `json:"stdinOnce,omitempty"`
+	Tty       bool `json:"tty,omitempty"`
+	// IpcMode and PidMode are the IPC and PID namespaces of the container, container:<id> joins the ones of another
+	// container
+	IpcMode string `json:"ipcMode,omitempty"`
+	PidMode string `json:"pidMode,omitempty"`
+}
+
+// ContainerState is the state of a container as reported by the engine
+type ContainerState struct {
+	Status     string    `json:"status"`
+	Running    bool      `json:"running"`
+	ExitCode   int       `json:"exitCode"`
+	OOMKilled  bool      `json:"oomKilled"`
+	Error      string    `json:"error,omitempty"`
+	StartedAt  time.Time `json:"startedAt"`
+	FinishedAt time.Time `json:"finishedAt"`
+}
+
+// ContainerInfo is the structured result of a container inspect or list
+type ContainerInfo struct {
+	ID       string            `json:"id"`
+	Name     string            `json:"name"`
+	Image    string            `json:"image"`
+	ImageID  string            `json:"imageID"`
+	Labels   map[string]string `json:"labels,omitempty"`
+	Env      []string          `json:"env,omitempty"`
+	Mounts   []Mount           `json:"mounts,omitempty"`
+	Networks map[string]string `json:"networks,omitempty"`
+	State    ContainerState    `json:"state"`
+}
+
+// NetworkInfo is the structured result of a network inspect or list
+type NetworkInfo struct {
+	ID     string            `json:"id"`
+	Name   string            `json:"name"`
+	Driver string            `json:"driver"`
+	Labels map[string]string `json:"labels,omitempty"`
+}
+
+// PodInfo is the structured result of a pod inspect or list
+type PodInfo struct {
+	ID     string            `json:"id"`
+	Name   string            `json:"name"`
+	Labels map[string]string `json:"labels,omitempty"`
+}
+
+// ListOptions filters containers and networks returned by the List calls
+type ListOptions struct {
+	// All includes stopped containers
+	All bool
+	// Labels keeps only objects carrying all the given labels. An empty value matches any value of the key.
+	Labels map[string]string
+}
+
+// LogOptions selects which logs are returned by ContainerLogs
+type LogOptions struct {
+	Timestamps bool
+	// Tail is the number of lines to return from the end of the logs, 0 means all
+	Tail int
+	// Since returns only logs produced after this time, if not zero
+	Since time.Time
+}
+
+// ExecResult is the outcome of a command executed inside a running container
+type ExecResult struct {
+	ExitCode int
+	Stdout   string
+	Stderr   string
+}
+
+// ContainerRuntime is the typed client layer used by the sidecar to drive a container engine, either the host daemon
+// or the daemon running inside a DIND container.
+type ContainerRuntime interface {
+	Ping(ctx context.Context) error
+
+	// PullImage pulls an image, unless always is false and the image is already present. CreateContainer pulls the
+	// missing images too.
+	PullImage(ctx context.Context, ref string, always bool) error
+	CreateContainer(ctx context.Context, spec ContainerSpec) (string, error)
+	StartContainer(ctx context.Context, id string) error
+	// StopContainer sends the stop signal of a container, then kills it if it is still running after timeout
+	StopContainer(ctx context.Context, id string, timeout time.Duration) error
+	RemoveContainer(ctx context.Context, id string, force bool) error
+	RenameContainer(ctx context.Context, id string, newName string) error
+	InspectContainer(ctx context.Context, id string) (ContainerInfo, error)
+	// UpdateContainerResources changes the CPU and memory limits of a container, even while it runs
+	UpdateContainerResources(ctx context.Context, id string, resources Resources) error
+	ListContainers(ctx context.Context, opts ListOptions) ([]ContainerInfo, error)
+	ContainerLogs(ctx context.Context, id string, opts LogOptions) ([]byte, error)
+	// Exec runs cmd in a running container and waits for it to exit, or for ctx to be done
+	Exec(ctx context.Context, id string, cmd []string) (ExecResult, error)
+
+	CreateNetwork(ctx context.Context, name string, labels map[string]string) (string, error)
+	InspectNetwork(ctx context.Context, id string) (NetworkInfo, error)
+	RemoveNetwork(ctx context.Context, id string) error
+	ListNetworks(ctx context.Context, opts ListOptions) ([]NetworkInfo, error)
+
+	// Inner returns a runtime talking to the daemon listening at endpoint (e.g. unix:///path/docker.sock),
+	// used to reach the daemon running inside a DIND container.
+	Inner(endpoint string) (ContainerRuntime, error)
+	// Forget closes the runtime returned by Inner for endpoint, once the daemon listening there is gone
+	Forget(endpoint string)
+}
+
+// PodSpec describes a native pod
+type PodSpec struct {
+	Name   string            `json:"name"`
+	Labels map[string]string `json:"labels,omitempty"`
+	Ports  []PortBinding     `json:"ports,omitempty"`
+	// SharePID makes the containers of the pod share a PID namespace, in addition to the network and IPC ones
+	SharePID bool `json:"sharePID,omitempty"`
+}
+
+// PodRuntime is implemented by the runtimes able to group containers in native pods, whose containers share the network
+// namespace of the pod. The ports of the containers of a pod are published by the pod itself.
+type PodRuntime interface {
+	CreatePod(ctx context.Context, spec PodSpec) (string, error)
+	InspectPod(ctx context.Context, id string) (PodInfo, error)
+	// RemovePod removes a pod along with its containers
+	RemovePod(ctx context.Context, id string) error
+	ListPods(ctx context.Context, opts ListOptions) ([]PodInfo, error)
+}
+
+func matchLabels(labels map[string]string, filter map[string]string) bool {
+	for k, v := range filter {
+		value, ok := labels[k]
+		if !ok || (v != "" && value != v) {
+			return false
+		}
+	}
+	return true
+}
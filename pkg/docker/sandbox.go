@@ -0,0 +1,324 @@
+package docker
+
+import (
+	"fmt"
+
+	"github.com/containerd/containerd/log"
+	v1 "k8s.io/api/core/v1"
+
+	commonIL "github.com/intertwin-eu/interlink-docker-plugin/pkg/common"
+	"github.com/intertwin-eu/interlink-docker-plugin/pkg/docker/dindmanager"
+	"github.com/intertwin-eu/interlink-docker-plugin/pkg/docker/runtime"
+)
+
+// podSandbox is where the containers of a pod run: its DIND container, or its bridge network on the host docker daemon
+// in host mode
+type podSandbox struct {
+	// Runtime is the runtime the containers of the pod are created in
+	Runtime runtime.ContainerRuntime
+	// JobID is returned to interLink: the ID of the DIND container, or of the network of the pod in host mode
+	JobID string
+	// DindID is the ID of the DIND container, empty in host mode
+	DindID    string
+	NetworkID string
+	// NetworkMode is the network mode of the containers of the pod
+	NetworkMode string
+	// Pod is the native pod the containers of the pod join in host mode, on runtimes implementing runtime.PodRuntime
+	Pod string
+	// Infra is the infra container whose network and IPC namespaces, and PID namespace if SharePID, the containers of
+	// the pod join. Native pods have their own.
+	Infra    string
+	SharePID bool
+	// IP is the address of the pod: the one of the DIND container, or of the infra container in host mode. It is empty
+	// if unknown, e.g. for native pods.
+	IP string
+	// Failure explains why the containers of the pod cannot run anymore, FailureReason is its short form
+	Failure       string
+	FailureReason string
+}
+
+func (h *SidecarHandler) hostMode() bool {
+	return h.Config.ExecutionMode == commonIL.ExecutionModeHost
+}
+
+// hostSandboxName returns the name of the object grouping the containers of a pod in host mode: a native pod on
+// runtimes implementing runtime.PodRuntime, a bridge network otherwise
+func (h *SidecarHandler) hostSandboxName(podUID string) string {
+	if _, ok := h.Runtime.(runtime.PodRuntime); ok {
+		return podUID + "_pod"
+	}
+	return podUID + "_network"
+}
+
+// inspectHostSandbox returns the native pod or the network grouping the containers of a pod in host mode
+func (h *SidecarHandler) inspectHostSandbox(name string) (runtime.PodInfo, error) {
+	if podRuntime, ok := h.Runtime.(runtime.PodRuntime); ok {
+		return podRuntime.InspectPod(h.Ctx, name)
+	}
+	network, err := h.Runtime.InspectNetwork(h.Ctx, name)
+	return runtime.PodInfo{ID: network.ID, Name: network.Name, Labels: network.Labels}, err
+}
+
+// listHostSandboxes returns the native pods or the networks grouping the containers of the pods in host mode
+func (h *SidecarHandler) listHostSandboxes(labels map[string]string) ([]runtime.PodInfo, error) {
+	if podRuntime, ok := h.Runtime.(runtime.PodRuntime); ok {
+		return podRuntime.ListPods(h.Ctx, runtime.ListOptions{Labels: labels})
+	}
+	networks, err := h.Runtime.ListNetworks(h.Ctx, runtime.ListOptions{Labels: labels})
+	var sandboxes []runtime.PodInfo
+	for _, network := range networks {
+		sandboxes = append(sandboxes, runtime.PodInfo{ID: network.ID, Name: network.Name, Labels: network.Labels})
+	}
+	return sandboxes, err
+}
+
+// removeHostSandbox removes the native pod or the network grouping the containers of a pod in host mode
+func (h *SidecarHandler) removeHostSandbox(id string) error {
+	if podRuntime, ok := h.Runtime.(runtime.PodRuntime); ok {
+		return podRuntime.RemovePod(h.Ctx, id)
+	}
+	return h.Runtime.RemoveNetwork(h.Ctx, id)
+}
+
+// attach returns runSpec with the namespaces of the sandbox. The ports of the containers are published by the native
+// pod or the infra container.
+func (s podSandbox) attach(runSpec DockerRunSpec) DockerRunSpec {
+	runSpec.NetworkMode = s.NetworkMode
+	if s.Pod != "" {
+		runSpec.Pod = s.Pod
+		runSpec.Ports = nil
+	} else if s.Infra != "" {
+		runSpec.NetworkMode = "container:" + s.Infra
+		runSpec.IpcMode = "container:" + s.Infra
+		if s.SharePID {
+			runSpec.PidMode = "container:" + s.Infra
+		}
+		runSpec.Ports = nil
+	}
+	return runSpec
+}
+
+// podPorts returns the ports published by the containers of a pod
+func podPorts(runSpecs []DockerRunSpec) []runtime.PortBinding {
+	var ports []runtime.PortBinding
+	for _, runSpec := range runSpecs {
+		ports = append(ports, runSpec.Ports...)
+	}
+	return ports
+}
+
+// createSandbox prepares the sandbox of a new pod, whose containers are described by runSpecs
+func (h *SidecarHandler) createSandbox(pod *v1.Pod, runSpecs []DockerRunSpec) (podSandbox, error) {
+	podUID := string(pod.UID)
+	podNamespace := pod.Namespace
+	labels := map[string]string{
+		dindmanager.LabelInstance: h.Config.InstanceID,
+		dindmanager.LabelRole:     dindmanager.RolePod,
+		LabelPodUID:               podUID,
+		LabelPodNamespace:         podNamespace,
+		LabelPodName:              pod.Name,
+	}
+	sharePID := pod.Spec.ShareProcessNamespace != nil && *pod.Spec.ShareProcessNamespace
+
+	var sandbox podSandbox
+	if h.hostMode() {
+		name := h.hostSandboxName(podUID)
+
+		if podRuntime, ok := h.Runtime.(runtime.PodRuntime); ok {
+			// the containers share the namespaces of the native pod, which publishes their ports
+			podID, err := podRuntime.CreatePod(h.Ctx, runtime.PodSpec{Name: name, Labels: labels, Ports: podPorts(runSpecs), SharePID: sharePID})
+			if err != nil {
+				return podSandbox{}, fmt.Errorf("unable to create the native pod of the pod: %w", err)
+			}
+			return podSandbox{Runtime: h.Runtime, JobID: podID, NetworkID: podID, Pod: name}, nil
+		}
+
+		networkID, err := h.Runtime.CreateNetwork(h.Ctx, name, labels)
+		if err != nil {
+			return podSandbox{}, fmt.Errorf("unable to create the network of the pod: %w", err)
+		}
+		sandbox = podSandbox{Runtime: h.Runtime, JobID: networkID, NetworkID: networkID, NetworkMode: name}
+	} else {
+		var err error
+		sandbox, err = h.createDindSandbox(podUID, podNamespace, runSpecs)
+		if err != nil {
+			return podSandbox{}, err
+		}
+	}
+
+	// the infra container holds the namespaces shared by the containers of the pod, and publishes their ports
+	infra := DockerRunSpec{
+		Name:        podUID + "_infra",
+		Image:       h.Config.InfraImage,
+		Labels:      labels,
+		NetworkMode: sandbox.NetworkMode,
+		IpcMode:     "shareable",
+	}
+	if sandbox.NetworkMode != "host" {
+		infra.Ports = podPorts(runSpecs)
+	}
+	err := h.runContainer(sandbox.Runtime, infra)
+	if err != nil {
+		return sandbox, fmt.Errorf("unable to start the infra container of the pod: %w", err)
+	}
+	sandbox.Infra = infra.Name
+	sandbox.SharePID = sharePID
+
+	if sandbox.DindID != "" {
+		// the DIND container cannot publish ports, since it was created before the pod
+		ports := podPortMappings(runSpecs)
+		if len(ports) > 0 && sandbox.IP == "" {
+			return sandbox, fmt.Errorf("unable to publish the ports of the pod: the DIND container has no address")
+		}
+		err = h.ports.forward(h.Ctx, podUID, ports, sandbox.IP)
+		if err != nil {
+			return sandbox, err
+		}
+	} else {
+		sandbox.IP = h.infraAddress(podUID, sandbox.NetworkMode)
+	}
+
+	return sandbox, nil
+}
+
+// createDindSandbox acquires the DIND container of a new pod
+func (h *SidecarHandler) createDindSandbox(podUID string, podNamespace string, runSpecs []DockerRunSpec) (podSandbox, error) {
+	// the DIND container is limited to the resources of the containers of the pod
+	dindResourceLimits, err := dindResources(h.Config, runSpecs)
+	if err != nil {
+		return podSandbox{}, err
+	}
+
+	// reserve a DIND container for the pod
+	dindSpec, err := h.DindManager.AcquireDind(podUID, dindCgroupParent(h.Config, podNamespace))
+	if err != nil {
+		return podSandbox{}, fmt.Errorf("unable to acquire a DIND container: %w", err)
+	}
+
+	if dindResourceLimits.Memory != 0 || dindResourceLimits.NanoCPUs != 0 {
+		err = h.Runtime.UpdateContainerResources(h.Ctx, dindSpec.DindID, dindResourceLimits)
+		if err != nil {
+			return podSandbox{}, fmt.Errorf("unable to update the resources of the DIND container: %w", err)
+		}
+		log.G(h.Ctx).Info(fmt.Sprintf("\u2705 [POD FLOW] DIND container limited to %d bytes of memory and %d nano CPUs", dindResourceLimits.Memory, dindResourceLimits.NanoCPUs))
+	}
+
+	// rename the container to the pod UID
+	err = h.Runtime.RenameContainer(h.Ctx, dindSpec.DindID, podUID+"_dind")
+	if err != nil {
+		return podSandbox{}, fmt.Errorf("unable to rename the DIND container: %w", err)
+	}
+
+	innerRuntime, dind, err := h.dindRuntime(podUID)
+	if err != nil {
+		return podSandbox{}, fmt.Errorf("unable to connect to the docker daemon of the DIND container: %w", err)
+	}
+
+	// the infra container shares the network of the DIND container
+	return podSandbox{Runtime: innerRuntime, JobID: dindSpec.DindID, DindID: dindSpec.DindID, NetworkID: dindSpec.DindNetworkID, NetworkMode: "host", IP: dindAddress(dind, dindSpec.DindNetworkID)}, nil
+}
+
+// dindAddress returns the address of a DIND container on its network
+func dindAddress(dind runtime.ContainerInfo, networkID string) string {
+	if address := dind.Networks[networkID]; address != "" {
+		return address
+	}
+	for _, address := range dind.Networks {
+		if address != "" {
+			return address
+		}
+	}
+	return ""
+}
+
+// infraAddress returns the address of the infra container of a pod on the network of the pod in host mode, empty if
+// unknown
+func (h *SidecarHandler) infraAddress(podUID string, network string) string {
+	infra, err := h.Runtime.InspectContainer(h.Ctx, podUID+"_infra")
+	if err != nil {
+		return ""
+	}
+	return infra.Networks[network]
+}
+
+// getSandbox returns the sandbox of an existing pod. If the pod is known but its sandbox cannot run containers anymore,
+// the Failure of the sandbox is set. A not found error is returned if the pod is unknown.
+func (h *SidecarHandler) getSandbox(podUID string) (podSandbox, error) {
+	if h.hostMode() {
+		name := h.hostSandboxName(podUID)
+		hostSandbox, err := h.inspectHostSandbox(name)
+		if runtime.IsNotFound(err) {
+			if _, ok := h.StateStore.GetPod(podUID); ok {
+				return podSandbox{Failure: name + " does not exist anymore", FailureReason: "SandboxNotFound"}, nil
+			}
+			return podSandbox{}, err
+		} else if err != nil {
+			return podSandbox{}, err
+		}
+		if _, ok := h.Runtime.(runtime.PodRuntime); ok {
+			return podSandbox{Runtime: h.Runtime, JobID: hostSandbox.ID, NetworkID: hostSandbox.ID, Pod: name}, nil
+		}
+		return podSandbox{Runtime: h.Runtime, JobID: hostSandbox.ID, NetworkID: hostSandbox.ID, NetworkMode: name, IP: h.infraAddress(podUID, name)}, nil
+	}
+
+	// a pod whose DIND container died is failed, along with all its containers
+	dindSpec, dindSpecErr := h.DindManager.GetDindFromPodUID(podUID)
+	if dindSpecErr == nil && dindSpec.State == dindmanager.DindFailed {
+		return podSandbox{JobID: dindSpec.DindID, DindID: dindSpec.DindID, Failure: dindSpec.Message, FailureReason: "DindFailed"}, nil
+	}
+
+	// retrieve the dind container of the pod and the runtime of the docker daemon inside of it
+	innerRuntime, dind, err := h.dindRuntime(podUID)
+	if runtime.IsNotFound(err) && dindSpecErr == nil {
+		return podSandbox{JobID: dindSpec.DindID, DindID: dindSpec.DindID, Failure: "DIND container " + podUID + "_dind does not exist anymore", FailureReason: "DindFailed"}, nil
+	} else if err != nil {
+		return podSandbox{}, err
+	}
+
+	sandbox := podSandbox{Runtime: innerRuntime, JobID: dind.ID, DindID: dind.ID, NetworkID: dindSpec.DindNetworkID, NetworkMode: "host", IP: dindAddress(dind, dindSpec.DindNetworkID)}
+	if !dind.State.Running {
+		sandbox.Failure = fmt.Sprintf("DIND container %s is %s (exit code %d)", dind.Name, dind.State.Status, dind.State.ExitCode)
+		sandbox.FailureReason = "DindFailed"
+	}
+	return sandbox, nil
+}
+
+// removeSandbox removes the sandbox of a pod along with its containers. Removing a missing sandbox is not an error.
+func (h *SidecarHandler) removeSandbox(podUID string) error {
+	h.workers.stop(podUID)
+	h.images.stop(podUID)
+	h.probes.stop(podUID)
+	h.supervisor.stop(podUID)
+
+	if h.hostMode() {
+		containers, err := h.Runtime.ListContainers(h.Ctx, runtime.ListOptions{All: true, Labels: map[string]string{dindmanager.LabelInstance: h.Config.InstanceID, LabelPodUID: podUID}})
+		if err != nil {
+			return err
+		}
+		for _, container := range containers {
+			err = h.Runtime.RemoveContainer(h.Ctx, container.ID, true)
+			if err != nil && !runtime.IsNotFound(err) {
+				return err
+			}
+		}
+
+		err = h.removeHostSandbox(h.hostSandboxName(podUID))
+		if err != nil && !runtime.IsNotFound(err) {
+			return err
+		}
+		return nil
+	}
+
+	// the DIND container is destroyed along with its network
+	h.ports.stop(podUID)
+	err := h.DindManager.ReleaseDind(podUID)
+	if err != nil {
+		log.G(h.Ctx).Warning("\u26A0 Error releasing the DIND container of pod " + podUID + ", maybe it is not known anymore: " + err.Error())
+
+		err = h.Runtime.RemoveContainer(h.Ctx, podUID+"_dind", true)
+		if err != nil && !runtime.IsNotFound(err) {
+			return err
+		}
+	}
+	return nil
+}
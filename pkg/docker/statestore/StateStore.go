@@ -0,0 +1,163 @@
+package statestore
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+
+	commonIL "github.com/intertwin-eu/interlink-docker-plugin/pkg/common"
+)
+
+// PodRecord is what the sidecar must remember about a pod to keep managing it after a restart
+type PodRecord struct {
+	PodUID       string `json:"podUID"`
+	PodNamespace string `json:"podNamespace"`
+	PodName      string `json:"podName"`
+	// DindID is the pool name of the DIND container assigned to the pod, before it was renamed to <podUID>_dind
+	DindID        string `json:"dindID"`
+	DindNetworkID string `json:"dindNetworkID"`
+	// GPUs holds the indexes of the GPUs assigned to each container, by docker container name
+	GPUs map[string][]string `json:"gpus,omitempty"`
+	// RestartCounts holds the number of restarts of each container, by container name
+	RestartCounts map[string]int32 `json:"restartCounts,omitempty"`
+	// Ports are the container ports of the pod published on the host
+	Ports        []commonIL.PortMapping `json:"ports,omitempty"`
+	PodDirectory string                 `json:"podDirectory"`
+	// Phase is the phase of the creation of the pod, Running once its containers were started. Message explains why
+	// the creation failed.
+	Phase   string `json:"phase,omitempty"`
+	Message string `json:"message,omitempty"`
+	// Pod and RunSpecs are what the creation of the pod needs to be resumed after a restart of the plugin: the pod as
+	// created, and the JSON encoded run specs of its init containers and containers
+	Pod       *v1.Pod         `json:"pod,omitempty"`
+	RunSpecs  json.RawMessage `json:"runSpecs,omitempty"`
+	CreatedAt time.Time       `json:"createdAt"`
+}
+
+type state struct {
+	Pods map[string]PodRecord `json:"pods"`
+}
+
+// StateStore persists the pod records in a JSON file, rewritten atomically on every change
+type StateStore struct {
+	path  string
+	mutex sync.Mutex
+	state state
+}
+
+// Open loads the StateStore saved at path, or returns an empty one if the file does not exist yet
+func Open(path string) (*StateStore, error) {
+	store := &StateStore{path: path, state: state{Pods: map[string]PodRecord{}}}
+
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return store, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	err = json.Unmarshal(data, &store.state)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse state file %s: %v", path, err)
+	}
+	if store.state.Pods == nil {
+		store.state.Pods = map[string]PodRecord{}
+	}
+	return store, nil
+}
+
+// save writes the state to a temporary file and renames it, so that a crash never leaves a truncated state file
+func (s *StateStore) save() error {
+	data, err := json.MarshalIndent(s.state, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	err = os.MkdirAll(filepath.Dir(s.path), os.ModePerm)
+	if err != nil {
+		return err
+	}
+
+	tmpFile, err := os.CreateTemp(filepath.Dir(s.path), filepath.Base(s.path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpFile.Name())
+
+	_, err = tmpFile.Write(data)
+	if err == nil {
+		err = tmpFile.Sync()
+	}
+	if closeErr := tmpFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmpFile.Name(), s.path)
+}
+
+// Pods returns all the pod records, sorted by creation time
+func (s *StateStore) Pods() []PodRecord {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	pods := make([]PodRecord, 0, len(s.state.Pods))
+	for _, pod := range s.state.Pods {
+		pods = append(pods, pod)
+	}
+	sort.Slice(pods, func(i, j int) bool { return pods[i].CreatedAt.Before(pods[j].CreatedAt) })
+	return pods
+}
+
+// GetPod returns the record of a pod, if any
+func (s *StateStore) GetPod(podUID string) (PodRecord, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	pod, ok := s.state.Pods[podUID]
+	return pod, ok
+}
+
+// PutPod creates or replaces the record of a pod
+func (s *StateStore) PutPod(pod PodRecord) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.state.Pods[pod.PodUID] = pod
+	return s.save()
+}
+
+// UpdatePod changes the record of a pod with update, atomically with respect to the other changes of the store.
+// Updating a missing record does nothing, so that a deleted record is never written back.
+func (s *StateStore) UpdatePod(podUID string, update func(pod *PodRecord)) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	pod, ok := s.state.Pods[podUID]
+	if !ok {
+		return nil
+	}
+	update(&pod)
+	s.state.Pods[podUID] = pod
+	return s.save()
+}
+
+// DeletePod removes the record of a pod. Removing a missing record is not an error.
+func (s *StateStore) DeletePod(podUID string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if _, ok := s.state.Pods[podUID]; !ok {
+		return nil
+	}
+	delete(s.state.Pods, podUID)
+	return s.save()
+}
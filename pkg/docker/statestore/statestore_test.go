@@ -0,0 +1,90 @@
+package statestore
+
+import (
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestStateStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "jobs", "state.json")
+
+	store, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pod := PodRecord{
+		PodUID:        "uid-1",
+		PodNamespace:  "default",
+		PodName:       "test-pod",
+		DindID:        "pool_dind",
+		DindNetworkID: "pool_dind_network",
+		GPUs:          map[string][]string{"default-uid-1-main": {"0", "1"}},
+		PodDirectory:  "/data/default-uid-1",
+		CreatedAt:     time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC),
+	}
+	if err := store.PutPod(pod); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.PutPod(PodRecord{PodUID: "uid-2", CreatedAt: pod.CreatedAt.Add(time.Minute)}); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.DeletePod("uid-2"); err != nil {
+		t.Fatal(err)
+	}
+
+	// a new StateStore, as after a restart, reads back the records
+	reopened, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pods := reopened.Pods()
+	if len(pods) != 1 || !reflect.DeepEqual(pods[0], pod) {
+		t.Errorf("unexpected pods after reopening: %+v", pods)
+	}
+	if err := reopened.DeletePod("missing"); err != nil {
+		t.Errorf("deleting a missing pod should not fail: %v", err)
+	}
+}
+
+func TestUpdatePod(t *testing.T) {
+	store, err := Open(filepath.Join(t.TempDir(), "state.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.PutPod(PodRecord{PodUID: "uid-1"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// concurrent updates are not lost
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := store.UpdatePod("uid-1", func(pod *PodRecord) {
+				pod.RestartCounts = map[string]int32{"main": pod.RestartCounts["main"] + 1}
+			})
+			if err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	if pod, _ := store.GetPod("uid-1"); pod.RestartCounts["main"] != 20 {
+		t.Errorf("expected 20 restarts, got %v", pod.RestartCounts)
+	}
+
+	// a deleted record is not written back
+	if err := store.DeletePod("uid-1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.UpdatePod("uid-1", func(pod *PodRecord) { pod.Phase = "Running" }); err != nil {
+		t.Fatal(err)
+	}
+	if pod, ok := store.GetPod("uid-1"); ok {
+		t.Errorf("expected the deleted record to stay deleted, got %+v", pod)
+	}
+}
@@ -0,0 +1,365 @@
+package docker
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/containerd/containerd/log"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/intertwin-eu/interlink-docker-plugin/pkg/docker/runtime"
+)
+
+// supervisorInterval is how often the supervisor of a pod checks its containers
+var supervisorInterval = time.Second
+
+// the crash loop back-off of the kubelet: the first restart is immediate, the next ones wait twice as long as the
+// previous one, up to maxRestartBackoff. The back-off is reset once the container ran for restartBackoffReset.
+const (
+	initialRestartBackoff = 10 * time.Second
+	maxRestartBackoff     = 5 * time.Minute
+	restartBackoffReset   = 10 * time.Minute
+)
+
+// the limits of the termination messages of the kubelet: the message written by a container is truncated to
+// maxTerminationMessageLength bytes, the one taken from its logs to the last maxTerminationMessageLogLines lines and
+// maxTerminationMessageLogLength bytes
+const (
+	maxTerminationMessageLength    = 4096
+	maxTerminationMessageLogLines  = 80
+	maxTerminationMessageLogLength = 2048
+)
+
+// containerRestarts holds the restarts of a container
+type containerRestarts struct {
+	restartCount    int32
+	lastTermination *v1.ContainerStateTerminated
+	// handled is the end of the run whose restart is scheduled at retryAt, backoff the delay before the next restart
+	handled time.Time
+	retryAt time.Time
+	backoff time.Duration
+}
+
+type podSupervisor struct {
+	cancel     context.CancelFunc
+	mutex      sync.Mutex
+	containers map[string]*containerRestarts
+	// completed is set once the containers of the pod exited for good and its sidecars were stopped
+	completed bool
+	// ended is closed once the supervise goroutine returned
+	ended chan struct{}
+}
+
+// supervisorManager restarts the containers of the pods according to their restart policy
+type supervisorManager struct {
+	mutex sync.Mutex
+	pods  map[string]*podSupervisor
+}
+
+// restartStatus is what the status of a container needs to know about its restarts
+type restartStatus struct {
+	RestartCount    int32
+	LastTermination *v1.ContainerStateTerminated
+	// Backoff is the delay before the pending restart of the container, if any
+	Backoff time.Duration
+}
+
+// restartsOnExit returns whether a container exiting with exitCode is restarted under policy. Pods default to Always.
+func restartsOnExit(policy v1.RestartPolicy, exitCode int) bool {
+	switch policy {
+	case v1.RestartPolicyNever:
+		return false
+	case v1.RestartPolicyOnFailure:
+		return exitCode != 0
+	default:
+		return true
+	}
+}
+
+// isSidecar returns whether an init container is a native sidecar, which keeps running along with the containers
+func isSidecar(container v1.Container) bool {
+	return container.RestartPolicy != nil && *container.RestartPolicy == v1.ContainerRestartPolicyAlways
+}
+
+// sidecars returns the native sidecars of a pod, in the order of its init containers
+func sidecars(pod *v1.Pod) []v1.Container {
+	var sidecars []v1.Container
+	for _, container := range pod.Spec.InitContainers {
+		if isSidecar(container) {
+			sidecars = append(sidecars, container)
+		}
+	}
+	return sidecars
+}
+
+// stop stops supervising the containers of a pod and waits for the supervisor to return, so that it does not restart
+// nor count anything anymore
+func (m *supervisorManager) stop(podUID string) {
+	m.mutex.Lock()
+	supervisor, ok := m.pods[podUID]
+	if ok {
+		supervisor.cancel()
+		delete(m.pods, podUID)
+	}
+	m.mutex.Unlock()
+
+	if ok {
+		<-supervisor.ended
+	}
+}
+
+// status returns the restarts of a container
+func (m *supervisorManager) status(podUID string, containerName string) restartStatus {
+	m.mutex.Lock()
+	supervisor, ok := m.pods[podUID]
+	m.mutex.Unlock()
+	if !ok {
+		return restartStatus{}
+	}
+
+	supervisor.mutex.Lock()
+	defer supervisor.mutex.Unlock()
+	restarts, ok := supervisor.containers[containerName]
+	if !ok {
+		return restartStatus{}
+	}
+	status := restartStatus{RestartCount: restarts.restartCount, LastTermination: restarts.lastTermination}
+	if !restarts.retryAt.IsZero() {
+		status.Backoff = max(time.Until(restarts.retryAt), 0)
+	}
+	return status
+}
+
+// completed returns whether the containers of a pod exited for good, so that its sidecars were stopped
+func (m *supervisorManager) completed(podUID string) bool {
+	m.mutex.Lock()
+	supervisor, ok := m.pods[podUID]
+	m.mutex.Unlock()
+	if !ok {
+		return false
+	}
+
+	supervisor.mutex.Lock()
+	defer supervisor.mutex.Unlock()
+	return supervisor.completed
+}
+
+// startSupervisor starts supervising the containers of a pod, unless they are already supervised. The restart counts
+// are taken back from the state store.
+func (h *SidecarHandler) startSupervisor(pod *v1.Pod, sandbox podSandbox) {
+	podUID := string(pod.UID)
+
+	h.supervisor.mutex.Lock()
+	defer h.supervisor.mutex.Unlock()
+	if _, ok := h.supervisor.pods[podUID]; ok {
+		return
+	}
+	if h.supervisor.pods == nil {
+		h.supervisor.pods = map[string]*podSupervisor{}
+	}
+
+	record, _ := h.StateStore.GetPod(podUID)
+	ctx, cancel := context.WithCancel(h.Ctx)
+	supervisor := &podSupervisor{cancel: cancel, ended: make(chan struct{}), containers: map[string]*containerRestarts{}}
+	for _, container := range append(sidecars(pod), pod.Spec.Containers...) {
+		supervisor.containers[container.Name] = &containerRestarts{restartCount: record.RestartCounts[container.Name]}
+	}
+	h.supervisor.pods[podUID] = supervisor
+
+	go h.supervise(ctx, pod, h.probeTarget(podUID, sandbox), supervisor, supervisorInterval)
+}
+
+// supervise restarts the containers of a pod that exit, according to the restart policy of the pod, until ctx is done.
+// The sidecars of the pod are always restarted, until the containers exited for good: they are then stopped, so that
+// the pod completes. The postStart hooks of the restarted containers run in target.
+func (h *SidecarHandler) supervise(ctx context.Context, pod *v1.Pod, target probeTarget, supervisor *podSupervisor, interval time.Duration) {
+	defer close(supervisor.ended)
+
+	for {
+		supervisor.mutex.Lock()
+		completed := supervisor.completed
+		supervisor.mutex.Unlock()
+
+		if !completed {
+			exited := true
+			for _, container := range pod.Spec.Containers {
+				exited = h.superviseContainer(ctx, pod, target, supervisor, container, pod.Spec.RestartPolicy) && exited
+			}
+
+			if !exited {
+				for _, container := range sidecars(pod) {
+					h.superviseContainer(ctx, pod, target, supervisor, container, v1.RestartPolicyAlways)
+				}
+			} else if len(sidecars(pod)) > 0 {
+				h.stopSidecars(ctx, pod, target)
+				supervisor.mutex.Lock()
+				supervisor.completed = true
+				supervisor.mutex.Unlock()
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(interval):
+		}
+	}
+}
+
+// superviseContainer restarts a container of a pod if it exited and policy says so. It returns whether the container
+// exited for good.
+func (h *SidecarHandler) superviseContainer(ctx context.Context, pod *v1.Pod, target probeTarget, supervisor *podSupervisor, container v1.Container, policy v1.RestartPolicy) bool {
+	podUID := string(pod.UID)
+	name := container.Name
+	containerName := pod.Namespace + "-" + podUID + "-" + name
+	containerRuntime := target.runtime
+
+	info, err := containerRuntime.InspectContainer(ctx, containerName)
+	if err != nil {
+		return false
+	}
+
+	supervisor.mutex.Lock()
+	restarts := supervisor.containers[name]
+	if info.State.Running {
+		if time.Since(info.State.StartedAt) >= restartBackoffReset {
+			restarts.backoff = 0
+		}
+		supervisor.mutex.Unlock()
+		return false
+	}
+	if info.State.Status != "exited" && info.State.Status != "dead" {
+		supervisor.mutex.Unlock()
+		return false
+	}
+	if !restartsOnExit(policy, info.State.ExitCode) {
+		supervisor.mutex.Unlock()
+		return true
+	}
+
+	now := time.Now()
+	if restarts.retryAt.IsZero() || !info.State.FinishedAt.Equal(restarts.handled) {
+		// a new termination: the restart is scheduled after the back-off
+		restarts.handled = info.State.FinishedAt
+		restarts.retryAt = now.Add(restarts.backoff)
+		if restarts.backoff == 0 {
+			restarts.backoff = initialRestartBackoff
+		} else {
+			restarts.backoff = min(2*restarts.backoff, maxRestartBackoff)
+		}
+		if restarts.retryAt.After(now) {
+			log.G(h.Ctx).Warning(fmt.Sprintf("\u26A0 Container %s exited with code %d, back-off %s before restarting it", containerName, info.State.ExitCode, restarts.retryAt.Sub(now)))
+		}
+	}
+	if now.Before(restarts.retryAt) {
+		supervisor.mutex.Unlock()
+		return false
+	}
+	supervisor.mutex.Unlock()
+
+	// the termination message is read before the restarted container overwrites it
+	lastTermination := h.terminatedState(ctx, containerRuntime, container, info)
+	err = containerRuntime.StartContainer(ctx, containerName)
+	if err != nil {
+		log.G(h.Ctx).Error("\u274C Error restarting container " + containerName + ": " + err.Error())
+		return false
+	}
+
+	supervisor.mutex.Lock()
+	restarts.restartCount++
+	restarts.retryAt = time.Time{}
+	restarts.lastTermination = lastTermination
+	restartCount := restarts.restartCount
+	supervisor.mutex.Unlock()
+
+	log.G(h.Ctx).Info(fmt.Sprintf("\u2705 Container %s restarted (restart %d)", containerName, restartCount))
+
+	// the restart counts survive a restart of the plugin
+	h.countRestart(podUID, name)
+
+	h.postStart(ctx, pod, container, target)
+	return false
+}
+
+// stopSidecars stops the sidecars of a pod whose containers exited for good, in the reverse order of their start, within
+// the termination grace period of the pod
+func (h *SidecarHandler) stopSidecars(ctx context.Context, pod *v1.Pod, target probeTarget) {
+	deadline := time.Now().Add(terminationGracePeriod(pod))
+	podSidecars := sidecars(pod)
+	for i := len(podSidecars) - 1; i >= 0; i-- {
+		h.stopContainer(ctx, pod, podSidecars[i], target, deadline)
+	}
+}
+
+// terminatedState returns the terminated state of an exited container, with the reasons of the kubelet and the
+// termination message of the container
+func (h *SidecarHandler) terminatedState(ctx context.Context, containerRuntime runtime.ContainerRuntime, container v1.Container, info runtime.ContainerInfo) *v1.ContainerStateTerminated {
+	reason := "Completed"
+	if info.State.OOMKilled {
+		reason = "OOMKilled"
+	} else if info.State.ExitCode != 0 {
+		reason = "Error"
+	}
+	message := h.terminationMessage(ctx, containerRuntime, container, info)
+	if message == "" {
+		message = info.State.Error
+	}
+	return &v1.ContainerStateTerminated{
+		ExitCode:    int32(info.State.ExitCode),
+		Reason:      reason,
+		Message:     message,
+		StartedAt:   metav1.NewTime(info.State.StartedAt),
+		FinishedAt:  metav1.NewTime(info.State.FinishedAt),
+		ContainerID: h.containerID(info),
+	}
+}
+
+// terminationMessage returns the termination message of an exited container, like the kubelet: the content of its
+// terminationMessagePath, or the tail of its logs if it failed without writing it and its terminationMessagePolicy is
+// FallbackToLogsOnError
+func (h *SidecarHandler) terminationMessage(ctx context.Context, containerRuntime runtime.ContainerRuntime, container v1.Container, info runtime.ContainerInfo) string {
+	if container.TerminationMessagePath != "" {
+		for _, mount := range info.Mounts {
+			if mount.Target != container.TerminationMessagePath {
+				continue
+			}
+			message, err := readTerminationMessage(mount.Source)
+			if err != nil && !os.IsNotExist(err) {
+				log.G(h.Ctx).Warning("\u26A0 Unable to read the termination message of container " + container.Name + ": " + err.Error())
+			}
+			if message != "" {
+				return message
+			}
+		}
+	}
+
+	if container.TerminationMessagePolicy != v1.TerminationMessageFallbackToLogsOnError || info.State.ExitCode == 0 {
+		return ""
+	}
+	logs, err := containerRuntime.ContainerLogs(ctx, info.ID, runtime.LogOptions{Tail: maxTerminationMessageLogLines})
+	if err != nil {
+		log.G(h.Ctx).Warning("\u26A0 Unable to read the logs of container " + container.Name + " for its termination message: " + err.Error())
+		return ""
+	}
+	if len(logs) > maxTerminationMessageLogLength {
+		logs = logs[len(logs)-maxTerminationMessageLogLength:]
+	}
+	return string(logs)
+}
+
+// readTerminationMessage reads a termination message file, up to maxTerminationMessageLength bytes
+func readTerminationMessage(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	message, err := io.ReadAll(io.LimitReader(file, maxTerminationMessageLength))
+	return string(message), err
+}
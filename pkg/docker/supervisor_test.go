@@ -0,0 +1,92 @@
+package docker
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+
+	commonIL "github.com/intertwin-eu/interlink-docker-plugin/pkg/common"
+	"github.com/intertwin-eu/interlink-docker-plugin/pkg/docker/runtime"
+	"github.com/intertwin-eu/interlink-docker-plugin/pkg/docker/statestore"
+)
+
+func TestRestartsOnExit(t *testing.T) {
+	for _, test := range []struct {
+		policy   v1.RestartPolicy
+		exitCode int
+		restart  bool
+	}{
+		{"", 0, true},
+		{v1.RestartPolicyAlways, 0, true},
+		{v1.RestartPolicyAlways, 1, true},
+		{v1.RestartPolicyOnFailure, 0, false},
+		{v1.RestartPolicyOnFailure, 1, true},
+		{v1.RestartPolicyNever, 1, false},
+	} {
+		if restart := restartsOnExit(test.policy, test.exitCode); restart != test.restart {
+			t.Errorf("policy %q, exit code %d: expected restart %v, got %v", test.policy, test.exitCode, test.restart, restart)
+		}
+	}
+}
+
+func TestSupervisor(t *testing.T) {
+	defer func(interval time.Duration) { supervisorInterval = interval }(supervisorInterval)
+	supervisorInterval = 10 * time.Millisecond
+
+	h, fakeRuntime := newTestHandler(t)
+	ctx := context.Background()
+	pod := testPod("1", "crashing", "done")
+	pod.Spec.RestartPolicy = v1.RestartPolicyOnFailure
+	innerRuntime := startTestDind(t, fakeRuntime, string(pod.UID))
+	startTestContainer(t, innerRuntime, "default-uid-1-crashing")
+	startTestContainer(t, innerRuntime, "default-uid-1-done")
+	if err := h.StateStore.PutPod(statestore.PodRecord{PodUID: "uid-1", PodNamespace: "default", PodName: "test-pod"}); err != nil {
+		t.Fatal(err)
+	}
+
+	h.startSupervisor(pod, podSandbox{Runtime: innerRuntime})
+	defer h.supervisor.stop("uid-1")
+
+	// a failed container is restarted at once the first time, a completed one is left alone under OnFailure
+	crashed := time.Now()
+	innerRuntime.SetState("default-uid-1-crashing", runtime.ContainerState{Status: "exited", ExitCode: 2, StartedAt: crashed.Add(-time.Second), FinishedAt: crashed})
+	innerRuntime.SetState("default-uid-1-done", runtime.ContainerState{Status: "exited", ExitCode: 0, FinishedAt: crashed})
+	waitFor(t, "the failed container to be restarted", func() bool {
+		return h.supervisor.status("uid-1", "crashing").RestartCount == 1
+	})
+	if info, _ := innerRuntime.InspectContainer(ctx, "default-uid-1-done"); info.State.Running {
+		t.Error("expected the completed container not to be restarted")
+	}
+	if record, _ := h.StateStore.GetPod("uid-1"); record.RestartCounts["crashing"] != 1 {
+		t.Errorf("expected the restart count to be recorded, got %v", record.RestartCounts)
+	}
+
+	// the next restart waits for the back-off
+	innerRuntime.SetState("default-uid-1-crashing", runtime.ContainerState{Status: "exited", ExitCode: 2, StartedAt: crashed, FinishedAt: time.Now()})
+	waitFor(t, "the back-off of the failed container", func() bool {
+		return h.supervisor.status("uid-1", "crashing").Backoff > 0
+	})
+
+	recorder := doRequest(t, h.StatusHandler, []*v1.Pod{pod})
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("unexpected status code %d: %s", recorder.Code, recorder.Body.String())
+	}
+	var resp []commonIL.PodStatus
+	if err := json.Unmarshal(recorder.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	crashing := resp[0].Containers[0]
+	if crashing.State.Waiting == nil || crashing.State.Waiting.Reason != "CrashLoopBackOff" || crashing.RestartCount != 1 {
+		t.Errorf("expected the failed container to be in CrashLoopBackOff, got %+v", crashing)
+	}
+	if crashing.LastTerminationState.Terminated == nil || crashing.LastTerminationState.Terminated.ExitCode != 2 {
+		t.Errorf("expected the last termination of the failed container, got %+v", crashing.LastTerminationState)
+	}
+	if done := resp[0].Containers[1]; done.State.Terminated == nil || done.RestartCount != 0 {
+		t.Errorf("expected the completed container to be terminated, got %+v", done)
+	}
+}
@@ -1,12 +1,65 @@
 package docker
 
-type DockerRunStruct struct {
+import (
+	commonIL "github.com/intertwin-eu/interlink-docker-plugin/pkg/common"
+	"github.com/intertwin-eu/interlink-docker-plugin/pkg/docker/runtime"
+)
+
+// Labels set on every object the sidecar creates for a pod
+const (
+	LabelPodUID        = "interlink.eu/pod-uid"
+	LabelPodNamespace  = "interlink.eu/pod-namespace"
+	LabelPodName       = "interlink.eu/pod-name"
+	LabelContainerName = "interlink.eu/container-name"
+)
+
+// DockerRunSpec is the typed description of a container of a pod, translated from its v1.Container by prepareDockerRuns.
+// It is rendered to a runtime.ContainerSpec to create the container, or to a docker run command line for debugging.
+type DockerRunSpec struct {
 	Name            string `json:"name"`
-	Command         string `json:"command"`
+	ContainerName   string `json:"containerName"`
+	Image           string `json:"image"`
 	IsInitContainer bool   `json:"isInitContainer"`
-	GpuArgs         string `json:"gpuArgs"`
+	// IsSidecar marks the init containers with restartPolicy Always, which keep running along with the containers
+	IsSidecar  bool                  `json:"isSidecar,omitempty"`
+	Entrypoint []string              `json:"entrypoint,omitempty"`
+	Args       []string              `json:"args,omitempty"`
+	Env        []string              `json:"env,omitempty"`
+	Mounts     []runtime.Mount       `json:"mounts,omitempty"`
+	Ports      []runtime.PortBinding `json:"ports,omitempty"`
+	Resources  runtime.Resources     `json:"resources"`
+	// GPUs holds the indexes of the NVIDIA devices assigned to the container
+	GPUs        []string `json:"gpus,omitempty"`
+	Privileged  bool     `json:"privileged,omitempty"`
+	NetworkMode string   `json:"networkMode,omitempty"`
+	// Pod is the native pod the container joins, see runtime.PodRuntime
+	Pod string `json:"pod,omitempty"`
+	// IpcMode and PidMode are the IPC and PID namespaces of the container, the ones of the infra container of the pod
+	IpcMode string            `json:"ipcMode,omitempty"`
+	PidMode string            `json:"pidMode,omitempty"`
+	Labels  map[string]string `json:"labels,omitempty"`
+	// WorkingDir, Stdin, StdinOnce and TTY are the ones of the container
+	WorkingDir string `json:"workingDir,omitempty"`
+	Stdin      bool   `json:"stdin,omitempty"`
+	StdinOnce  bool   `json:"stdinOnce,omitempty"`
+	TTY        bool   `json:"tty,omitempty"`
+	// Options are the flags set through the docker-options.vk.io/flags annotation
+	Options DockerOptions `json:"options"`
 }
+
+// DockerOptions are the docker run flags supported in the docker-options.vk.io/flags annotation
+type DockerOptions struct {
+	User        string   `json:"user,omitempty"`
+	ShmSize     int64    `json:"shmSize,omitempty"`
+	CapAdd      []string `json:"capAdd,omitempty"`
+	CapDrop     []string `json:"capDrop,omitempty"`
+	SecurityOpt []string `json:"securityOpt,omitempty"`
+	ExtraHosts  []string `json:"extraHosts,omitempty"`
+}
+
 type CreateStruct struct {
 	PodUID string `json:"PodUID"`
 	PodJID string `json:"PodJID"`
+	// Ports are the container ports of the pod published on the host
+	Ports []commonIL.PortMapping `json:"ports,omitempty"`
 }
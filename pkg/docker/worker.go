@@ -0,0 +1,339 @@
+package docker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/containerd/containerd/log"
+	v1 "k8s.io/api/core/v1"
+
+	"github.com/intertwin-eu/interlink-docker-plugin/pkg/docker/runtime"
+	"github.com/intertwin-eu/interlink-docker-plugin/pkg/docker/statestore"
+)
+
+// the phases of the creation of a pod by its worker, recorded in the state store
+const (
+	workerPulling      = "Pulling"
+	workerInitializing = "Initializing"
+	workerRunning      = "Running"
+	workerFailed       = "Failed"
+)
+
+// initContainerPollInterval is how often the worker of a pod checks whether its init containers exited
+var initContainerPollInterval = time.Second
+
+// initContainerBackoff is the delay before restarting a failed init container, doubled after each failure up to
+// maxRestartBackoff
+var initContainerBackoff = initialRestartBackoff
+
+// errInitContainerFailed is returned when an init container of a pod exits with a non-zero code: the pod is failed
+var errInitContainerFailed = errors.New("init container failed")
+
+// workerManager runs the workers creating the containers of the pods in the background
+type workerManager struct {
+	mutex sync.Mutex
+	pods  map[string]*podWorker
+	// done tracks the running workers, so that their end can be waited for
+	done sync.WaitGroup
+}
+
+type podWorker struct {
+	cancel context.CancelFunc
+	// ended is closed once the worker returned
+	ended chan struct{}
+}
+
+// stop stops the worker of a pod, if it is still creating its containers, and waits for it to return, so that it does
+// not start anything anymore
+func (m *workerManager) stop(podUID string) {
+	m.mutex.Lock()
+	worker, ok := m.pods[podUID]
+	if ok {
+		worker.cancel()
+		delete(m.pods, podUID)
+	}
+	m.mutex.Unlock()
+
+	if ok {
+		<-worker.ended
+	}
+}
+
+// finish records the end of the worker of a pod
+func (m *workerManager) finish(podUID string, worker *podWorker) {
+	m.mutex.Lock()
+	if m.pods[podUID] == worker {
+		delete(m.pods, podUID)
+	}
+	m.mutex.Unlock()
+
+	worker.cancel()
+	close(worker.ended)
+	m.done.Done()
+}
+
+// wait waits for the end of the running workers, e.g. once they were stopped
+func (m *workerManager) wait() {
+	m.done.Wait()
+}
+
+// running returns whether the worker of a pod is still creating its containers
+func (m *workerManager) running(podUID string) bool {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	_, ok := m.pods[podUID]
+	return ok
+}
+
+// startWorker creates the containers of a pod in the background, from phase: it pulls their images, runs the init
+// containers until they exit, then runs the containers along with their supervisor and probes. Each phase is recorded
+// in the state store, so that a creation interrupted by a restart of the plugin is resumed from the phase it reached.
+func (h *SidecarHandler) startWorker(pod *v1.Pod, sandbox podSandbox, podDirectoryPath string, initContainers []DockerRunSpec, containers []DockerRunSpec, phase string) {
+	podUID := string(pod.UID)
+
+	h.workers.mutex.Lock()
+	if h.workers.pods == nil {
+		h.workers.pods = map[string]*podWorker{}
+	}
+	ctx, cancel := context.WithCancel(h.Ctx)
+	worker := &podWorker{cancel: cancel, ended: make(chan struct{})}
+	h.workers.pods[podUID] = worker
+	h.workers.done.Add(1)
+	h.workers.mutex.Unlock()
+
+	pullBackoff, pollInterval, initBackoff := initialImagePullBackoff, initContainerPollInterval, initContainerBackoff
+	go func() {
+		defer h.workers.finish(podUID, worker)
+
+		var err error
+		if phase == workerPulling {
+			err = h.pullImages(ctx, pod, sandbox.Runtime, pullBackoff)
+			if err == nil && ctx.Err() == nil {
+				h.setPodPhase(podUID, workerInitializing, "")
+			}
+		}
+		if err == nil && ctx.Err() == nil {
+			err = h.runInitContainers(ctx, pod, sandbox, podDirectoryPath, initContainers, pollInterval, initBackoff)
+		}
+		if err == nil && ctx.Err() == nil {
+			err = h.runContainers(ctx, pod, sandbox, podDirectoryPath, containers)
+		}
+		if ctx.Err() != nil {
+			// the pod was deleted while it was created
+			return
+		}
+
+		if err != nil {
+			log.G(h.Ctx).Error("\u274C [POD FLOW] Error creating the containers of pod " + podUID + ": " + err.Error())
+			h.setPodPhase(podUID, workerFailed, err.Error())
+			return
+		}
+		h.setPodPhase(podUID, workerRunning, "")
+		log.G(h.Ctx).Info("\u2705 [POD FLOW] Containers of pod " + podUID + " created successfully")
+	}()
+}
+
+// setPodPhase records the phase of the creation of a pod in the state store
+func (h *SidecarHandler) setPodPhase(podUID string, phase string, message string) {
+	err := h.StateStore.UpdatePod(podUID, func(record *statestore.PodRecord) {
+		record.Phase = phase
+		record.Message = message
+	})
+	if err != nil {
+		log.G(h.Ctx).Error("\u274C Error recording the phase of pod " + podUID + ": " + err.Error())
+	}
+}
+
+// runInitContainers runs the init containers of a pod one after the other, each once the previous one completed, or
+// started for sidecars. A failed init container is restarted after a back-off, unless the restart policy of the pod is
+// Never: the pod is then failed. Sidecars are always restarted.
+func (h *SidecarHandler) runInitContainers(ctx context.Context, pod *v1.Pod, sandbox podSandbox, podDirectoryPath string, initContainers []DockerRunSpec, pollInterval time.Duration, backoff time.Duration) error {
+	if len(initContainers) == 0 {
+		return nil
+	}
+	innerRuntime := sandbox.Runtime
+	target := h.probeTarget(string(pod.UID), sandbox)
+
+	log.G(h.Ctx).Info("\u2705 [POD FLOW] Start creating init containers")
+
+	// the equivalent docker commands are written to a script, only for debugging
+	err := writeDebugScript(podDirectoryPath+"/init_containers_command.sh", initContainers)
+	if err != nil {
+		return fmt.Errorf("creation of the init container script file: %w", err)
+	}
+
+	for _, initContainer := range initContainers {
+		started, err := h.resumeContainer(ctx, innerRuntime, initContainer)
+		if err != nil {
+			return fmt.Errorf("creation of init container %s: %w", initContainer.ContainerName, err)
+		}
+		container, _ := podContainer(pod, initContainer.ContainerName)
+		if started {
+			h.postStart(ctx, pod, container, target)
+		}
+
+		if initContainer.IsSidecar {
+			// the next init container waits for the startup probe of the sidecar, unless the pod is being deleted
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			h.startProbes(pod, sandbox)
+		}
+
+		containerBackoff := backoff
+		for {
+			var started bool
+			var exitCode int
+			if initContainer.IsSidecar {
+				started, exitCode, err = h.waitForStart(ctx, innerRuntime, string(pod.UID), initContainer, pollInterval)
+			} else {
+				exitCode, err = h.waitForExit(ctx, innerRuntime, initContainer.Name, pollInterval)
+				started = err == nil && exitCode == 0
+			}
+			if err != nil {
+				return fmt.Errorf("inspect of init container %s: %w", initContainer.ContainerName, err)
+			}
+			if started {
+				break
+			}
+			if !initContainer.IsSidecar && pod.Spec.RestartPolicy == v1.RestartPolicyNever {
+				// the containers of the pod are not started, the pod is failed
+				return fmt.Errorf("init container %s exited with code %d: %w", initContainer.ContainerName, exitCode, errInitContainerFailed)
+			}
+
+			log.G(h.Ctx).Warning(fmt.Sprintf("\u26A0 Init container %s exited with code %d, back-off %s before restarting it", initContainer.Name, exitCode, containerBackoff))
+			h.countRestart(string(pod.UID), initContainer.ContainerName)
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(containerBackoff):
+			}
+			containerBackoff = min(2*containerBackoff, maxRestartBackoff)
+
+			err = innerRuntime.StartContainer(ctx, initContainer.Name)
+			if err != nil {
+				return fmt.Errorf("restart of init container %s: %w", initContainer.ContainerName, err)
+			}
+			h.postStart(ctx, pod, container, target)
+		}
+		if initContainer.IsSidecar {
+			log.G(h.Ctx).Info("\u2705 [POD FLOW] Sidecar " + initContainer.ContainerName + " started")
+		} else {
+			log.G(h.Ctx).Info("\u2705 [POD FLOW] Init container " + initContainer.ContainerName + " completed")
+		}
+	}
+
+	log.G(h.Ctx).Info("\u2705 [POD FLOW] Init containers created and executed successfully")
+	return nil
+}
+
+// resumeContainer creates and starts the container of runSpec. When the creation of its pod is resumed after a restart
+// of the plugin, the container may already exist: it is then only started if it never was. It returns whether the
+// container was started.
+func (h *SidecarHandler) resumeContainer(ctx context.Context, containerRuntime runtime.ContainerRuntime, runSpec DockerRunSpec) (bool, error) {
+	containerInfo, err := containerRuntime.InspectContainer(ctx, runSpec.Name)
+	if runtime.IsNotFound(err) {
+		return true, h.runContainer(containerRuntime, runSpec)
+	} else if err != nil {
+		return false, err
+	}
+	if containerInfo.State.Status != "created" {
+		return false, nil
+	}
+	return true, containerRuntime.StartContainer(ctx, runSpec.Name)
+}
+
+// waitForExit polls a container until it exits, and returns its exit code
+func (h *SidecarHandler) waitForExit(ctx context.Context, containerRuntime runtime.ContainerRuntime, containerName string, pollInterval time.Duration) (int, error) {
+	for {
+		containerInfo, err := containerRuntime.InspectContainer(ctx, containerName)
+		if err != nil {
+			return 0, err
+		}
+		if containerInfo.State.Status == "exited" || containerInfo.State.Status == "dead" {
+			return containerInfo.State.ExitCode, nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return 0, ctx.Err()
+		case <-time.After(pollInterval):
+		}
+	}
+}
+
+// waitForStart polls a sidecar until it runs and its startup probe succeeded, or until it exits. It returns whether it
+// started, or its exit code.
+func (h *SidecarHandler) waitForStart(ctx context.Context, containerRuntime runtime.ContainerRuntime, podUID string, runSpec DockerRunSpec, pollInterval time.Duration) (bool, int, error) {
+	for {
+		containerInfo, err := containerRuntime.InspectContainer(ctx, runSpec.Name)
+		if err != nil {
+			return false, 0, err
+		}
+		if containerInfo.State.Status == "exited" || containerInfo.State.Status == "dead" {
+			return false, containerInfo.State.ExitCode, nil
+		}
+		if started, _ := h.probes.status(podUID, runSpec.ContainerName); containerInfo.State.Running && started {
+			return true, 0, nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return false, 0, ctx.Err()
+		case <-time.After(pollInterval):
+		}
+	}
+}
+
+// countRestart records a restart of a container of a pod in the state store
+func (h *SidecarHandler) countRestart(podUID string, containerName string) {
+	err := h.StateStore.UpdatePod(podUID, func(record *statestore.PodRecord) {
+		// the map is copied, since the records returned by the store share it
+		restartCounts := map[string]int32{containerName: record.RestartCounts[containerName] + 1}
+		for container, count := range record.RestartCounts {
+			if container != containerName {
+				restartCounts[container] = count
+			}
+		}
+		record.RestartCounts = restartCounts
+	})
+	if err != nil {
+		log.G(h.Ctx).Error("\u274C Error recording the restarts of container " + containerName + " of pod " + podUID + ": " + err.Error())
+	}
+}
+
+// runContainers runs the containers of a pod, each once the postStart hook of the previous one completed, along with
+// their supervisor and probes
+func (h *SidecarHandler) runContainers(ctx context.Context, pod *v1.Pod, sandbox podSandbox, podDirectoryPath string, containers []DockerRunSpec) error {
+	// the equivalent docker commands are written to a script, only for debugging
+	err := writeDebugScript(podDirectoryPath+"/containers_command.sh", containers)
+	if err != nil {
+		return fmt.Errorf("creation of the container commands script: %w", err)
+	}
+
+	log.G(h.Ctx).Info("\u2705 [POD FLOW] Containers commands written to the script file")
+
+	target := h.probeTarget(string(pod.UID), sandbox)
+	for _, runSpec := range containers {
+		started, err := h.resumeContainer(ctx, sandbox.Runtime, runSpec)
+		if err != nil {
+			return fmt.Errorf("creation of container %s: %w", runSpec.ContainerName, err)
+		}
+		container, _ := podContainer(pod, runSpec.ContainerName)
+		if started {
+			h.postStart(ctx, pod, container, target)
+		}
+	}
+
+	// the pod may have been deleted meanwhile: its containers are then not restarted nor probed anymore
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	h.startSupervisor(pod, sandbox)
+	h.startProbes(pod, sandbox)
+	return nil
+}